@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/scaleops/k8s-optimizer/internal/config"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Annotations workload owners can set on a workload or its pod template to
+// control the optimizer. Pod annotations take precedence over the owner's.
+const (
+	annotationPrefix            = "k8s-optimizer.scaleops.io/"
+	annotationExclude           = annotationPrefix + "exclude"            // "true" skips the workload
+	annotationExcludeContainers = annotationPrefix + "exclude-containers" // comma-separated container names
+	annotationPercentile        = annotationPrefix + "percentile"         // e.g. "0.99"
+	annotationBuffer            = annotationPrefix + "buffer"             // e.g. "0.3"
+	annotationMinCPU            = annotationPrefix + "min-cpu"            // quantity, e.g. "100m"
+	annotationMinMemory         = annotationPrefix + "min-memory"         // quantity, e.g. "256Mi"
+)
+
+// workloadOverrides are the optimizer settings read from annotations.
+// Unset tuning values are invalid (Valid false) and leave the policy alone.
+type workloadOverrides struct {
+	Excluded           bool
+	ExcludedContainers map[string]bool
+	Percentile         sql.NullFloat64
+	Buffer             sql.NullFloat64
+	MinCPU             sql.NullFloat64
+	MinMemory          sql.NullInt64
+}
+
+// ownerAnnotations returns the annotations of the pod's top-level workload
+// from the informer cache, or nil for bare pods and owners not cached.
+func (c *Collector) ownerAnnotations(namespace string, ref workloadRef) map[string]string {
+	var annotations map[string]string
+	var err error
+
+	switch ref.Kind {
+	case "Deployment":
+		deployment, getErr := c.deploymentLister.Deployments(namespace).Get(ref.Name)
+		if err = getErr; err == nil {
+			annotations = deployment.Annotations
+		}
+	case "StatefulSet":
+		set, getErr := c.statefulSetLister.StatefulSets(namespace).Get(ref.Name)
+		if err = getErr; err == nil {
+			annotations = set.Annotations
+		}
+	case "DaemonSet":
+		set, getErr := c.daemonSetLister.DaemonSets(namespace).Get(ref.Name)
+		if err = getErr; err == nil {
+			annotations = set.Annotations
+		}
+	case "ReplicaSet":
+		rs, getErr := c.replicaSetLister.ReplicaSets(namespace).Get(ref.Name)
+		if err = getErr; err == nil {
+			annotations = rs.Annotations
+		}
+	case "CronJob":
+		job, getErr := c.cronJobLister.CronJobs(namespace).Get(ref.Name)
+		if err = getErr; err == nil {
+			annotations = job.Annotations
+		}
+	case "Job":
+		job, getErr := c.jobLister.Jobs(namespace).Get(ref.Name)
+		if err = getErr; err == nil {
+			annotations = job.Annotations
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read annotations of %s %s/%s: %v", ref.Kind, namespace, ref.Name, err)
+	}
+
+	return annotations
+}
+
+// parseOverrides reads the optimizer annotations of the owner and the pod.
+// Malformed values are logged and ignored.
+func parseOverrides(pod *corev1.Pod, ownerAnnotations map[string]string) workloadOverrides {
+	merged := make(map[string]string)
+	for k, v := range ownerAnnotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			merged[k] = v
+		}
+	}
+	for k, v := range pod.Annotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			merged[k] = v
+		}
+	}
+
+	o := workloadOverrides{ExcludedContainers: make(map[string]bool)}
+	invalid := func(key, value string) {
+		log.Printf("Warning: ignoring invalid annotation %s=%q on pod %s/%s", key, value, pod.Namespace, pod.Name)
+	}
+
+	if v, ok := merged[annotationExclude]; ok {
+		excluded, err := strconv.ParseBool(v)
+		if err != nil {
+			invalid(annotationExclude, v)
+		}
+		o.Excluded = excluded
+	}
+	if v, ok := merged[annotationExcludeContainers]; ok {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				o.ExcludedContainers[name] = true
+			}
+		}
+	}
+	if v, ok := merged[annotationPercentile]; ok {
+		if p, err := strconv.ParseFloat(v, 64); err == nil && p > 0 && p <= 1 {
+			o.Percentile = sql.NullFloat64{Float64: p, Valid: true}
+		} else {
+			invalid(annotationPercentile, v)
+		}
+	}
+	if v, ok := merged[annotationBuffer]; ok {
+		if b, err := strconv.ParseFloat(v, 64); err == nil && b >= 0 {
+			o.Buffer = sql.NullFloat64{Float64: b, Valid: true}
+		} else {
+			invalid(annotationBuffer, v)
+		}
+	}
+	if v, ok := merged[annotationMinCPU]; ok {
+		if q, err := resource.ParseQuantity(v); err == nil {
+			o.MinCPU = sql.NullFloat64{Float64: q.AsApproximateFloat64(), Valid: true}
+		} else {
+			invalid(annotationMinCPU, v)
+		}
+	}
+	if v, ok := merged[annotationMinMemory]; ok {
+		if q, err := resource.ParseQuantity(v); err == nil {
+			o.MinMemory = sql.NullInt64{Int64: q.Value(), Valid: true}
+		} else {
+			invalid(annotationMinMemory, v)
+		}
+	}
+
+	return o
+}
+
+// apply overrides the policy's tuning with the annotation values and lists
+// the ones that took effect.
+func (o workloadOverrides) apply(policy config.AnalysisPolicy) (config.AnalysisPolicy, []string) {
+	var applied []string
+	if o.Percentile.Valid {
+		policy.Percentile = o.Percentile.Float64
+		applied = append(applied, "percentile="+strconv.FormatFloat(o.Percentile.Float64, 'g', -1, 64))
+	}
+	if o.Buffer.Valid {
+		policy.Buffer = o.Buffer.Float64
+		applied = append(applied, "buffer="+strconv.FormatFloat(o.Buffer.Float64, 'g', -1, 64))
+	}
+	if o.MinCPU.Valid {
+		policy.MinCPU = o.MinCPU.Float64
+		applied = append(applied, "min-cpu="+strconv.FormatFloat(o.MinCPU.Float64, 'g', -1, 64))
+	}
+	if o.MinMemory.Valid {
+		policy.MinMemory = o.MinMemory.Int64
+		applied = append(applied, "min-memory="+strconv.FormatInt(o.MinMemory.Int64, 10))
+	}
+	return policy, applied
+}
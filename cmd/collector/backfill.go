@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/scaleops/k8s-optimizer/internal/metrics"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// backfillBatchSize bounds the rows per multi-row INSERT (4 parameters each).
+const backfillBatchSize = 1000
+
+// backfillTarget is a workload container with no stored usage yet.
+type backfillTarget struct {
+	namespace     string
+	workload      workloadRef
+	overrides     workloadOverrides
+	containerName string
+}
+
+func (t backfillTarget) String() string {
+	return fmt.Sprintf("%s/%s %s/%s", t.namespace, t.workload.Kind, t.workload.Name, t.containerName)
+}
+
+// backfill loads the longest analysis policy window of history from Prometheus for
+// every workload container in scope the collector has no samples for, so a
+// freshly deployed optimizer can produce confident recommendations
+// immediately. Targets come from the informer cache rather than the database,
+// so workloads are backfilled before their first live sample is stored.
+func (c *Collector) backfill(ctx context.Context) error {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	stored, err := c.containersWithHistory()
+	if err != nil {
+		return err
+	}
+	var targets []backfillTarget
+	for _, t := range c.backfillTargets(pods) {
+		if !stored[t.String()] {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	log.Printf("Backfilling history for %d workload containers from Prometheus...", len(targets))
+
+	end := time.Now()
+	start := end.Add(-time.Duration(c.config.Analysis.Policies.MaxWindowDays()) * 24 * time.Hour)
+
+	// Samples older than the rollup watermarks must be rolled up again
+	if err := c.rewindRollups(start); err != nil {
+		return fmt.Errorf("failed to rewind rollups: %w", err)
+	}
+
+	for _, t := range targets {
+		history, err := c.history.History(ctx, c.historyQuery(t, start, end))
+		if err != nil {
+			log.Printf("Warning: failed to backfill %s: %v", t, err)
+			continue
+		}
+
+		workloadID, err := c.storeWorkload(t.namespace, t.workload, t.overrides)
+		if err != nil {
+			log.Printf("Warning: failed to store backfilled workload %s: %v", t, err)
+			continue
+		}
+
+		total := 0
+		for key, samples := range history {
+			if len(samples) == 0 {
+				continue
+			}
+			containerID, err := c.storeHistoricalContainer(workloadID, key, samples)
+			if err != nil {
+				log.Printf("Warning: failed to store backfilled container %s/%s/%s: %v", key.Namespace, key.Pod, key.Container, err)
+				continue
+			}
+			if err := c.insertSamples(containerID, samples); err != nil {
+				log.Printf("Warning: failed to store backfilled metrics for %s/%s/%s: %v", key.Namespace, key.Pod, key.Container, err)
+				continue
+			}
+			total += len(samples)
+		}
+
+		log.Printf("  Backfilled %s: %d samples from %d pods", t, total, len(history))
+	}
+
+	return nil
+}
+
+// backfillTargets returns the workload containers of the pods in scope,
+// skipping excluded workloads and containers.
+func (c *Collector) backfillTargets(pods []*corev1.Pod) []backfillTarget {
+	seen := make(map[string]bool)
+	var targets []backfillTarget
+	for _, pod := range pods {
+		if !c.shouldCollect(pod) {
+			continue
+		}
+		ref, err := c.resolveWorkload(pod)
+		if err != nil {
+			continue
+		}
+		overrides := parseOverrides(pod, c.ownerAnnotations(pod.Namespace, ref))
+		if overrides.Excluded {
+			continue
+		}
+
+		for _, container := range pod.Spec.Containers {
+			t := backfillTarget{namespace: pod.Namespace, workload: ref, overrides: overrides, containerName: container.Name}
+			if overrides.ExcludedContainers[container.Name] || seen[t.String()] {
+				continue
+			}
+			seen[t.String()] = true
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// containersWithHistory returns the workload containers with stored usage at
+// any resolution, keyed like backfillTarget.String.
+func (c *Collector) containersWithHistory() (map[string]bool, error) {
+	rows, err := c.db.Query(`
+		SELECT DISTINCT w.namespace, w.kind, w.name, c.container_name
+		FROM containers c
+		JOIN pods p ON p.id = c.pod_id
+		JOIN workloads w ON w.id = p.workload_id
+		WHERE EXISTS (SELECT 1 FROM metrics_snapshots m WHERE m.container_id = c.id)
+			OR EXISTS (SELECT 1 FROM metrics_hourly h WHERE h.container_id = c.id)
+			OR EXISTS (SELECT 1 FROM metrics_daily d WHERE d.container_id = c.id)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var t backfillTarget
+		if err := rows.Scan(&t.namespace, &t.workload.Kind, &t.workload.Name, &t.containerName); err != nil {
+			return nil, err
+		}
+		stored[t.String()] = true
+	}
+	return stored, rows.Err()
+}
+
+// historyQuery selects the target's usage across every pod its workload
+// created.
+func (c *Collector) historyQuery(t backfillTarget, start, end time.Time) metrics.HistoryQuery {
+	return metrics.HistoryQuery{
+		Namespace:  t.namespace,
+		PodPattern: podPattern(t.workload.Kind, t.workload.Name),
+		Container:  t.containerName,
+		Start:      start,
+		End:        end,
+		Step:       c.config.Analysis.CollectionInterval,
+	}
+}
+
+// storeHistoricalContainer makes sure a pod seen only in Prometheus history
+// has pod and container rows under the workload, without bumping updated_at
+// of pods the collector already tracks. Backfilled pods gone from the cluster
+// are stored as deleted at their last sample.
+func (c *Collector) storeHistoricalContainer(workloadID int64, key metrics.ContainerKey, samples []metrics.Sample) (int64, error) {
+	firstSeen := samples[0].Timestamp
+	lastSeen := samples[len(samples)-1].Timestamp
+	deletedAt := c.backfilledDeletedAt(key, lastSeen)
+
+	var podID int64
+	err := c.db.QueryRow(`
+		INSERT INTO pods (namespace, pod_name, workload_id, created_at, updated_at, first_seen_at, last_seen_at, backfilled, deleted_at)
+		VALUES ($1, $2, $3, $4, $5, $4, $5, true, $6)
+		ON CONFLICT (namespace, pod_name) DO UPDATE SET workload_id = $3,
+			deleted_at = CASE WHEN pods.backfilled THEN $6 ELSE pods.deleted_at END
+		RETURNING id
+	`, key.Namespace, key.Pod, workloadID, firstSeen, lastSeen, deletedAt).Scan(&podID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert pod: %w", err)
+	}
+
+	var containerID int64
+	err = c.db.QueryRow(`
+		INSERT INTO containers (pod_id, container_name, created_at, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (pod_id, container_name) DO UPDATE SET container_name = EXCLUDED.container_name
+		RETURNING id
+	`, podID, key.Container, firstSeen, lastSeen).Scan(&containerID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert container: %w", err)
+	}
+
+	return containerID, nil
+}
+
+// backfilledDeletedAt returns when a pod seen in history was deleted: never
+// while the informer cache has it, else at its last sample.
+func (c *Collector) backfilledDeletedAt(key metrics.ContainerKey, lastSeen time.Time) *time.Time {
+	if _, err := c.podLister.Pods(key.Namespace).Get(key.Pod); err == nil {
+		return nil
+	}
+	return &lastSeen
+}
+
+// insertSamples bulk-inserts usage samples in batched multi-row statements.
+func (c *Collector) insertSamples(containerID int64, samples []metrics.Sample) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(samples); start += backfillBatchSize {
+		end := start + backfillBatchSize
+		if end > len(samples) {
+			end = len(samples)
+		}
+
+		var sb strings.Builder
+		sb.WriteString("INSERT INTO metrics_snapshots (container_id, timestamp, cpu_usage, memory_usage) VALUES ")
+		args := make([]interface{}, 0, (end-start)*4)
+		for i, s := range samples[start:end] {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			n := len(args)
+			fmt.Fprintf(&sb, "($%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4)
+			args = append(args, containerID, s.Timestamp.Truncate(time.Minute), s.CPU, s.Memory)
+		}
+		sb.WriteString(" ON CONFLICT (container_id, timestamp) DO NOTHING")
+
+		if _, err := tx.Exec(sb.String(), args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// podPattern returns a regular expression matching the names of pods a
+// workload controller creates, so history from replaced replicas is included.
+func podPattern(kind, name string) string {
+	quoted := regexp.QuoteMeta(name)
+	switch kind {
+	case "Deployment":
+		return quoted + "-[a-z0-9]+-[a-z0-9]+"
+	case "StatefulSet":
+		return quoted + "-[0-9]+"
+	case "CronJob":
+		return quoted + "-[0-9]+-[a-z0-9]+"
+	case "Pod":
+		return quoted
+	default:
+		return quoted + "-[a-z0-9]+"
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scaleops/k8s-optimizer/internal/config"
+	"github.com/scaleops/k8s-optimizer/internal/metrics"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// testCollector returns a collector whose listers serve objects, with the
+// given scope.
+func testCollector(t *testing.T, scopeConfig config.ScopeConfig, objects ...runtime.Object) *Collector {
+	t.Helper()
+	indexer := func(kind string) cache.Indexer {
+		idx := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		for _, obj := range objects {
+			if fmt.Sprintf("%T", obj) == kind {
+				if err := idx.Add(obj); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return idx
+	}
+
+	s, err := newScope(scopeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Collector{
+		config:            &config.Config{Analysis: config.AnalysisConfig{CollectionInterval: 5 * time.Minute}},
+		scope:             s,
+		podLister:         corelisters.NewPodLister(indexer("*v1.Pod")),
+		nodeLister:        corelisters.NewNodeLister(indexer("*v1.Node")),
+		replicaSetLister:  appslisters.NewReplicaSetLister(indexer("*v1.ReplicaSet")),
+		jobLister:         batchlisters.NewJobLister(indexer("*v1.Job")),
+		deploymentLister:  appslisters.NewDeploymentLister(indexer("*v1.Deployment")),
+		statefulSetLister: appslisters.NewStatefulSetLister(indexer("*v1.StatefulSet")),
+		daemonSetLister:   appslisters.NewDaemonSetLister(indexer("*v1.DaemonSet")),
+		cronJobLister:     batchlisters.NewCronJobLister(indexer("*v1.CronJob")),
+	}
+}
+
+func controllerRef(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func runningPod(namespace, name string, owners []metav1.OwnerReference, annotations map[string]string, containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, OwnerReferences: owners, Annotations: annotations},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	for _, c := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: c})
+	}
+	return pod
+}
+
+func TestBackfillTargets(t *testing.T) {
+	pending := runningPod("shop", "pending", nil, nil, "app")
+	pending.Status.Phase = corev1.PodPending
+
+	c := testCollector(t, config.ScopeConfig{ExcludeNamespaces: []string{"kube-system"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web-5d4f8", OwnerReferences: controllerRef("Deployment", "web")}},
+	)
+	pods := []*corev1.Pod{
+		// Two replicas of a workload the collector never stored
+		runningPod("shop", "web-5d4f8-abcde", controllerRef("ReplicaSet", "web-5d4f8"), nil, "app", "proxy"),
+		runningPod("shop", "web-5d4f8-fghij", controllerRef("ReplicaSet", "web-5d4f8"), nil, "app", "proxy"),
+		runningPod("shop", "db-0", controllerRef("StatefulSet", "db"),
+			map[string]string{annotationExcludeContainers: "backup"}, "postgres", "backup"),
+		runningPod("shop", "batch", nil, map[string]string{annotationExclude: "true"}, "job"),
+		runningPod("kube-system", "coredns-1", controllerRef("ReplicaSet", "coredns-1"), nil, "coredns"),
+		pending,
+	}
+
+	var got []string
+	for _, target := range c.backfillTargets(pods) {
+		got = append(got, target.String())
+	}
+	want := []string{
+		"shop/Deployment web/app",
+		"shop/Deployment web/proxy",
+		"shop/StatefulSet db/postgres",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got targets\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestBackfillHistoryFromPrometheus(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query_range" {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+		value := "0.2"
+		if strings.Contains(query, "memory") {
+			value = "67108864"
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"namespace":"shop","pod":"web-5d4f8-abcde","container":"app"},"values":[[1700000000,%q],[1700000300,%[1]q]]},
+			{"metric":{"namespace":"shop","pod":"web-7c9b2-klmno","container":"app"},"values":[[1700000000,%[1]q]]}]}}`, value)
+	}))
+	defer server.Close()
+
+	c := testCollector(t, config.ScopeConfig{},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web-5d4f8", OwnerReferences: controllerRef("Deployment", "web")}},
+	)
+	c.history = metrics.NewPrometheusSource(server.URL, "", server.Client())
+
+	targets := c.backfillTargets([]*corev1.Pod{
+		runningPod("shop", "web-5d4f8-abcde", controllerRef("ReplicaSet", "web-5d4f8"), nil, "app"),
+	})
+	if len(targets) != 1 {
+		t.Fatalf("got %d targets, want 1", len(targets))
+	}
+
+	end := time.Unix(1700000600, 0)
+	history, err := c.history.History(context.Background(), c.historyQuery(targets[0], end.Add(-time.Hour), end))
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+
+	// Replicas replaced by earlier rollouts are included
+	if len(history) != 2 {
+		t.Errorf("got history of %d pods, want 2", len(history))
+	}
+	samples := history[metrics.ContainerKey{Namespace: "shop", Pod: "web-5d4f8-abcde", Container: "app"}]
+	if len(samples) != 2 || samples[0].CPU != 0.2 || samples[0].Memory != 64<<20 {
+		t.Errorf("got samples %+v", samples)
+	}
+	for _, q := range queries {
+		if !strings.Contains(q, `pod=~"web-[a-z0-9]+-[a-z0-9]+"`) || !strings.Contains(q, `container="app"`) {
+			t.Errorf("query %q does not select the workload's pods", q)
+		}
+	}
+}
+
+func TestBackfilledDeletedAt(t *testing.T) {
+	c := testCollector(t, config.ScopeConfig{},
+		runningPod("shop", "web-5d4f8-abcde", controllerRef("ReplicaSet", "web-5d4f8"), nil, "app"),
+	)
+	lastSeen := time.Unix(1700000300, 0)
+
+	if got := c.backfilledDeletedAt(metrics.ContainerKey{Namespace: "shop", Pod: "web-5d4f8-abcde", Container: "app"}, lastSeen); got != nil {
+		t.Errorf("live pod: got deleted at %v, want nil", got)
+	}
+	// Replaced by an earlier rollout
+	got := c.backfilledDeletedAt(metrics.ContainerKey{Namespace: "shop", Pod: "web-7c9b2-klmno", Container: "app"}, lastSeen)
+	if got == nil || !got.Equal(lastSeen) {
+		t.Errorf("gone pod: got deleted at %v, want %v", got, lastSeen)
+	}
+}
+
+func TestPodPattern(t *testing.T) {
+	tests := []struct {
+		kind, name string
+		match      []string
+		noMatch    []string
+	}{
+		{"Deployment", "web", []string{"web-5d4f8-abcde"}, []string{"web-0", "web-api-5d4f8-abcde-x", "webx-5d4f8-abcde"}},
+		{"StatefulSet", "db", []string{"db-0", "db-12"}, []string{"db-a", "db-0-x"}},
+		{"CronJob", "report", []string{"report-28374650-x7k2p"}, []string{"report-abc"}},
+		{"DaemonSet", "agent", []string{"agent-x7k2p"}, []string{"agent"}},
+		{"Pod", "one.off", []string{"one.off"}, []string{"oneXoff"}},
+	}
+
+	for _, tt := range tests {
+		re := regexp.MustCompile("^(?:" + podPattern(tt.kind, tt.name) + ")$")
+		for _, name := range tt.match {
+			if !re.MatchString(name) {
+				t.Errorf("%s %s: pattern does not match %s", tt.kind, tt.name, name)
+			}
+		}
+		for _, name := range tt.noMatch {
+			if re.MatchString(name) {
+				t.Errorf("%s %s: pattern matches %s", tt.kind, tt.name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/scaleops/k8s-optimizer/internal/analysis"
+)
+
+// resolutionHistogram is the rollup_state key of the usage histograms.
+const resolutionHistogram = "histogram"
+
+// maintainHistograms merges raw samples newer than the watermark into the
+// per-container, per-day usage histograms, and advances the watermark to now.
+// Samples a day's histogram already covers, up to its last_at, are skipped,
+// so a watermark rewound for backfilled history only adds the new samples.
+// updated_at marks the days that changed for incremental analysis.
+func (c *Collector) maintainHistograms(now time.Time) error {
+	// Without a watermark yet, every sample is new
+	var from sql.NullTime
+	err := c.db.QueryRow(`SELECT rolled_until FROM rollup_state WHERE resolution = $1`, resolutionHistogram).Scan(&from)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	cpuBucket := bucketSQL(analysis.NewCPUHistogram(), "cpu_usage")
+	memoryBucket := bucketSQL(analysis.NewMemoryHistogram(), "memory_usage")
+	throttledBucket := bucketSQL(analysis.NewThrottlingHistogram(), "cpu_throttled_ratio")
+
+	result, err := c.db.Exec(`
+		WITH s AS (
+			SELECT m.container_id, date_trunc('day', m.timestamp) AS day, m.timestamp,
+				m.cpu_usage, m.memory_usage, m.cpu_throttled_ratio
+			FROM metrics_snapshots m
+			LEFT JOIN usage_histograms h ON h.container_id = m.container_id AND h.day = date_trunc('day', m.timestamp)
+			WHERE m.timestamp > $1 AND m.timestamp <= $2 AND (h.last_at IS NULL OR m.timestamp > h.last_at)
+		)
+		INSERT INTO usage_histograms (
+			container_id, day, first_at, last_at, samples,
+			cpu_sum, max_cpu, memory_sum, max_memory,
+			cpu_buckets, memory_buckets, throttled_buckets, updated_at
+		)
+		SELECT t.container_id, t.day, t.first_at, t.last_at, t.samples,
+			t.cpu_sum, t.max_cpu, t.memory_sum, t.max_memory,
+			cb.buckets, mb.buckets, COALESCE(tb.buckets, '{}'), $2
+		FROM (
+			SELECT container_id, day, MIN(timestamp) AS first_at, MAX(timestamp) AS last_at, COUNT(*) AS samples,
+				SUM(cpu_usage) AS cpu_sum, MAX(cpu_usage) AS max_cpu,
+				SUM(memory_usage) AS memory_sum, MAX(memory_usage) AS max_memory
+			FROM s
+			GROUP BY container_id, day
+		) t
+		JOIN (
+			SELECT container_id, day, jsonb_object_agg(bucket, n) AS buckets
+			FROM (SELECT container_id, day, `+cpuBucket+` AS bucket, COUNT(*) AS n FROM s GROUP BY 1, 2, 3) b
+			GROUP BY container_id, day
+		) cb USING (container_id, day)
+		JOIN (
+			SELECT container_id, day, jsonb_object_agg(bucket, n) AS buckets
+			FROM (SELECT container_id, day, `+memoryBucket+` AS bucket, COUNT(*) AS n FROM s GROUP BY 1, 2, 3) b
+			GROUP BY container_id, day
+		) mb USING (container_id, day)
+		LEFT JOIN (
+			SELECT container_id, day, jsonb_object_agg(bucket, n) AS buckets
+			FROM (
+				SELECT container_id, day, `+throttledBucket+` AS bucket, COUNT(*) AS n
+				FROM s
+				WHERE cpu_throttled_ratio IS NOT NULL
+				GROUP BY 1, 2, 3
+			) b
+			GROUP BY container_id, day
+		) tb USING (container_id, day)
+		ON CONFLICT (container_id, day) DO UPDATE SET
+			first_at = LEAST(usage_histograms.first_at, EXCLUDED.first_at),
+			last_at = GREATEST(usage_histograms.last_at, EXCLUDED.last_at),
+			samples = usage_histograms.samples + EXCLUDED.samples,
+			cpu_sum = usage_histograms.cpu_sum + EXCLUDED.cpu_sum,
+			max_cpu = GREATEST(usage_histograms.max_cpu, EXCLUDED.max_cpu),
+			memory_sum = usage_histograms.memory_sum + EXCLUDED.memory_sum,
+			max_memory = GREATEST(usage_histograms.max_memory, EXCLUDED.max_memory),
+			cpu_buckets = `+mergeBucketsSQL("cpu_buckets")+`,
+			memory_buckets = `+mergeBucketsSQL("memory_buckets")+`,
+			throttled_buckets = `+mergeBucketsSQL("throttled_buckets")+`,
+			updated_at = EXCLUDED.updated_at
+	`, from.Time, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(`
+		INSERT INTO rollup_state (resolution, rolled_until) VALUES ($1, $2)
+		ON CONFLICT (resolution) DO UPDATE SET rolled_until = EXCLUDED.rolled_until
+	`, resolutionHistogram, now)
+	if err != nil {
+		return err
+	}
+
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		log.Printf("Updated %d daily usage histograms", rows)
+	}
+	return nil
+}
+
+// mergeBucketsSQL returns a SQL expression adding the bucket weights of the
+// inserted row's column to the stored row's, for ON CONFLICT DO UPDATE.
+func mergeBucketsSQL(column string) string {
+	return fmt.Sprintf(`(
+		SELECT COALESCE(jsonb_object_agg(key, n), '{}') FROM (
+			SELECT key, SUM(value::NUMERIC) AS n
+			FROM (
+				SELECT * FROM jsonb_each_text(usage_histograms.%[1]s)
+				UNION ALL SELECT * FROM jsonb_each_text(EXCLUDED.%[1]s)
+			) b
+			GROUP BY key
+		) m
+	)`, column)
+}
+
+// bucketSQL returns a SQL expression computing the bucket of column in the
+// histogram's layout, matching Histogram.Add.
+func bucketSQL(h *analysis.Histogram, column string) string {
+	first, ratio, buckets := h.Layout()
+	return fmt.Sprintf("LEAST(FLOOR(LN(GREATEST(%s, 0) * %g / %g + 1) / LN(%g)), %d)::INTEGER",
+		column, ratio-1, first, ratio, buckets-1)
+}
+
+// loadUsage reads the daily usage of every replica of a workload container
+// from the day of since on, with the requests in force at the end of each day.
+// It also returns the number of replicas seen.
+func (c *Collector) loadUsage(workloadID int64, containerName string, since time.Time) ([]*analysis.Usage, int, error) {
+	rows, err := c.db.Query(`
+		SELECT h.container_id, h.first_at, h.last_at, h.samples,
+			h.cpu_sum, h.max_cpu, h.memory_sum, h.max_memory,
+			h.cpu_buckets, h.memory_buckets, h.throttled_buckets,
+			COALESCE(rr.cpu_request, 0), COALESCE(rr.mem_request, 0)
+		FROM usage_histograms h
+		JOIN containers c ON c.id = h.container_id
+		JOIN pods p ON p.id = c.pod_id
+		LEFT JOIN LATERAL (
+			SELECT r.cpu_request, r.mem_request
+			FROM resource_requests r
+			WHERE r.container_id = h.container_id
+			ORDER BY CASE WHEN r.updated_at <= h.last_at THEN r.updated_at END DESC NULLS LAST, r.updated_at
+			LIMIT 1
+		) rr ON true
+		WHERE p.workload_id = $1 AND c.container_name = $2 AND h.day >= date_trunc('day', $3::TIMESTAMP)
+		ORDER BY h.day
+	`, workloadID, containerName, since)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var usage []*analysis.Usage
+	replicas := make(map[int64]bool)
+	for rows.Next() {
+		var replicaID int64
+		var cpuBuckets, memoryBuckets, throttledBuckets []byte
+		day := analysis.NewUsage(analysis.Resources{})
+		if err := rows.Scan(&replicaID, &day.Start, &day.End, &day.Samples,
+			&day.CPUSum, &day.MaxCPU, &day.MemorySum, &day.MaxMemory,
+			&cpuBuckets, &memoryBuckets, &throttledBuckets,
+			&day.Requests.CPU, &day.Requests.Memory); err != nil {
+			return nil, 0, err
+		}
+		if err := fillHistogram(day.CPU, cpuBuckets); err != nil {
+			return nil, 0, err
+		}
+		if err := fillHistogram(day.Memory, memoryBuckets); err != nil {
+			return nil, 0, err
+		}
+		if err := fillHistogram(day.Throttled, throttledBuckets); err != nil {
+			return nil, 0, err
+		}
+
+		replicas[replicaID] = true
+		usage = append(usage, day)
+	}
+
+	return usage, len(replicas), rows.Err()
+}
+
+// fillHistogram adds the stored {"bucket": weight} object to h.
+func fillHistogram(h *analysis.Histogram, data []byte) error {
+	var buckets map[string]float64
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		return fmt.Errorf("invalid histogram: %w", err)
+	}
+	for key, weight := range buckets {
+		i, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("invalid histogram bucket %q", key)
+		}
+		h.AddBucket(i, weight)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// informerResync is how often the informers replay their cache to handlers.
+// The collection tick already walks the cache, so periodic resync is off.
+const informerResync = 0
+
+// startInformers sets up the shared informers backing the collector's local
+// cache of pods, nodes and pod owners, and blocks until they have synced.
+func (c *Collector) startInformers(ctx context.Context) error {
+	var opts []informers.SharedInformerOption
+	if c.namespace != "" {
+		opts = append(opts, informers.WithNamespace(c.namespace))
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(c.clientset, informerResync, opts...)
+
+	podInformer := factory.Core().V1().Pods()
+	c.podLister = podInformer.Lister()
+	c.nodeLister = factory.Core().V1().Nodes().Lister()
+	c.replicaSetLister = factory.Apps().V1().ReplicaSets().Lister()
+	c.jobLister = factory.Batch().V1().Jobs().Lister()
+	c.deploymentLister = factory.Apps().V1().Deployments().Lister()
+	c.statefulSetLister = factory.Apps().V1().StatefulSets().Lister()
+	c.daemonSetLister = factory.Apps().V1().DaemonSets().Lister()
+	c.cronJobLister = factory.Batch().V1().CronJobs().Lister()
+
+	factory.Start(ctx.Done())
+
+	start := time.Now()
+	for informerType, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return fmt.Errorf("failed to sync informer cache for %v", informerType)
+		}
+	}
+	log.Printf("Informer caches synced in %v", time.Since(start).Round(time.Millisecond))
+
+	// Register handlers once owners are cached so workload resolution
+	// succeeds; existing pods are replayed as add events.
+	_, err := podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.onPodChange(pod)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, ok := oldObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			newPod, ok := newObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			if podChanged(oldPod, newPod) {
+				c.onPodChange(newPod)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.onPodDelete(pod)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register pod event handler: %w", err)
+	}
+
+	return nil
+}
+
+// onPodChange keeps the stored pod, containers and requests in sync as soon
+// as the cluster reports a change, without waiting for the next tick.
+func (c *Collector) onPodChange(pod *corev1.Pod) {
+	if !c.shouldCollect(pod) {
+		return
+	}
+	if _, err := c.storePod(pod); err != nil {
+		log.Printf("Error storing pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+}
+
+// onPodDelete marks the stored pod deleted so it drops out of the dashboard.
+func (c *Collector) onPodDelete(pod *corev1.Pod) {
+	if err := c.markPodDeleted(pod.Namespace, pod.Name); err != nil {
+		log.Printf("Error marking pod %s/%s deleted: %v", pod.Namespace, pod.Name, err)
+	}
+}
+
+// podChanged reports whether an update is relevant to what the collector
+// stores: the pod started running, a container restarted or its container
+// specs changed.
+func podChanged(oldPod, newPod *corev1.Pod) bool {
+	if oldPod.Status.Phase != newPod.Status.Phase {
+		return true
+	}
+	if restartCount(oldPod) != restartCount(newPod) {
+		return true
+	}
+	return !equality.Semantic.DeepEqual(oldPod.Spec.Containers, newPod.Spec.Containers)
+}
+
+func restartCount(pod *corev1.Pod) int32 {
+	var restarts int32
+	for _, status := range pod.Status.ContainerStatuses {
+		restarts += status.RestartCount
+	}
+	return restarts
+}
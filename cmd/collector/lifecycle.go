@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func (c *Collector) markPodDeleted(namespace, podName string) error {
+	_, err := c.db.Exec(`
+		UPDATE pods SET deleted_at = $3
+		WHERE namespace = $1 AND pod_name = $2 AND deleted_at IS NULL
+	`, namespace, podName, time.Now())
+	return err
+}
+
+// markVanishedPods marks stored pods that are no longer in the informer
+// cache as deleted, covering deletions while the collector was not running.
+// Pods the scope no longer selects count as vanished too.
+func (c *Collector) markVanishedPods(pods []*corev1.Pod) error {
+	live := c.livePods(pods)
+
+	query := `SELECT namespace, pod_name FROM pods WHERE deleted_at IS NULL`
+	args := []interface{}{}
+	if c.namespace != "" {
+		query += " AND namespace = $1"
+		args = append(args, c.namespace)
+	}
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+
+	var vanished [][2]string
+	for rows.Next() {
+		var namespace, podName string
+		if err := rows.Scan(&namespace, &podName); err != nil {
+			rows.Close()
+			return err
+		}
+		if !live[namespace+"/"+podName] {
+			vanished = append(vanished, [2]string{namespace, podName})
+		}
+	}
+	rows.Close()
+
+	for _, p := range vanished {
+		if err := c.markPodDeleted(p[0], p[1]); err != nil {
+			return fmt.Errorf("failed to mark pod %s/%s deleted: %w", p[0], p[1], err)
+		}
+	}
+	if len(vanished) > 0 {
+		log.Printf("Marked %d vanished pods deleted", len(vanished))
+	}
+
+	return nil
+}
+
+// livePods returns the cached pods in scope, keyed by namespace/name.
+func (c *Collector) livePods(pods []*corev1.Pod) map[string]bool {
+	live := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		if c.scope.matches(pod) {
+			live[pod.Namespace+"/"+pod.Name] = true
+		}
+	}
+	return live
+}
+
+// purgeDeletedPods removes pods deleted longer ago than the retention period,
+// with their containers, samples and analyses, and workloads left without
+// pods or recommendations. Pods backfilled from Prometheus were gone when
+// they were stored, so they are kept while their daily rollups are.
+// Recommendations and their history are kept.
+func (c *Collector) purgeDeletedPods() error {
+	retention := c.config.Retention.DeletedPodDays
+	if retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-time.Duration(retention) * 24 * time.Hour)
+
+	result, err := c.db.Exec(`
+		DELETE FROM pods p
+		WHERE p.deleted_at < $1 AND (NOT p.backfilled OR NOT EXISTS (
+			SELECT 1 FROM containers c JOIN metrics_daily d ON d.container_id = c.id
+			WHERE c.pod_id = p.id
+		))
+	`, cutoff)
+	if err != nil {
+		return err
+	}
+	purged, _ := result.RowsAffected()
+
+	if purged > 0 {
+		_, err = c.db.Exec(`
+			DELETE FROM workloads w
+			WHERE NOT EXISTS (SELECT 1 FROM pods p WHERE p.workload_id = w.id)
+				AND NOT EXISTS (SELECT 1 FROM recommendations r WHERE r.workload_id = w.id)
+		`)
+		if err != nil {
+			return err
+		}
+		log.Printf("Purged %d pods deleted more than %d days ago", purged, retention)
+	}
+
+	return nil
+}
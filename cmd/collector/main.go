@@ -2,22 +2,31 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/scaleops/k8s-optimizer/internal/analysis"
+	"github.com/scaleops/k8s-optimizer/internal/apply"
 	"github.com/scaleops/k8s-optimizer/internal/config"
 	"github.com/scaleops/k8s-optimizer/internal/database"
+	"github.com/scaleops/k8s-optimizer/internal/metrics"
 
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/clientcmd"
-	metricsv1beta1 "k8s.io/metrics/pkg/client/clientset/versioned"
 )
 
 func main() {
@@ -26,7 +35,12 @@ func main() {
 	kubecontext := flag.String("context", "", "Kubernetes context to use")
 	namespace := flag.String("namespace", "", "Namespace to collect metrics from (empty for all)")
 	once := flag.Bool("once", false, "Run once and exit (default: continuous collection)")
+	backfill := flag.Bool("backfill", false, "Backfill history from Prometheus for containers without metrics, then exit")
 	interval := flag.Duration("interval", 5*time.Minute, "Collection interval")
+	includeNamespaces := flag.String("include-namespaces", "", "Comma-separated namespace globs to collect (overrides COLLECT_NAMESPACES)")
+	excludeNamespaces := flag.String("exclude-namespaces", "", "Comma-separated namespace globs to skip (overrides COLLECT_EXCLUDE_NAMESPACES)")
+	selector := flag.String("selector", "", "Label selector pods must match (overrides COLLECT_POD_SELECTOR)")
+	analysisWorkers := flag.Int("analysis-workers", 0, "Containers analyzed concurrently (overrides ANALYSIS_WORKERS)")
 	flag.Parse()
 
 	// Load application config
@@ -35,6 +49,31 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	if *includeNamespaces != "" {
+		cfg.Scope.IncludeNamespaces = config.SplitList(*includeNamespaces)
+	}
+	if *excludeNamespaces != "" {
+		cfg.Scope.ExcludeNamespaces = config.SplitList(*excludeNamespaces)
+	}
+	if *selector != "" {
+		cfg.Scope.PodSelector = *selector
+	}
+	if *analysisWorkers > 0 {
+		cfg.Analysis.Workers = *analysisWorkers
+	}
+	if days := cfg.Retention.DeletedPodDays; days > 0 && days < cfg.Analysis.Policies.MaxWindowDays() {
+		log.Printf("Warning: deleted pods are kept %d days, less than the %d-day analysis window", days, cfg.Analysis.Policies.MaxWindowDays())
+	}
+	if days := cfg.Retention.HistogramDays; days > 0 && days < cfg.Analysis.Policies.MaxWindowDays() {
+		log.Printf("Warning: usage histograms are kept %d days, less than the %d-day analysis window", days, cfg.Analysis.Policies.MaxWindowDays())
+	}
+
+	podScope, err := newScope(cfg.Scope)
+	if err != nil {
+		log.Fatalf("Invalid collection scope: %v", err)
+	}
+	log.Printf("Collection scope: %s", podScope)
+
 	// Connect to database
 	db, err := database.NewDB(cfg.Database.ConnectionString())
 	if err != nil {
@@ -75,28 +114,61 @@ func main() {
 		log.Fatalf("Failed to create Kubernetes client: %v", err)
 	}
 
-	// Create Metrics clientset
-	metricsClient, err := metricsv1beta1.NewForConfig(kubeConfig)
-	if err != nil {
-		log.Fatalf("Failed to create metrics client: %v", err)
-	}
-
 	log.Printf("Connected to Kubernetes cluster")
 	if *kubecontext != "" {
 		log.Printf("Using context: %s", *kubecontext)
 	}
 
+	if err := validateRecommenders(cfg.Analysis); err != nil {
+		log.Fatalf("Invalid analysis configuration: %v", err)
+	}
+
 	collector := &Collector{
-		db:            db,
-		clientset:     clientset,
-		metricsClient: metricsClient,
-		config:        cfg,
-		namespace:     *namespace,
+		db:        db,
+		clientset: clientset,
+		config:    cfg,
+		namespace: *namespace,
+		scope:     podScope,
+		interval:  *interval,
+	}
+
+	if cfg.Verification.Period > 0 && cfg.Verification.AutoRollback {
+		collector.applier = apply.NewForClient(clientset, cfg.Apply)
+		log.Printf("Rolling back applies that regress within %v", cfg.Verification.Period)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := collector.startInformers(ctx); err != nil {
+		log.Fatalf("Failed to start informers: %v", err)
+	}
+
+	// The kubelet source scrapes nodes from the informer cache, so it is
+	// created once the caches have synced
+	collector.metricsSource, err = newMetricsSource(cfg.Metrics, kubeConfig, collector)
+	if err != nil {
+		log.Fatalf("Failed to create metrics source: %v", err)
+	}
+	log.Printf("Using metrics source: %s", collector.metricsSource.Name())
+
+	if *backfill || cfg.Metrics.Backfill {
+		collector.history = metrics.NewPrometheusSource(cfg.Metrics.PrometheusURL, *namespace,
+			&http.Client{Timeout: prometheusTimeout})
+	}
+
+	if *backfill {
+		log.Println("Running history backfill...")
+		if err := collector.backfill(ctx); err != nil {
+			log.Fatalf("Backfill failed: %v", err)
+		}
+		log.Println("Backfill complete!")
+		return
 	}
 
 	if *once {
 		log.Println("Running single collection...")
-		if err := collector.Collect(context.Background()); err != nil {
+		if err := collector.Collect(ctx); err != nil {
 			log.Fatalf("Collection failed: %v", err)
 		}
 		log.Println("Collection complete!")
@@ -109,12 +181,12 @@ func main() {
 	defer ticker.Stop()
 
 	// Run immediately
-	if err := collector.Collect(context.Background()); err != nil {
+	if err := collector.Collect(ctx); err != nil {
 		log.Printf("Collection error: %v", err)
 	}
 
 	for range ticker.C {
-		if err := collector.Collect(context.Background()); err != nil {
+		if err := collector.Collect(ctx); err != nil {
 			log.Printf("Collection error: %v", err)
 		}
 	}
@@ -122,115 +194,279 @@ func main() {
 
 type Collector struct {
 	db            *database.DB
-	clientset     *kubernetes.Clientset
-	metricsClient *metricsv1beta1.Clientset
+	clientset     kubernetes.Interface
+	metricsSource metrics.MetricsSource
+	history       *metrics.PrometheusSource // nil unless backfill is enabled
+	applier       *apply.Applier            // nil unless regressions are rolled back
 	config        *config.Config
 	namespace     string
+	scope         *scope
+	interval      time.Duration // collection interval, for timing warnings
+
+	// analyzedAll is set once a full analysis pass ran; later passes skip
+	// targets whose inputs did not change
+	analyzedAll bool
+
+	// Listers backed by the shared informer cache
+	podLister        corelisters.PodLister
+	nodeLister       corelisters.NodeLister
+	replicaSetLister appslisters.ReplicaSetLister
+	jobLister        batchlisters.JobLister
+
+	// Top-level owners, for their optimizer annotations
+	deploymentLister  appslisters.DeploymentLister
+	statefulSetLister appslisters.StatefulSetLister
+	daemonSetLister   appslisters.DaemonSetLister
+	cronJobLister     batchlisters.CronJobLister
 }
 
 func (c *Collector) Collect(ctx context.Context) error {
 	log.Println("Starting metrics collection...")
 
-	// Get all pods
-	listOptions := metav1.ListOptions{}
-	var pods *corev1.PodList
-	var err error
-
-	if c.namespace != "" {
-		pods, err = c.clientset.CoreV1().Pods(c.namespace).List(ctx, listOptions)
-	} else {
-		pods, err = c.clientset.CoreV1().Pods("").List(ctx, listOptions)
+	// Read pods and nodes from the informer cache instead of listing the API server
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
 	}
 
+	nodes, err := c.nodeLister.List(labels.Everything())
 	if err != nil {
-		return fmt.Errorf("failed to list pods: %w", err)
+		return fmt.Errorf("failed to list nodes: %w", err)
 	}
 
-	log.Printf("Found %d pods", len(pods.Items))
+	log.Printf("Found %d pods on %d nodes", len(pods), len(nodes))
 
-	// Get pod metrics
-	var podMetricsList interface{ Items() interface{} }
-	
-	if c.namespace != "" {
-		metrics, err := c.metricsClient.MetricsV1beta1().PodMetricses(c.namespace).List(ctx, listOptions)
-		if err != nil {
-			log.Printf("Warning: Could not get metrics (metrics-server might not be installed): %v", err)
-		} else {
-			log.Printf("Got metrics for %d pods", len(metrics.Items))
-			_ = podMetricsList
+	// Catch deletions missed while the collector was down, then drop pods
+	// gone past retention
+	if err := c.markVanishedPods(pods); err != nil {
+		log.Printf("Error marking deleted pods: %v", err)
+	}
+	if err := c.purgeDeletedPods(); err != nil {
+		log.Printf("Error purging deleted pods: %v", err)
+	}
+
+	// Backfill workloads seen for the first time before their first live sample
+	if c.history != nil {
+		if err := c.backfill(ctx); err != nil {
+			log.Printf("Error backfilling history: %v", err)
 		}
+	}
+
+	// Get container usage for the whole cluster in one pass
+	usage, err := c.metricsSource.Collect(ctx)
+	if err != nil {
+		log.Printf("Warning: Could not get metrics from %s: %v", c.metricsSource.Name(), err)
 	} else {
-		metrics, err := c.metricsClient.MetricsV1beta1().PodMetricses("").List(ctx, listOptions)
-		if err != nil {
-			log.Printf("Warning: Could not get metrics (metrics-server might not be installed): %v", err)
-		} else {
-			log.Printf("Got metrics for %d pods", len(metrics.Items))
-		}
+		log.Printf("Got metrics for %d containers", len(usage))
 	}
 
-	// Store each pod and its containers
-	for _, pod := range pods.Items {
-		// Skip pods that are not running
-		if pod.Status.Phase != corev1.PodRunning {
+	// Store each pod, its containers and their usage
+	for _, pod := range pods {
+		if !c.shouldCollect(pod) {
 			continue
 		}
 
-		// Skip system pods (optional)
-		if pod.Namespace == "kube-system" && !isImportantSystemPod(pod.Name) {
+		containerIDs, err := c.storePod(pod)
+		if err != nil {
+			log.Printf("Error storing pod %s/%s: %v", pod.Namespace, pod.Name, err)
 			continue
 		}
 
-		if err := c.storePod(ctx, &pod); err != nil {
-			log.Printf("Error storing pod %s/%s: %v", pod.Namespace, pod.Name, err)
-			continue
+		for containerName, containerID := range containerIDs {
+			key := metrics.ContainerKey{Namespace: pod.Namespace, Pod: pod.Name, Container: containerName}
+			u, ok := usage[key]
+			if !ok {
+				continue
+			}
+			if err := c.storeMetrics(containerID, key, u); err != nil {
+				log.Printf("Warning: failed to store metrics for %s/%s/%s: %v", pod.Namespace, pod.Name, containerName, err)
+			}
 		}
 	}
 
+	// Downsample and expire old usage before analyzing it
+	if err := c.maintainMetrics(); err != nil {
+		log.Printf("Error maintaining metrics rollups: %v", err)
+	}
+
+	// Watch applied recommendations for regressions, rolling them back
+	// before a new analysis reacts to them
+	if err := c.verifyApplies(ctx, time.Now()); err != nil {
+		log.Printf("Error verifying applied recommendations: %v", err)
+	}
+
 	// Run analysis
 	if err := c.runAnalysis(ctx); err != nil {
 		log.Printf("Error running analysis: %v", err)
 	}
 
+	if err := c.maintainRecommendations(time.Now()); err != nil {
+		log.Printf("Error maintaining recommendations: %v", err)
+	}
+
 	log.Println("Collection complete!")
 	return nil
 }
 
-func (c *Collector) storePod(ctx context.Context, pod *corev1.Pod) error {
+// shouldCollect reports whether a pod is in scope for collection.
+func (c *Collector) shouldCollect(pod *corev1.Pod) bool {
+	// Skip pods that are not running
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+
+	return c.scope.matches(pod)
+}
+
+// storePod upserts the pod and its containers and returns the stored
+// container IDs keyed by container name.
+func (c *Collector) storePod(pod *corev1.Pod) (map[string]int64, error) {
+	// Resolve the owning workload so history survives rollouts
+	ref, err := c.resolveWorkload(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := parseOverrides(pod, c.ownerAnnotations(pod.Namespace, ref))
+
+	workloadID, err := c.storeWorkload(pod.Namespace, ref, overrides)
+	if err != nil {
+		return nil, err
+	}
+
 	// Insert or update pod
 	var podID int64
-	err := c.db.QueryRow(`
-		INSERT INTO pods (namespace, pod_name, created_at, updated_at)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (namespace, pod_name) DO UPDATE SET updated_at = $4
+	err = c.db.QueryRow(`
+		INSERT INTO pods (namespace, pod_name, workload_id, created_at, updated_at, first_seen_at, last_seen_at, resize_status)
+		VALUES ($1, $2, $3, $4, $5, $4, $5, $6)
+		ON CONFLICT (namespace, pod_name) DO UPDATE SET
+			workload_id = $3, updated_at = $5, last_seen_at = $5, deleted_at = NULL, resize_status = $6, backfilled = false
 		RETURNING id
-	`, pod.Namespace, pod.Name, time.Now(), time.Now()).Scan(&podID)
+	`, pod.Namespace, pod.Name, workloadID, time.Now(), time.Now(), podResizeStatus(pod)).Scan(&podID)
 
 	if err != nil {
-		return fmt.Errorf("failed to insert pod: %w", err)
+		return nil, fmt.Errorf("failed to insert pod: %w", err)
 	}
 
 	// Process each container
-	for _, container := range pod.Spec.Containers {
-		if err := c.storeContainer(ctx, podID, pod.Namespace, pod.Name, &container); err != nil {
+	containerIDs := make(map[string]int64, len(pod.Spec.Containers))
+	for i, container := range pod.Spec.Containers {
+		containerID, err := c.storeContainer(podID, i, &container, overrides.ExcludedContainers[container.Name])
+		if err != nil {
 			log.Printf("Error storing container %s: %v", container.Name, err)
+			continue
 		}
+		containerIDs[container.Name] = containerID
 	}
 
-	return nil
+	c.storeContainerStatuses(pod, containerIDs)
+	c.storeOOMKills(pod, containerIDs)
+
+	return containerIDs, nil
 }
 
-func (c *Collector) storeContainer(ctx context.Context, podID int64, namespace, podName string, container *corev1.Container) error {
+// storeContainerStatuses records restart counts, current state and the last
+// termination of each container.
+func (c *Collector) storeContainerStatuses(pod *corev1.Pod, containerIDs map[string]int64) {
+	for _, status := range pod.Status.ContainerStatuses {
+		containerID, ok := containerIDs[status.Name]
+		if !ok {
+			continue
+		}
+
+		state, stateReason := "", ""
+		switch {
+		case status.State.Running != nil:
+			state = "running"
+		case status.State.Waiting != nil:
+			state, stateReason = "waiting", status.State.Waiting.Reason
+		case status.State.Terminated != nil:
+			state, stateReason = "terminated", status.State.Terminated.Reason
+		}
+
+		var lastReason sql.NullString
+		var lastExitCode sql.NullInt32
+		var lastStartedAt, lastFinishedAt sql.NullTime
+		if last := status.LastTerminationState.Terminated; last != nil {
+			lastReason = sql.NullString{String: last.Reason, Valid: true}
+			lastExitCode = sql.NullInt32{Int32: last.ExitCode, Valid: true}
+			lastStartedAt = sql.NullTime{Time: last.StartedAt.Time, Valid: !last.StartedAt.IsZero()}
+			lastFinishedAt = sql.NullTime{Time: last.FinishedAt.Time, Valid: !last.FinishedAt.IsZero()}
+		}
+
+		_, err := c.db.Exec(`
+			INSERT INTO container_statuses (
+				container_id, restart_count, ready, state, state_reason,
+				last_termination_reason, last_exit_code, last_started_at, last_finished_at, updated_at
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT (container_id) DO UPDATE SET
+				restart_count = $2, ready = $3, state = $4, state_reason = $5,
+				last_termination_reason = $6, last_exit_code = $7,
+				last_started_at = $8, last_finished_at = $9, updated_at = $10
+		`, containerID, status.RestartCount, status.Ready, state, stateReason,
+			lastReason, lastExitCode, lastStartedAt, lastFinishedAt, time.Now())
+		if err != nil {
+			log.Printf("Warning: failed to store status of %s/%s/%s: %v", pod.Namespace, pod.Name, status.Name, err)
+		}
+	}
+}
+
+// storeOOMKills records OOMKilled terminations reported in the pod's container
+// statuses, along with the memory the container was sized at when killed.
+func (c *Collector) storeOOMKills(pod *corev1.Pod, containerIDs map[string]int64) {
+	specs := make(map[string]*corev1.Container, len(pod.Spec.Containers))
+	for i := range pod.Spec.Containers {
+		specs[pod.Spec.Containers[i].Name] = &pod.Spec.Containers[i]
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		containerID, ok := containerIDs[status.Name]
+		if !ok {
+			continue
+		}
+
+		for _, state := range []corev1.ContainerState{status.State, status.LastTerminationState} {
+			terminated := state.Terminated
+			if terminated == nil || terminated.Reason != "OOMKilled" {
+				continue
+			}
+
+			var memRequest, memLimit int64
+			if spec := specs[status.Name]; spec != nil {
+				memRequest = spec.Resources.Requests.Memory().Value()
+				memLimit = spec.Resources.Limits.Memory().Value()
+			}
+
+			_, err := c.db.Exec(`
+				INSERT INTO oom_kills (container_id, finished_at, memory_request, memory_limit)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT (container_id, finished_at) DO NOTHING
+			`, containerID, terminated.FinishedAt.Time, memRequest, memLimit)
+			if err != nil {
+				log.Printf("Warning: failed to record OOMKill of %s/%s/%s: %v", pod.Namespace, pod.Name, status.Name, err)
+			}
+		}
+	}
+}
+
+// storeContainer upserts the container at position index of the pod spec,
+// which JSON patches address it by, along with whether it has requests and
+// limits for them to add to.
+func (c *Collector) storeContainer(podID int64, index int, container *corev1.Container, excluded bool) (int64, error) {
 	// Insert or update container
 	var containerID int64
 	err := c.db.QueryRow(`
-		INSERT INTO containers (pod_id, container_name, image, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (pod_id, container_name) DO UPDATE SET image = $3, updated_at = $5
+		INSERT INTO containers (pod_id, container_name, image, excluded, container_index, has_requests, has_limits, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (pod_id, container_name) DO UPDATE SET image = $3, excluded = $4, container_index = $5,
+			has_requests = $6, has_limits = $7, updated_at = $9
 		RETURNING id
-	`, podID, container.Name, container.Image, time.Now(), time.Now()).Scan(&containerID)
+	`, podID, container.Name, container.Image, excluded, index,
+		len(container.Resources.Requests) > 0, len(container.Resources.Limits) > 0,
+		time.Now(), time.Now()).Scan(&containerID)
 
 	if err != nil {
-		return fmt.Errorf("failed to insert container: %w", err)
+		return 0, fmt.Errorf("failed to insert container: %w", err)
 	}
 
 	// Store resource requests
@@ -257,345 +493,444 @@ func (c *Collector) storeContainer(ctx context.Context, podID int64, namespace,
 		}
 	}
 
-	// Insert or update resource requests
+	// Record the spec only when it differs from the latest recorded one, so
+	// resource_requests is a history of changes effective from updated_at
 	_, err = c.db.Exec(`
 		INSERT INTO resource_requests (container_id, cpu_request, cpu_limit, mem_request, mem_limit, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT DO NOTHING
+		SELECT $1, $2, $3, $4, $5, $6::TIMESTAMP
+		WHERE NOT EXISTS (
+			SELECT 1 FROM (
+				SELECT cpu_request, cpu_limit, mem_request, mem_limit
+				FROM resource_requests
+				WHERE container_id = $1
+				ORDER BY updated_at DESC, id DESC
+				LIMIT 1
+			) latest
+			WHERE latest.cpu_request = $2 AND latest.cpu_limit = $3
+				AND latest.mem_request = $4 AND latest.mem_limit = $5
+		)
 	`, containerID, cpuRequest, cpuLimit, memRequest, memLimit, time.Now())
 
 	if err != nil {
 		log.Printf("Warning: failed to insert resource request: %v", err)
 	}
 
-	// Try to get metrics for this container
-	if err := c.storeMetrics(ctx, containerID, namespace, podName, container.Name); err != nil {
-		log.Printf("Warning: failed to store metrics for %s/%s/%s: %v", namespace, podName, container.Name, err)
-	}
-
-	return nil
+	return containerID, nil
 }
 
-func (c *Collector) storeMetrics(ctx context.Context, containerID int64, namespace, podName, containerName string) error {
-	// Get pod metrics
-	podMetrics, err := c.metricsClient.MetricsV1beta1().PodMetricses(namespace).Get(ctx, podName, metav1.GetOptions{})
+func (c *Collector) storeMetrics(containerID int64, key metrics.ContainerKey, usage metrics.Usage) error {
+	throttled := sql.NullFloat64{Float64: usage.ThrottledRatio, Valid: usage.HasThrottling}
+
+	_, err := c.db.Exec(`
+		INSERT INTO metrics_snapshots (container_id, timestamp, cpu_usage, memory_usage, cpu_throttled_ratio)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (container_id, timestamp) DO NOTHING
+	`, containerID, time.Now().Truncate(time.Minute), usage.CPU, usage.Memory, throttled)
+
 	if err != nil {
 		return err
 	}
 
-	// Find container metrics
-	for _, cm := range podMetrics.Containers {
-		if cm.Name == containerName {
-			cpuUsage := float64(cm.Usage.Cpu().MilliValue()) / 1000.0
-			memUsage := cm.Usage.Memory().Value()
-
-			_, err := c.db.Exec(`
-				INSERT INTO metrics_snapshots (container_id, timestamp, cpu_usage, memory_usage)
-				VALUES ($1, $2, $3, $4)
-				ON CONFLICT (container_id, timestamp) DO NOTHING
-			`, containerID, time.Now().Truncate(time.Minute), cpuUsage, memUsage)
-
-			if err != nil {
-				return err
-			}
-
-			log.Printf("  Stored metrics for %s/%s/%s: CPU=%.3f cores, Memory=%d MB",
-				namespace, podName, containerName, cpuUsage, memUsage/(1024*1024))
-			return nil
-		}
-	}
+	log.Printf("  Stored metrics for %s/%s/%s: CPU=%.3f cores, Memory=%d MB",
+		key.Namespace, key.Pod, key.Container, usage.CPU, usage.Memory/(1024*1024))
+	return nil
+}
 
-	return fmt.Errorf("container not found in metrics")
+// analysisTarget is a workload/container pair. Samples are pooled from every
+// replica of the workload; containerID refers to the most recently seen one.
+type analysisTarget struct {
+	containerID   int64
+	workloadID    int64
+	workloadKind  string
+	workloadName  string
+	containerName string
+	namespace     string
+	podName       string
+	excluded      bool
+	overrides     workloadOverrides
+
+	// When any replica's usage, requests or OOMKills last changed, and when
+	// the target was last analyzed
+	changedAt  sql.NullTime
+	analyzedAt sql.NullTime
 }
 
+// analysisRefresh is how often unchanged targets are re-analyzed anyway, as
+// their window moves and old usage, restarts and OOMKills drop out of it.
+const analysisRefresh = 24 * time.Hour
+
 func (c *Collector) runAnalysis(ctx context.Context) error {
 	log.Println("Running analysis...")
+	start := time.Now()
 
-	// Get containers with enough metrics data
+	// Get workload containers with metrics data, newest replica first, with
+	// when their inputs last changed and when they were last analyzed
 	rows, err := c.db.Query(`
-		SELECT DISTINCT c.id, c.pod_id, c.container_name, p.namespace, p.pod_name
+		SELECT c.id, w.id, w.kind, w.name, c.container_name, p.namespace, p.pod_name,
+			COALESCE(w.excluded, false) OR COALESCE(c.excluded, false),
+			w.override_percentile, w.override_buffer, w.override_min_cpu, w.override_min_memory,
+			GREATEST(
+				(SELECT MAX(h.updated_at) FROM usage_histograms h WHERE h.container_id = c.id),
+				(SELECT MAX(r.updated_at) FROM resource_requests r WHERE r.container_id = c.id),
+				(SELECT MAX(o.finished_at) FROM oom_kills o WHERE o.container_id = c.id)
+			),
+			la.analyzed_at
 		FROM containers c
 		JOIN pods p ON p.id = c.pod_id
-		WHERE EXISTS (
-			SELECT 1 FROM metrics_snapshots m 
-			WHERE m.container_id = c.id
-		)
+		JOIN workloads w ON w.id = p.workload_id
+		LEFT JOIN analyses la ON la.is_current AND la.workload_id = w.id AND la.container_name = c.container_name
+		WHERE EXISTS (SELECT 1 FROM usage_histograms h WHERE h.container_id = c.id)
+		ORDER BY c.updated_at DESC, c.id DESC
 	`)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
-	type containerInfo struct {
-		id            int64
-		podID         int64
-		containerName string
-		namespace     string
-		podName       string
-	}
-
-	var containers []containerInfo
+	var targets []*analysisTarget
+	byKey := make(map[string]*analysisTarget)
 	for rows.Next() {
-		var ci containerInfo
-		if err := rows.Scan(&ci.id, &ci.podID, &ci.containerName, &ci.namespace, &ci.podName); err != nil {
+		t := &analysisTarget{}
+		if err := rows.Scan(&t.containerID, &t.workloadID, &t.workloadKind, &t.workloadName,
+			&t.containerName, &t.namespace, &t.podName, &t.excluded,
+			&t.overrides.Percentile, &t.overrides.Buffer, &t.overrides.MinCPU, &t.overrides.MinMemory,
+			&t.changedAt, &t.analyzedAt); err != nil {
+			continue
+		}
+
+		// The newest replica represents the target; any replica's changes count
+		key := fmt.Sprintf("%d/%s", t.workloadID, t.containerName)
+		if first, ok := byKey[key]; ok {
+			if t.changedAt.Valid && (!first.changedAt.Valid || t.changedAt.Time.After(first.changedAt.Time)) {
+				first.changedAt = t.changedAt
+			}
 			continue
 		}
-		containers = append(containers, ci)
+		byKey[key] = t
+		targets = append(targets, t)
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	for _, ci := range containers {
-		if err := c.analyzeContainer(ctx, ci.id, ci.namespace, ci.podName, ci.containerName); err != nil {
-			log.Printf("Error analyzing %s/%s/%s: %v", ci.namespace, ci.podName, ci.containerName, err)
+	pending, retired, unchanged := c.selectTargets(targets, start)
+	for _, r := range retired {
+		if err := c.retireTarget(r.target, r.reason, start); err != nil {
+			log.Printf("Warning: failed to retire %s/%s %s/%s: %v",
+				r.target.namespace, r.target.workloadKind, r.target.workloadName, r.target.containerName, err)
 		}
 	}
 
-	return nil
+	analyzed, failed := c.analyzeAll(ctx, pending)
+	if ctx.Err() == nil {
+		c.analyzedAll = true
+	}
+
+	elapsed := time.Since(start)
+	log.Printf("Analyzed %d containers (%d failed, %d unchanged) in %v with %d workers",
+		analyzed, failed, unchanged, elapsed.Round(time.Millisecond), c.analysisWorkers())
+	if c.interval > 0 && elapsed > c.interval/2 {
+		log.Printf("Warning: analysis took %v, more than half the %v collection interval; consider raising ANALYSIS_WORKERS",
+			elapsed.Round(time.Second), c.interval)
+	}
+
+	return ctx.Err()
 }
 
-func (c *Collector) analyzeContainer(ctx context.Context, containerID int64, namespace, podName, containerName string) error {
-	// Get metrics for last 7 days
-	windowStart := time.Now().Add(-7 * 24 * time.Hour)
-	windowEnd := time.Now()
+// retiredTarget is a target dropped from analysis, with why.
+type retiredTarget struct {
+	target analysisTarget
+	reason string
+}
 
-	rows, err := c.db.Query(`
-		SELECT cpu_usage, memory_usage
-		FROM metrics_snapshots
-		WHERE container_id = $1 AND timestamp >= $2
-		ORDER BY timestamp
-	`, containerID, windowStart)
-	if err != nil {
-		return err
+// selectTargets splits targets into the ones to analyze and the ones to
+// retire, counting the unchanged ones it skips. Targets only need retiring
+// while they still have a current analysis.
+func (c *Collector) selectTargets(targets []*analysisTarget, now time.Time) ([]analysisTarget, []retiredTarget, int) {
+	var pending []analysisTarget
+	var retired []retiredTarget
+	var unchanged int
+	for _, t := range targets {
+		// Retire workloads collected before the scope was narrowed, and
+		// excluded ones; the newest replica's annotations decide exclusion
+		reason := ""
+		if !c.scope.matchesNamespace(t.namespace) {
+			reason = "out of collection scope"
+		} else if t.excluded {
+			reason = "excluded from analysis"
+		}
+		if reason != "" {
+			if t.analyzedAt.Valid {
+				retired = append(retired, retiredTarget{*t, reason})
+			}
+			continue
+		}
+
+		if c.analyzedAll && !t.stale(now) {
+			unchanged++
+			continue
+		}
+		pending = append(pending, *t)
 	}
-	defer rows.Close()
+	return pending, retired, unchanged
+}
 
-	var cpuValues []float64
-	var memValues []int64
+// stale reports whether a target needs a new analysis: it was never analyzed,
+// its usage, requests or OOMKills changed since, or the last analysis is older
+// than analysisRefresh and the window has moved on.
+func (t *analysisTarget) stale(now time.Time) bool {
+	if !t.analyzedAt.Valid {
+		return true
+	}
+	if t.changedAt.Valid && t.changedAt.Time.After(t.analyzedAt.Time) {
+		return true
+	}
+	return now.Sub(t.analyzedAt.Time) >= analysisRefresh
+}
 
-	for rows.Next() {
-		var cpu float64
-		var mem int64
-		if err := rows.Scan(&cpu, &mem); err != nil {
-			continue
+// analyzeAll analyzes targets on a bounded pool of workers and returns how
+// many were analyzed and how many of those failed.
+func (c *Collector) analyzeAll(ctx context.Context, targets []analysisTarget) (int, int) {
+	work := make(chan analysisTarget)
+	var analyzed, failed int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < c.analysisWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range work {
+				atomic.AddInt64(&analyzed, 1)
+				if err := c.analyzeContainer(ctx, t); err != nil {
+					atomic.AddInt64(&failed, 1)
+					log.Printf("Error analyzing %s/%s %s/%s: %v", t.namespace, t.workloadKind, t.workloadName, t.containerName, err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, t := range targets {
+		select {
+		case work <- t:
+		case <-ctx.Done():
+			break feed
 		}
-		cpuValues = append(cpuValues, cpu)
-		memValues = append(memValues, mem)
 	}
+	close(work)
+	wg.Wait()
+
+	return int(analyzed), int(failed)
+}
+
+func (c *Collector) analysisWorkers() int {
+	if workers := c.config.Analysis.Workers; workers > 0 {
+		return workers
+	}
+	return 1
+}
+
+// analysisPolicy returns the policy for a target, matching label selectors
+// against the representative pod. Pods no longer in the cache only match
+// namespace policies.
+func (c *Collector) analysisPolicy(t analysisTarget) config.AnalysisPolicy {
+	var podLabels map[string]string
+	if pod, err := c.podLister.Pods(t.namespace).Get(t.podName); err == nil {
+		podLabels = pod.Labels
+	}
+	return c.config.Analysis.Policies.For(t.namespace, podLabels)
+}
 
-	if len(cpuValues) == 0 {
-		return fmt.Errorf("no metrics data")
+func (c *Collector) analyzeContainer(ctx context.Context, t analysisTarget) error {
+	policy, overridden := t.overrides.apply(c.analysisPolicy(t))
+	recommender, err := newRecommender(c.config.Analysis, policy, c.config.Analysis.LimitsFor(t.namespace))
+	if err != nil {
+		return err
 	}
 
-	// Calculate statistics
-	avgCPU, maxCPU, p95CPU, p99CPU := calculateStats(cpuValues)
-	avgMem, maxMem, p95Mem, p99Mem := calculateStatsInt(memValues)
+	// Get metrics for the policy window from all replicas of the workload
+	windowStart := time.Now().Add(-time.Duration(policy.WindowDays) * 24 * time.Hour)
+	windowEnd := time.Now()
+
+	// Read daily usage histograms rather than samples; the first day of the
+	// window counts in full
+	usage, replicas, err := c.loadUsage(t.workloadID, t.containerName, windowStart)
+	if err != nil {
+		return err
+	}
 
-	// Get current resource requests
-	var currentCPU float64
-	var currentMem int64
+	// Get current resource requests and limits
+	var current, currentLimits analysis.Resources
 	err = c.db.QueryRow(`
-		SELECT COALESCE(cpu_request, 0), COALESCE(mem_request, 0)
+		SELECT COALESCE(cpu_request, 0), COALESCE(mem_request, 0), COALESCE(cpu_limit, 0), COALESCE(mem_limit, 0)
 		FROM resource_requests
 		WHERE container_id = $1
-		ORDER BY updated_at DESC
+		ORDER BY updated_at DESC, id DESC
 		LIMIT 1
-	`, containerID).Scan(&currentCPU, &currentMem)
+	`, t.containerID).Scan(&current.CPU, &current.Memory, &currentLimits.CPU, &currentLimits.Memory)
 	if err != nil {
 		// No resource requests, use defaults
-		currentCPU = 0.1
-		currentMem = 128 * 1024 * 1024
+		current.CPU = 0.1
+		current.Memory = 128 * 1024 * 1024
 	}
 
-	// Calculate recommended resources (P95 + 20% buffer)
-	recommendedCPU := p95CPU * 1.2
-	recommendedMem := int64(float64(p95Mem) * 1.2)
+	in := analysis.Input{Usage: usage, Current: current, CurrentLimits: currentLimits}
 
-	// Ensure minimums
-	if recommendedCPU < 0.01 {
-		recommendedCPU = 0.01
-	}
-	if recommendedMem < 32*1024*1024 {
-		recommendedMem = 32 * 1024 * 1024
+	// Get the published recommendation, kept unless the new one differs enough
+	in.Published, err = c.publishedRecommendation(t.workloadID, t.containerName)
+	if err != nil {
+		return err
 	}
 
-	// Calculate waste percentages
-	cpuWaste := float64(0)
-	memWaste := float64(0)
-	if currentCPU > 0 {
-		cpuWaste = ((currentCPU - recommendedCPU) / currentCPU) * 100
+	// Get OOMKills of any replica in the window and the size they were killed at
+	err = c.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(CASE WHEN o.memory_limit > 0 THEN o.memory_limit ELSE o.memory_request END), 0)
+		FROM oom_kills o
+		JOIN containers c ON c.id = o.container_id
+		JOIN pods p ON p.id = c.pod_id
+		WHERE p.workload_id = $1 AND c.container_name = $2 AND o.finished_at >= $3
+	`, t.workloadID, t.containerName, windowStart).Scan(&in.OOMKills, &in.OOMMemory)
+	if err != nil {
+		return err
 	}
-	if currentMem > 0 {
-		memWaste = float64(currentMem-recommendedMem) / float64(currentMem) * 100
+
+	// Get restarts of replicas that terminated in the window and crash loops
+	err = c.db.QueryRow(`
+		SELECT
+			COALESCE(SUM(CASE WHEN s.last_finished_at >= $3 THEN s.restart_count ELSE 0 END), 0),
+			COALESCE(BOOL_OR(s.state_reason = 'CrashLoopBackOff'), false)
+		FROM container_statuses s
+		JOIN containers c ON c.id = s.container_id
+		JOIN pods p ON p.id = c.pod_id
+		WHERE p.workload_id = $1 AND c.container_name = $2
+	`, t.workloadID, t.containerName, windowStart).Scan(&in.Restarts, &in.CrashLooping)
+	if err != nil {
+		return err
 	}
 
-	// Clamp waste to reasonable bounds
-	if cpuWaste < -100 {
-		cpuWaste = -100
+	result, err := recommender.Recommend(in)
+	if err != nil {
+		return err
 	}
-	if memWaste < -100 {
-		memWaste = -100
+	stats := result.Stats
+
+	var changedAt sql.NullTime
+	var cpuChange, memChange sql.NullFloat64
+	if change := result.RequestChange; change != nil {
+		changedAt = sql.NullTime{Time: change.At, Valid: true}
+		cpuChange = sql.NullFloat64{Float64: change.CPUPercent, Valid: true}
+		memChange = sql.NullFloat64{Float64: change.MemoryPercent, Valid: true}
 	}
 
-	// Calculate monthly savings
-	cpuSavings := float64(0)
-	memSavings := float64(0)
-	if cpuWaste > 0 {
-		cpuSavings = (currentCPU - recommendedCPU) * c.config.Analysis.CPUCostPerCore
+	// Generate recommendation
+	reason := fmt.Sprintf("Based on %d data points from %d replicas over %d days (%s strategy, %s policy). CPU waste: %.1f%%, Memory waste: %.1f%%. Memory: %s",
+		stats.Samples, replicas, policy.WindowDays, result.Strategy, policy.Name, result.CPUWastePercent, result.MemoryWastePercent, result.MemoryReason)
+	if result.RiskReason != "" {
+		reason += ". At risk: " + result.RiskReason
+	}
+	if result.ThrottleReason != "" {
+		reason += ". " + result.ThrottleReason
 	}
-	if memWaste > 0 {
-		memSavings = float64(currentMem-recommendedMem) / (1024 * 1024 * 1024) * c.config.Analysis.MemoryCostPerGB
+	if change := result.RequestChange; change != nil {
+		reason += fmt.Sprintf(". Requests changed on %s (CPU %+.0f%%, memory %+.0f%%)",
+			change.At.Format("2006-01-02"), change.CPUPercent, change.MemoryPercent)
 	}
-	monthlySavings := cpuSavings + memSavings
-	if monthlySavings < 0 {
-		monthlySavings = 0
+	if len(overridden) > 0 {
+		reason += ". Annotation overrides: " + strings.Join(overridden, ", ")
+	}
+	if result.Held {
+		reason += fmt.Sprintf(". Unchanged since %s", result.StableSince.Format("2006-01-02 15:04"))
 	}
 
-	// Determine status
-	status := "optimal"
-	if cpuWaste > 30 || memWaste > 30 {
-		status = "over-provisioned"
-	} else if cpuWaste < -20 || memWaste < -20 {
-		status = "under-provisioned"
+	// Replace the current analysis and the live recommendation together
+	now := time.Now()
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	// Determine confidence based on data points
-	confidence := "low"
-	if len(cpuValues) >= 100 {
-		confidence = "high"
-	} else if len(cpuValues) >= 20 {
-		confidence = "medium"
+	_, err = tx.Exec(`
+		UPDATE analyses SET is_current = false
+		WHERE is_current AND workload_id = $1 AND container_name = $2
+	`, t.workloadID, t.containerName)
+	if err != nil {
+		return err
 	}
 
-	// Insert analysis
 	var analysisID int64
-	err = c.db.QueryRow(`
+	err = tx.QueryRow(`
 		INSERT INTO analyses (
-			container_id, analyzed_at, window_start, window_end,
+			container_id, workload_id, analyzed_at, window_start, window_end,
 			avg_cpu, max_cpu, p95_cpu, p99_cpu,
 			avg_memory, max_memory, p95_memory, p99_memory,
 			current_cpu_request, current_mem_request,
 			recommended_cpu, recommended_memory,
 			cpu_waste_percent, memory_waste_percent,
-			monthly_savings, status, confidence
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+			monthly_savings, status, confidence,
+			p95_cpu_throttled, current_cpu_limit, recommended_cpu_limit,
+			current_mem_limit, recommended_memory_limit, limit_policy, policy,
+			requests_changed_at, cpu_request_change_percent, memory_request_change_percent,
+			container_name, is_current, stable_since
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, true, $34)
 		RETURNING id
-	`, containerID, time.Now(), windowStart, windowEnd,
-		avgCPU, maxCPU, p95CPU, p99CPU,
-		avgMem, maxMem, p95Mem, p99Mem,
-		currentCPU, currentMem, recommendedCPU, recommendedMem,
-		cpuWaste, memWaste, monthlySavings, status, confidence).Scan(&analysisID)
-
+	`, t.containerID, t.workloadID, now, windowStart, windowEnd,
+		stats.AvgCPU, stats.MaxCPU, stats.P95CPU, stats.P99CPU,
+		stats.AvgMemory, stats.MaxMemory, stats.P95Memory, stats.P99Memory,
+		current.CPU, current.Memory, result.Recommended.CPU, result.Recommended.Memory,
+		result.CPUWastePercent, result.MemoryWastePercent, result.MonthlySavings,
+		result.Status, result.Confidence,
+		stats.P95Throttled, currentLimits.CPU, result.RecommendedLimits.CPU,
+		currentLimits.Memory, result.RecommendedLimits.Memory, result.LimitPolicy.String(), policy.Name,
+		changedAt, cpuChange, memChange,
+		t.containerName, result.StableSince).Scan(&analysisID)
 	if err != nil {
 		return err
 	}
 
-	// Generate recommendation
-	reason := fmt.Sprintf("Based on %d data points over 7 days. CPU waste: %.1f%%, Memory waste: %.1f%%",
-		len(cpuValues), cpuWaste, memWaste)
-
-	_, err = c.db.Exec(`
-		INSERT INTO recommendations (
-			analysis_id, namespace, pod_name, container_name,
-			current_cpu, current_memory,
-			recommended_cpu, recommended_memory,
-			monthly_savings, confidence, status, reason, applied
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
-	`, analysisID, namespace, podName, containerName,
-		currentCPU, currentMem, recommendedCPU, recommendedMem,
-		monthlySavings, confidence, status, reason, false)
-
-	log.Printf("  Analyzed %s/%s/%s: status=%s, savings=$%.2f/month",
-		namespace, podName, containerName, status, monthlySavings)
-
-	return err
-}
-
-func calculateStats(values []float64) (avg, max, p95, p99 float64) {
-	if len(values) == 0 {
-		return
-	}
-
-	// Sort for percentiles
-	sorted := make([]float64, len(values))
-	copy(sorted, values)
-	sort.Float64s(sorted)
-
-	// Calculate average
-	var sum float64
-	for _, v := range values {
-		sum += v
-	}
-	avg = sum / float64(len(values))
-
-	// Max
-	max = sorted[len(sorted)-1]
-
-	// P95
-	p95Index := int(float64(len(sorted)) * 0.95)
-	if p95Index >= len(sorted) {
-		p95Index = len(sorted) - 1
-	}
-	p95 = sorted[p95Index]
-
-	// P99
-	p99Index := int(float64(len(sorted)) * 0.99)
-	if p99Index >= len(sorted) {
-		p99Index = len(sorted) - 1
+	if err := storeSegments(tx, analysisID, result.Segments); err != nil {
+		return fmt.Errorf("failed to store request segments: %w", err)
 	}
-	p99 = sorted[p99Index]
 
-	return
-}
-
-func calculateStatsInt(values []int64) (avg, max, p95, p99 int64) {
-	if len(values) == 0 {
-		return
-	}
-
-	// Sort for percentiles
-	sorted := make([]int64, len(values))
-	copy(sorted, values)
-	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
-
-	// Calculate average
-	var sum int64
-	for _, v := range values {
-		sum += v
+	err = storeRecommendation(tx, recommendation{
+		analysisID:        analysisID,
+		target:            t,
+		current:           current,
+		currentLimits:     currentLimits,
+		recommended:       result.Recommended,
+		recommendedLimits: result.RecommendedLimits,
+		monthlySavings:    result.MonthlySavings,
+		confidence:        result.Confidence,
+		status:            result.Status,
+		reason:            reason,
+	}, now)
+	if err != nil {
+		return fmt.Errorf("failed to store recommendation: %w", err)
 	}
-	avg = sum / int64(len(values))
 
-	// Max
-	max = sorted[len(sorted)-1]
-
-	// P95
-	p95Index := int(float64(len(sorted)) * 0.95)
-	if p95Index >= len(sorted) {
-		p95Index = len(sorted) - 1
+	if err := tx.Commit(); err != nil {
+		return err
 	}
-	p95 = sorted[p95Index]
 
-	// P99
-	p99Index := int(float64(len(sorted)) * 0.99)
-	if p99Index >= len(sorted) {
-		p99Index = len(sorted) - 1
-	}
-	p99 = sorted[p99Index]
+	log.Printf("  Analyzed %s/%s %s/%s: status=%s, savings=$%.2f/month, stable since %s",
+		t.namespace, t.workloadKind, t.workloadName, t.containerName, result.Status, result.MonthlySavings,
+		result.StableSince.Format(time.RFC3339))
 
-	return
+	return nil
 }
 
-func isImportantSystemPod(name string) bool {
-	// Include some important system pods
-	importantPrefixes := []string{
-		"coredns",
-		"metrics-server",
-		"aws-node",
-		"kube-proxy",
-	}
-	for _, prefix := range importantPrefixes {
-		if len(name) >= len(prefix) && name[:len(prefix)] == prefix {
-			return true
+// storeSegments records the usage under each set of requests seen in the
+// analysis window.
+func storeSegments(tx *sql.Tx, analysisID int64, segments []analysis.Segment) error {
+	for _, seg := range segments {
+		_, err := tx.Exec(`
+			INSERT INTO analysis_segments (
+				analysis_id, cpu_request, mem_request, start_at, end_at, samples, p95_cpu, p95_memory
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`, analysisID, seg.Requests.CPU, seg.Requests.Memory, seg.Start, seg.End, seg.Samples, seg.P95CPU, seg.P95Memory)
+		if err != nil {
+			return err
 		}
 	}
-	return false
+	return nil
 }
-
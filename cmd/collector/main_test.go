@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/scaleops/k8s-optimizer/internal/config"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSelectTargets(t *testing.T) {
+	now := time.Now()
+	analyzed := sql.NullTime{Time: now.Add(-time.Hour), Valid: true}
+
+	c := testCollector(t, config.ScopeConfig{ExcludeNamespaces: []string{"kube-system"}})
+	c.analyzedAll = true
+	targets := []*analysisTarget{
+		{workloadName: "web", namespace: "shop", analyzedAt: analyzed},
+		{workloadName: "new", namespace: "shop"},
+		{workloadName: "excluded", namespace: "shop", excluded: true, analyzedAt: analyzed},
+		// Already retired
+		{workloadName: "retired", namespace: "shop", excluded: true},
+		// Collected before kube-system was excluded
+		{workloadName: "coredns", namespace: "kube-system", analyzedAt: analyzed},
+	}
+
+	pending, retired, unchanged := c.selectTargets(targets, now)
+	if len(pending) != 1 || pending[0].workloadName != "new" {
+		t.Errorf("got pending %+v, want only the never analyzed target", pending)
+	}
+	if unchanged != 1 {
+		t.Errorf("got %d unchanged, want 1", unchanged)
+	}
+	if len(retired) != 2 ||
+		retired[0].target.workloadName != "excluded" || retired[0].reason != "excluded from analysis" ||
+		retired[1].target.workloadName != "coredns" || retired[1].reason != "out of collection scope" {
+		t.Errorf("got retired %+v, want the excluded and out-of-scope targets with a current analysis", retired)
+	}
+}
+
+func TestLivePods(t *testing.T) {
+	c := testCollector(t, config.ScopeConfig{ExcludeNamespaces: []string{"kube-system"}, PodSelector: "tier!=test"})
+	test := runningPod("shop", "web-test", nil, nil, "app")
+	test.Labels = map[string]string{"tier": "test"}
+
+	live := c.livePods([]*corev1.Pod{
+		runningPod("shop", "web", nil, nil, "app"),
+		runningPod("kube-system", "coredns", nil, nil, "coredns"),
+		test,
+	})
+	if len(live) != 1 || !live["shop/web"] {
+		t.Errorf("got live pods %v, want only shop/web", live)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// workloadRef identifies the top-level controller that owns a pod.
+// Pods without a controller are treated as their own workload of kind "Pod".
+type workloadRef struct {
+	Kind string
+	Name string
+}
+
+// resolveWorkload walks the pod's controller ownerReferences up to the
+// top-level workload (Pod -> ReplicaSet -> Deployment, Pod -> Job -> CronJob),
+// reading intermediate owners from the informer cache.
+func (c *Collector) resolveWorkload(pod *corev1.Pod) (workloadRef, error) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return workloadRef{Kind: "Pod", Name: pod.Name}, nil
+	}
+
+	owner := workloadRef{Kind: ref.Kind, Name: ref.Name}
+	switch ref.Kind {
+	case "ReplicaSet":
+		rs, err := c.replicaSetLister.ReplicaSets(pod.Namespace).Get(ref.Name)
+		if err != nil {
+			return workloadRef{}, fmt.Errorf("failed to get replicaset %s: %w", ref.Name, err)
+		}
+		if parent := metav1.GetControllerOf(rs); parent != nil && parent.Kind == "Deployment" {
+			owner = workloadRef{Kind: parent.Kind, Name: parent.Name}
+		}
+	case "Job":
+		job, err := c.jobLister.Jobs(pod.Namespace).Get(ref.Name)
+		if err != nil {
+			return workloadRef{}, fmt.Errorf("failed to get job %s: %w", ref.Name, err)
+		}
+		if parent := metav1.GetControllerOf(job); parent != nil && parent.Kind == "CronJob" {
+			owner = workloadRef{Kind: parent.Kind, Name: parent.Name}
+		}
+	}
+
+	return owner, nil
+}
+
+// storeWorkload upserts the workload with the overrides its annotations set.
+func (c *Collector) storeWorkload(namespace string, ref workloadRef, overrides workloadOverrides) (int64, error) {
+	var workloadID int64
+	err := c.db.QueryRow(`
+		INSERT INTO workloads (
+			namespace, kind, name, excluded,
+			override_percentile, override_buffer, override_min_cpu, override_min_memory,
+			created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (namespace, kind, name) DO UPDATE SET
+			excluded = $4,
+			override_percentile = $5, override_buffer = $6, override_min_cpu = $7, override_min_memory = $8,
+			updated_at = $10
+		RETURNING id
+	`, namespace, ref.Kind, ref.Name, overrides.Excluded,
+		overrides.Percentile, overrides.Buffer, overrides.MinCPU, overrides.MinMemory,
+		time.Now(), time.Now()).Scan(&workloadID)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert workload: %w", err)
+	}
+
+	return workloadID, nil
+}
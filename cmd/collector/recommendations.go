@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/scaleops/k8s-optimizer/internal/analysis"
+	"github.com/scaleops/k8s-optimizer/internal/models"
+)
+
+// collectorActor is recorded as the actor of state changes the collector makes.
+const collectorActor = "collector"
+
+// recommendation is the live recommendation of a workload container.
+type recommendation struct {
+	analysisID        int64
+	target            analysisTarget
+	current           analysis.Resources
+	currentLimits     analysis.Resources
+	recommended       analysis.Resources
+	recommendedLimits analysis.Resources
+	monthlySavings    float64
+	confidence        string
+	status            string
+	reason            string
+}
+
+// publishedRecommendation returns the live recommendation of a workload
+// container for the hysteresis, or nil if there is none.
+func (c *Collector) publishedRecommendation(workloadID int64, containerName string) (*analysis.Published, error) {
+	var pub analysis.Published
+	err := c.db.QueryRow(`
+		SELECT recommended_cpu, recommended_memory,
+			COALESCE(recommended_cpu_limit, 0), COALESCE(recommended_memory_limit, 0),
+			COALESCE(stable_since, created_at)
+		FROM recommendations
+		WHERE workload_id = $1 AND container_name = $2 AND state NOT IN ($3, $4)
+	`, workloadID, containerName, models.RecommendationSuperseded, models.RecommendationExpired,
+	).Scan(&pub.Requests.CPU, &pub.Requests.Memory, &pub.Limits.CPU, &pub.Limits.Memory, &pub.Since)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pub, nil
+}
+
+// storeRecommendation keeps a single live recommendation per workload
+// container. While the recommended resources stay the same, which the
+// hysteresis ensures for insignificant changes, it is updated in place with
+// the latest analysis, keeping its state; when they change it is superseded
+// by a new open one, and the old one is kept as history. An applied one isn't
+// superseded while its apply is verified, so a regression the new analysis
+// reacts to, such as an OOMKill, is still rolled back from it.
+func storeRecommendation(tx *sql.Tx, rec recommendation, now time.Time) error {
+	var liveID int64
+	var liveState, applyOutcome string
+	var live analysis.Resources
+	var liveLimits analysis.Resources
+	err := tx.QueryRow(`
+		SELECT r.id, r.state, r.recommended_cpu, r.recommended_memory,
+			COALESCE(r.recommended_cpu_limit, 0), COALESCE(r.recommended_memory_limit, 0),
+			COALESCE((
+				SELECT a.outcome FROM recommendation_applies a
+				WHERE a.recommendation_id = r.id AND a.rolled_back_at IS NULL
+				ORDER BY a.created_at DESC, a.id DESC
+				LIMIT 1
+			), '')
+		FROM recommendations r
+		WHERE r.workload_id = $1 AND r.container_name = $2 AND r.state NOT IN ($3, $4)
+		FOR UPDATE OF r
+	`, rec.target.workloadID, rec.target.containerName, models.RecommendationSuperseded, models.RecommendationExpired,
+	).Scan(&liveID, &liveState, &live.CPU, &live.Memory, &liveLimits.CPU, &liveLimits.Memory, &applyOutcome)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == nil && sameResources(live, rec.recommended) && sameResources(liveLimits, rec.recommendedLimits) {
+		_, err = tx.Exec(`
+			UPDATE recommendations SET
+				analysis_id = $2, pod_name = $3,
+				current_cpu = $4, current_memory = $5, current_cpu_limit = $6, current_memory_limit = $7,
+				monthly_savings = $8, confidence = $9, status = $10, reason = $11, updated_at = $12
+			WHERE id = $1
+		`, liveID, rec.analysisID, rec.target.podName,
+			rec.current.CPU, rec.current.Memory, rec.currentLimits.CPU, rec.currentLimits.Memory,
+			rec.monthlySavings, rec.confidence, rec.status, rec.reason, now)
+		return err
+	}
+	if err == nil && verifyingApply(liveState, applyOutcome) {
+		return nil
+	}
+
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE recommendations SET state = $2, superseded_at = $3, state_changed_at = $3, state_actor = $4, state_reason = NULL
+			WHERE id = $1
+		`, liveID, models.RecommendationSuperseded, now, collectorActor)
+		if err != nil {
+			return err
+		}
+		if err := recordEvent(tx, liveID, liveState, models.RecommendationSuperseded, "newer analysis changed the recommended resources", now); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO recommendations (
+			analysis_id, workload_id, namespace, pod_name, container_name,
+			workload_kind, workload_name,
+			current_cpu, current_memory, current_cpu_limit, current_memory_limit,
+			recommended_cpu, recommended_memory, recommended_cpu_limit, recommended_memory_limit,
+			monthly_savings, confidence, status, reason, applied, created_at, updated_at,
+			state, state_changed_at, state_actor
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $21, $22, $21, $23)
+	`, rec.analysisID, rec.target.workloadID, rec.target.namespace, rec.target.podName, rec.target.containerName,
+		rec.target.workloadKind, rec.target.workloadName,
+		rec.current.CPU, rec.current.Memory, rec.currentLimits.CPU, rec.currentLimits.Memory,
+		rec.recommended.CPU, rec.recommended.Memory, rec.recommendedLimits.CPU, rec.recommendedLimits.Memory,
+		rec.monthlySavings, rec.confidence, rec.status, rec.reason, false, now,
+		models.RecommendationOpen, collectorActor)
+	return err
+}
+
+// verifyingApply reports whether a live recommendation is applied and its
+// apply is still being verified.
+func verifyingApply(state, applyOutcome string) bool {
+	return state == models.RecommendationApplied && applyOutcome == models.OutcomeVerifying
+}
+
+// sameResources compares resources at the granularity patches are written
+// in: millicores and MiB.
+func sameResources(a, b analysis.Resources) bool {
+	return math.Round(a.CPU*1000) == math.Round(b.CPU*1000) &&
+		a.Memory/(1024*1024) == b.Memory/(1024*1024)
+}
+
+// maintainRecommendations reopens snoozed recommendations that are due,
+// expires live ones no analysis refreshed within the expiry, since their
+// workload is gone, excluded or out of scope, and tracks in-place resizes.
+func (c *Collector) maintainRecommendations(now time.Time) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	woken, err := transitionWhere(tx, `r.state = 'snoozed' AND r.snoozed_until <= $1`, now,
+		models.RecommendationOpen, "snooze ended", now)
+	if err != nil {
+		return err
+	}
+
+	var expired int64
+	if days := c.config.Analysis.RecommendationExpiryDays; days > 0 {
+		cutoff := now.Add(-time.Duration(days) * 24 * time.Hour)
+		expired, err = transitionWhere(tx, `r.state IN ('open', 'accepted', 'snoozed') AND r.updated_at < $1`, cutoff,
+			models.RecommendationExpired, fmt.Sprintf("not refreshed by an analysis for %d days", days), now)
+		if err != nil {
+			return err
+		}
+	}
+
+	resizes, err := trackResizes(tx, now)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if woken > 0 || expired > 0 {
+		log.Printf("Reopened %d snoozed and expired %d stale recommendations", woken, expired)
+	}
+	if resizes > 0 {
+		log.Printf("Updated the resize status of %d recommendations", resizes)
+	}
+	return nil
+}
+
+// retireTarget drops a target from the dashboard and statistics: its current
+// analysis is no longer current, and its open, accepted and snoozed
+// recommendations expire.
+func (c *Collector) retireTarget(t analysisTarget, reason string, now time.Time) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE analyses SET is_current = false
+		WHERE is_current AND workload_id = $1 AND container_name = $2
+	`, t.workloadID, t.containerName)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		WITH moved AS (
+			UPDATE recommendations r SET state = $3, state_changed_at = $4, state_actor = $5, state_reason = $6
+			FROM recommendations old
+			WHERE old.id = r.id AND r.workload_id = $1 AND r.container_name = $2
+				AND r.state IN ('open', 'accepted', 'snoozed')
+			RETURNING r.id, old.state AS from_state
+		)
+		INSERT INTO recommendation_events (recommendation_id, from_state, to_state, actor, reason, created_at)
+		SELECT id, from_state, $3, $5, $6, $4 FROM moved
+	`, t.workloadID, t.containerName, models.RecommendationExpired, now, collectorActor, reason)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("  Retired %s/%s %s/%s: %s", t.namespace, t.workloadKind, t.workloadName, t.containerName, reason)
+	return nil
+}
+
+// transitionWhere moves the recommendations r matching condition, which takes
+// one argument, to state and records the change. It returns how many moved.
+func transitionWhere(tx *sql.Tx, condition string, arg interface{}, state, reason string, now time.Time) (int64, error) {
+	result, err := tx.Exec(`
+		WITH moved AS (
+			UPDATE recommendations r SET state = $2, state_changed_at = $3, state_actor = $4, state_reason = $5
+			FROM recommendations old
+			WHERE old.id = r.id AND `+condition+`
+			RETURNING r.id, old.state AS from_state
+		)
+		INSERT INTO recommendation_events (recommendation_id, from_state, to_state, actor, reason, created_at)
+		SELECT id, from_state, $2, $4, $5, $3 FROM moved
+	`, arg, state, now, collectorActor, reason)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// recordEvent records a state change made by the collector.
+func recordEvent(tx *sql.Tx, recommendationID int64, from, to, reason string, now time.Time) error {
+	_, err := tx.Exec(`
+		INSERT INTO recommendation_events (recommendation_id, from_state, to_state, actor, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, recommendationID, from, to, collectorActor, reason, now)
+	return err
+}
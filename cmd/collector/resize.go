@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/scaleops/k8s-optimizer/internal/models"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// podResizeStatus returns the state of an in-place resize of the pod from its
+// resize conditions, or nil when no resize is pending or in progress.
+func podResizeStatus(pod *corev1.Pod) *string {
+	status := ""
+	rank := map[string]int{
+		models.ResizeInProgress: 1,
+		models.ResizeDeferred:   2,
+		models.ResizeError:      3,
+		models.ResizeInfeasible: 4,
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		var s string
+		switch {
+		case cond.Type == corev1.PodResizePending && cond.Reason == corev1.PodReasonInfeasible:
+			s = models.ResizeInfeasible
+		case cond.Type == corev1.PodResizePending:
+			s = models.ResizeDeferred
+		case cond.Type == corev1.PodResizeInProgress && cond.Reason == corev1.PodReasonError:
+			s = models.ResizeError
+		case cond.Type == corev1.PodResizeInProgress:
+			s = models.ResizeInProgress
+		default:
+			continue
+		}
+		if rank[s] > rank[status] {
+			status = s
+		}
+	}
+	if status == "" {
+		return nil
+	}
+	return &status
+}
+
+// trackResizes updates the resize status of recommendations applied by
+// resizing pods in place from the workload's pods seen since. The worst pod
+// status wins; the resize is completed once no pod reports one.
+func trackResizes(tx *sql.Tx, now time.Time) (int64, error) {
+	result, err := tx.Exec(`
+		UPDATE recommendations r SET resize_status = s.status, resize_updated_at = $1
+		FROM recommendations old
+		CROSS JOIN LATERAL (
+			SELECT COUNT(*) AS pods, CASE
+				WHEN BOOL_OR(p.resize_status = 'infeasible') THEN 'infeasible'
+				WHEN BOOL_OR(p.resize_status = 'error') THEN 'error'
+				WHEN BOOL_OR(p.resize_status = 'deferred') THEN 'deferred'
+				WHEN BOOL_OR(p.resize_status = 'in-progress') THEN 'in-progress'
+				ELSE 'completed'
+			END AS status
+			FROM pods p
+			WHERE p.workload_id = old.workload_id AND p.deleted_at IS NULL AND p.last_seen_at > old.resize_updated_at
+		) s
+		WHERE old.id = r.id AND old.state = 'applied' AND old.resize_status IS NOT NULL AND old.resize_status <> 'completed'
+			AND s.pods > 0 AND s.status <> old.resize_status
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
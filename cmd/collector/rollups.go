@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Rollup resolutions, also the keys of rollup_state.
+const (
+	resolutionHourly = "hourly"
+	resolutionDaily  = "daily"
+)
+
+// maintainMetrics rolls raw samples up into hourly and hourly rollups into
+// daily aggregates, updates the daily usage histograms, then expires data past
+// its retention. Only data that has been rolled up is expired.
+func (c *Collector) maintainMetrics() error {
+	now := time.Now()
+
+	if err := c.rollup(resolutionHourly, "hour", `
+		INSERT INTO metrics_hourly (
+			container_id, bucket, samples,
+			avg_cpu, max_cpu, p95_cpu,
+			avg_memory, max_memory, p95_memory,
+			p95_throttled
+		)
+		SELECT container_id, date_trunc('hour', timestamp), COUNT(*),
+			AVG(cpu_usage), MAX(cpu_usage), percentile_cont(0.95) WITHIN GROUP (ORDER BY cpu_usage),
+			AVG(memory_usage)::BIGINT, MAX(memory_usage), (percentile_cont(0.95) WITHIN GROUP (ORDER BY memory_usage))::BIGINT,
+			percentile_cont(0.95) WITHIN GROUP (ORDER BY cpu_throttled_ratio)
+		FROM metrics_snapshots
+		WHERE timestamp >= $1 AND timestamp < $2
+		GROUP BY container_id, date_trunc('hour', timestamp)
+		ON CONFLICT (container_id, bucket) DO UPDATE SET
+			samples = EXCLUDED.samples,
+			avg_cpu = EXCLUDED.avg_cpu, max_cpu = EXCLUDED.max_cpu, p95_cpu = EXCLUDED.p95_cpu,
+			avg_memory = EXCLUDED.avg_memory, max_memory = EXCLUDED.max_memory, p95_memory = EXCLUDED.p95_memory,
+			p95_throttled = EXCLUDED.p95_throttled
+	`, `SELECT date_trunc('hour', MIN(timestamp)) FROM metrics_snapshots`, now); err != nil {
+		return fmt.Errorf("hourly rollup: %w", err)
+	}
+
+	// Daily P95s are the P95 of the hourly ones, a close upper estimate
+	if err := c.rollup(resolutionDaily, "day", `
+		INSERT INTO metrics_daily (
+			container_id, bucket, samples,
+			avg_cpu, max_cpu, p95_cpu,
+			avg_memory, max_memory, p95_memory,
+			p95_throttled
+		)
+		SELECT container_id, date_trunc('day', bucket), SUM(samples),
+			SUM(avg_cpu * samples) / SUM(samples), MAX(max_cpu), percentile_cont(0.95) WITHIN GROUP (ORDER BY p95_cpu),
+			(SUM(avg_memory * samples) / SUM(samples))::BIGINT, MAX(max_memory), (percentile_cont(0.95) WITHIN GROUP (ORDER BY p95_memory))::BIGINT,
+			percentile_cont(0.95) WITHIN GROUP (ORDER BY p95_throttled)
+		FROM metrics_hourly
+		WHERE bucket >= $1 AND bucket < $2
+		GROUP BY container_id, date_trunc('day', bucket)
+		ON CONFLICT (container_id, bucket) DO UPDATE SET
+			samples = EXCLUDED.samples,
+			avg_cpu = EXCLUDED.avg_cpu, max_cpu = EXCLUDED.max_cpu, p95_cpu = EXCLUDED.p95_cpu,
+			avg_memory = EXCLUDED.avg_memory, max_memory = EXCLUDED.max_memory, p95_memory = EXCLUDED.p95_memory,
+			p95_throttled = EXCLUDED.p95_throttled
+	`, `SELECT date_trunc('day', MIN(bucket)) FROM metrics_hourly`, now); err != nil {
+		return fmt.Errorf("daily rollup: %w", err)
+	}
+
+	if err := c.maintainHistograms(now); err != nil {
+		return fmt.Errorf("usage histograms: %w", err)
+	}
+
+	return c.expireMetrics(now)
+}
+
+// rollup aggregates the complete buckets since the watermark of resolution,
+// re-aggregating the last bucket before it to pick up late samples. A
+// watermark rewound to mid-bucket re-aggregates that whole bucket. The
+// query receives the [from, to) range as $1 and $2; firstQuery returns the
+// first bucket of the source when there is no watermark yet.
+func (c *Collector) rollup(resolution, unit, query, firstQuery string, now time.Time) error {
+	var to time.Time
+	var from sql.NullTime
+	err := c.db.QueryRow(`
+		SELECT date_trunc($1, $2::TIMESTAMP),
+			(SELECT date_trunc($1, rolled_until - ('1 ' || $1)::INTERVAL) FROM rollup_state WHERE resolution = $3)
+	`, unit, now, resolution).Scan(&to, &from)
+	if err != nil {
+		return err
+	}
+	if !from.Valid {
+		if err := c.db.QueryRow(firstQuery).Scan(&from); err != nil {
+			return err
+		}
+		if !from.Valid {
+			return nil // nothing to roll up yet
+		}
+	}
+	if !from.Time.Before(to) {
+		return nil
+	}
+
+	result, err := c.db.Exec(query, from.Time, to)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(`
+		INSERT INTO rollup_state (resolution, rolled_until) VALUES ($1, $2)
+		ON CONFLICT (resolution) DO UPDATE SET rolled_until = $2
+	`, resolution, to)
+	if err != nil {
+		return err
+	}
+
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		log.Printf("Rolled up %d %s buckets", rows, resolution)
+	}
+	return nil
+}
+
+// rewindRollups moves the watermarks back so samples inserted before them,
+// such as backfilled history, are rolled up on the next maintenance.
+func (c *Collector) rewindRollups(since time.Time) error {
+	_, err := c.db.Exec(`
+		UPDATE rollup_state SET rolled_until = LEAST(rolled_until, $1)
+	`, since)
+	return err
+}
+
+// expireMetrics deletes raw samples and rollups past their retention that
+// the next coarser resolution already covers. Raw samples are also kept until
+// the usage histograms cover them.
+func (c *Collector) expireMetrics(now time.Time) error {
+	retention := c.config.Retention
+	rawBoundary, hourlyBoundary := retention.ResolutionBoundaries(now)
+
+	if retention.RawDays > 0 {
+		if _, err := c.db.Exec(`
+			DELETE FROM metrics_snapshots
+			WHERE timestamp < $1
+				AND timestamp < (SELECT rolled_until FROM rollup_state WHERE resolution = $2)
+				AND timestamp < (SELECT rolled_until FROM rollup_state WHERE resolution = $3)
+		`, rawBoundary, resolutionHourly, resolutionHistogram); err != nil {
+			return fmt.Errorf("failed to expire raw samples: %w", err)
+		}
+	}
+
+	if retention.HourlyDays > 0 {
+		if _, err := c.db.Exec(`
+			DELETE FROM metrics_hourly
+			WHERE bucket < $1
+				AND bucket < (SELECT rolled_until FROM rollup_state WHERE resolution = $2)
+		`, hourlyBoundary, resolutionDaily); err != nil {
+			return fmt.Errorf("failed to expire hourly rollups: %w", err)
+		}
+	}
+
+	if retention.DailyDays > 0 {
+		cutoff := now.Add(-time.Duration(retention.DailyDays) * 24 * time.Hour)
+		if _, err := c.db.Exec(`DELETE FROM metrics_daily WHERE bucket < $1`, cutoff); err != nil {
+			return fmt.Errorf("failed to expire daily rollups: %w", err)
+		}
+	}
+
+	if retention.HistogramDays > 0 {
+		cutoff := now.Add(-time.Duration(retention.HistogramDays) * 24 * time.Hour)
+		if _, err := c.db.Exec(`DELETE FROM usage_histograms WHERE day < $1`, cutoff); err != nil {
+			return fmt.Errorf("failed to expire usage histograms: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/scaleops/k8s-optimizer/internal/config"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// scope decides which pods the collector tracks, by namespace globs and a
+// pod label selector.
+type scope struct {
+	include  []string
+	exclude  []string
+	selector labels.Selector
+}
+
+func newScope(cfg config.ScopeConfig) (*scope, error) {
+	for _, pattern := range append(append([]string{}, cfg.IncludeNamespaces...), cfg.ExcludeNamespaces...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %q: %w", pattern, err)
+		}
+	}
+
+	selector := labels.Everything()
+	if cfg.PodSelector != "" {
+		var err error
+		selector, err = labels.Parse(cfg.PodSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod selector %q: %w", cfg.PodSelector, err)
+		}
+	}
+
+	return &scope{include: cfg.IncludeNamespaces, exclude: cfg.ExcludeNamespaces, selector: selector}, nil
+}
+
+// matches reports whether the pod is in scope.
+func (s *scope) matches(pod *corev1.Pod) bool {
+	return s.matchesNamespace(pod.Namespace) && s.selector.Matches(labels.Set(pod.Labels))
+}
+
+// matchesNamespace reports whether the namespace is included and not
+// excluded.
+func (s *scope) matchesNamespace(namespace string) bool {
+	if matchAny(s.exclude, namespace) {
+		return false
+	}
+	return len(s.include) == 0 || matchAny(s.include, namespace)
+}
+
+func (s *scope) String() string {
+	return fmt.Sprintf("namespaces=%v, excluded=%v, selector=%q", s.include, s.exclude, s.selector.String())
+}
+
+func matchAny(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/scaleops/k8s-optimizer/internal/analysis"
+	"github.com/scaleops/k8s-optimizer/internal/config"
+	"github.com/scaleops/k8s-optimizer/internal/metrics"
+
+	"k8s.io/client-go/rest"
+	metricsv1beta1 "k8s.io/metrics/pkg/client/clientset/versioned"
+)
+
+const prometheusTimeout = 30 * time.Second
+
+// newMetricsSource builds the usage source selected by configuration.
+func newMetricsSource(cfg config.MetricsConfig, kubeConfig *rest.Config, c *Collector) (metrics.MetricsSource, error) {
+	switch cfg.Source {
+	case "", "metrics-server":
+		metricsClient, err := metricsv1beta1.NewForConfig(kubeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create metrics client: %w", err)
+		}
+		return metrics.NewMetricsServerSource(metricsClient, c.namespace), nil
+	case "prometheus":
+		client := &http.Client{Timeout: prometheusTimeout}
+		return metrics.NewPrometheusSource(cfg.PrometheusURL, c.namespace, client), nil
+	case "kubelet":
+		return metrics.NewKubeletSource(c.clientset.CoreV1().RESTClient(), c.nodeLister, c.namespace), nil
+	default:
+		return nil, fmt.Errorf("unknown metrics source %q", cfg.Source)
+	}
+}
+
+// newRecommender builds the sizing strategy selected by configuration with
+// the given analysis and limit policies.
+func newRecommender(cfg config.AnalysisConfig, policy config.AnalysisPolicy, limits config.LimitPolicyConfig) (analysis.Recommender, error) {
+	opts := analysis.DefaultOptions()
+	opts.Percentile = policy.Percentile
+	opts.Buffer = policy.Buffer
+	opts.MinCPU = policy.MinCPU
+	opts.MinMemory = policy.MinMemory
+	opts.OverProvisionedThreshold = policy.OverProvisionedThreshold
+	opts.UnderProvisionedThreshold = policy.UnderProvisionedThreshold
+	opts.CPUCostPerCore = cfg.CPUCostPerCore
+	opts.MemoryCostPerGB = cfg.MemoryCostPerGB
+	opts.MemoryBasis = cfg.MemoryBasis
+	opts.MemoryMargin = cfg.MemoryMargin
+	opts.OOMBump = cfg.OOMBump
+	opts.RestartThreshold = cfg.RestartThreshold
+	opts.ThrottlingThreshold = cfg.ThrottlingThreshold
+	opts.Limits = analysis.LimitPolicy{CPU: limits.CPU, Memory: limits.Memory, Headroom: limits.Headroom}
+	opts.Hysteresis = analysis.Hysteresis{
+		Percent: cfg.RecommendationMinChange,
+		CPU:     cfg.RecommendationMinChangeCPU,
+		Memory:  cfg.RecommendationMinChangeMemory,
+	}
+	return analysis.New(cfg.Strategy, opts)
+}
+
+// validateRecommenders builds a recommender for every analysis policy and
+// every per-namespace limit policy, so misconfiguration fails at startup
+// rather than on the first analysis.
+func validateRecommenders(cfg config.AnalysisConfig) error {
+	for _, policy := range cfg.Policies.All() {
+		if _, err := newRecommender(cfg, policy, cfg.Limits); err != nil {
+			return fmt.Errorf("policy %s: %w", policy.Name, err)
+		}
+	}
+	for namespace, limits := range cfg.NamespaceLimits {
+		if _, err := newRecommender(cfg, cfg.Policies.Default, limits); err != nil {
+			return fmt.Errorf("namespace %s: %w", namespace, err)
+		}
+	}
+	return nil
+}
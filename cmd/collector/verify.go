@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/scaleops/k8s-optimizer/internal/apply"
+	"github.com/scaleops/k8s-optimizer/internal/config"
+	"github.com/scaleops/k8s-optimizer/internal/models"
+	"github.com/scaleops/k8s-optimizer/internal/repository"
+)
+
+// webhookTimeout bounds a regression notification.
+const webhookTimeout = 10 * time.Second
+
+// verification is an apply being watched for regressions.
+type verification struct {
+	apply      models.RecommendationApply
+	workloadID int64
+	replaced   bool // by a later apply to the container that stands
+}
+
+// regressions returns the thresholds the observed signals breach.
+func (v *verification) regressions(cfg config.VerificationConfig) []string {
+	a := &v.apply
+	var breached []string
+	if a.OOMKills > cfg.MaxOOMKills {
+		breached = append(breached, fmt.Sprintf("%d OOMKills", a.OOMKills))
+	}
+	if a.Restarts > cfg.MaxRestarts {
+		breached = append(breached, fmt.Sprintf("%d restarts", a.Restarts))
+	}
+
+	// Usage needs enough samples not to judge a single spike
+	if a.Samples < cfg.MinSamples {
+		return breached
+	}
+	if a.P95Throttled > cfg.MaxThrottled {
+		breached = append(breached, fmt.Sprintf("P95 CPU throttling of %.0f%%", a.P95Throttled*100))
+	}
+	if a.CPURequest > 0 && a.P95CPU > a.CPURequest*cfg.MaxUsage {
+		breached = append(breached, fmt.Sprintf("P95 CPU usage of %.0fm over the %.0fm request",
+			a.P95CPU*1000, a.CPURequest*1000))
+	}
+	if a.MemoryRequest > 0 && float64(a.P95Memory) > float64(a.MemoryRequest)*cfg.MaxUsage {
+		breached = append(breached, fmt.Sprintf("P95 memory usage of %dMi over the %dMi request",
+			a.P95Memory/(1024*1024), a.MemoryRequest/(1024*1024)))
+	}
+	return breached
+}
+
+// verifyApplies watches recently applied recommendations for regressions
+// until their verification period ends. An apply regresses as soon as a
+// threshold is breached, and is verified once the period passes without one.
+// Regressions are logged, sent to the webhook and, with auto-rollback, rolled
+// back; failed rollbacks are retried on later runs.
+func (c *Collector) verifyApplies(ctx context.Context, now time.Time) error {
+	cfg := c.config.Verification
+	if cfg.Period <= 0 {
+		return nil
+	}
+
+	started, err := c.startVerifications(now, cfg.Period)
+	if err != nil {
+		return err
+	}
+	if started > 0 {
+		log.Printf("Verifying %d newly applied recommendations", started)
+	}
+
+	if err := c.retryRollbacks(ctx); err != nil {
+		return err
+	}
+
+	verifications, err := c.appliesWithOutcome(models.OutcomeVerifying)
+	if err != nil {
+		return err
+	}
+
+	for i := range verifications {
+		v := &verifications[i]
+		if err := c.measure(v); err != nil {
+			log.Printf("Warning: failed to measure apply %d of recommendation %d: %v", v.apply.ID, v.apply.RecommendationID, err)
+			continue
+		}
+
+		outcome, reason := models.OutcomeVerifying, ""
+		if breached := v.regressions(cfg); len(breached) > 0 {
+			outcome, reason = models.OutcomeRegressed, strings.Join(breached, ", ")
+		} else if v.apply.VerifyUntil != nil && !now.Before(*v.apply.VerifyUntil) {
+			outcome, reason = models.OutcomeVerified, "no regression during the verification period"
+		}
+		if err := c.storeVerification(v, outcome, reason, now); err != nil {
+			log.Printf("Warning: failed to store verification of recommendation %d: %v", v.apply.RecommendationID, err)
+			continue
+		}
+
+		switch outcome {
+		case models.OutcomeVerified:
+			log.Printf("Verified recommendation %d on %s/%s %s", v.apply.RecommendationID,
+				v.apply.Namespace, v.apply.WorkloadKind, v.apply.WorkloadName)
+		case models.OutcomeRegressed:
+			c.regressed(ctx, v, reason)
+		}
+	}
+	return nil
+}
+
+// startVerifications starts verifying the applies made within the period
+// that were not rolled back, whatever became of their recommendation since,
+// and snapshots the restart counts of the workload's
+// containers that restarts are counted from. Older applies are not verified.
+func (c *Collector) startVerifications(now time.Time, period time.Duration) (int64, error) {
+	result, err := c.db.Exec(`
+		WITH started AS (
+			UPDATE recommendation_applies a SET outcome = $1, verify_until = a.created_at + $2::float8 * INTERVAL '1 second'
+			FROM recommendations r
+			WHERE r.id = a.recommendation_id AND a.outcome IS NULL AND a.rolled_back_at IS NULL
+				AND a.created_at > $3
+			RETURNING a.id, a.recommendation_id, a.container_name, a.created_at, r.workload_id
+		), baseline AS (
+			INSERT INTO verification_restarts (apply_id, container_id, restart_count)
+			SELECT s.id, c.id, cs.restart_count
+			FROM started s
+			JOIN pods p ON p.workload_id = s.workload_id AND p.first_seen_at <= s.created_at
+			JOIN containers c ON c.pod_id = p.id AND c.container_name = s.container_name
+			JOIN container_statuses cs ON cs.container_id = c.id
+			ON CONFLICT DO NOTHING
+		)
+		UPDATE recommendations r SET outcome = $1, outcome_reason = NULL
+		FROM started s
+		WHERE r.id = s.recommendation_id
+	`, models.OutcomeVerifying, period.Seconds(), now.Add(-period))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// appliesWithOutcome returns the applies with outcome that were not rolled
+// back.
+func (c *Collector) appliesWithOutcome(outcome string) ([]verification, error) {
+	rows, err := c.db.Query(`
+		SELECT a.id, a.recommendation_id, a.mode, a.namespace, a.workload_kind, a.workload_name, a.container_name,
+			COALESCE(a.previous_cpu_request, 0), COALESCE(a.previous_memory_request, 0),
+			COALESCE(a.previous_cpu_limit, 0), COALESCE(a.previous_memory_limit, 0),
+			COALESCE(a.cpu_request, 0), COALESCE(a.memory_request, 0),
+			COALESCE(a.cpu_limit, 0), COALESCE(a.memory_limit, 0),
+			COALESCE(a.outcome_reason, ''), a.created_at, a.verify_until, r.workload_id,
+			EXISTS (
+				SELECT 1 FROM recommendation_applies l
+				WHERE l.namespace = a.namespace AND l.workload_kind = a.workload_kind
+					AND l.workload_name = a.workload_name AND l.container_name = a.container_name
+					AND l.rolled_back_at IS NULL AND (l.created_at, l.id) > (a.created_at, a.id)
+			)
+		FROM recommendation_applies a
+		JOIN recommendations r ON r.id = a.recommendation_id
+		WHERE a.outcome = $1 AND a.rolled_back_at IS NULL AND r.workload_id IS NOT NULL
+	`, outcome)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var verifications []verification
+	for rows.Next() {
+		var v verification
+		a := &v.apply
+		if err := rows.Scan(&a.ID, &a.RecommendationID, &a.Mode, &a.Namespace, &a.WorkloadKind, &a.WorkloadName, &a.ContainerName,
+			&a.PreviousCPURequest, &a.PreviousMemoryRequest, &a.PreviousCPULimit, &a.PreviousMemoryLimit,
+			&a.CPURequest, &a.MemoryRequest, &a.CPULimit, &a.MemoryLimit,
+			&a.OutcomeReason, &a.CreatedAt, &a.VerifyUntil, &v.workloadID, &v.replaced); err != nil {
+			return nil, err
+		}
+		a.Outcome = outcome
+		verifications = append(verifications, v)
+	}
+	return verifications, rows.Err()
+}
+
+// measure reads the signals of the workload's container since the apply:
+// OOMKills, restarts past the snapshot, and P95 usage and throttling. A
+// workload apply rolls out new pods, so only pods first seen after it count;
+// resizes and manual applies count every pod.
+func (c *Collector) measure(v *verification) error {
+	a := &v.apply
+	newPodsOnly := a.Mode == models.ApplyModeWorkload
+	return c.db.QueryRow(`
+		WITH scope AS (
+			SELECT c.id
+			FROM containers c
+			JOIN pods p ON p.id = c.pod_id
+			WHERE p.workload_id = $1 AND c.container_name = $2 AND (NOT $4 OR p.first_seen_at >= $3)
+		)
+		SELECT
+			(SELECT COUNT(*) FROM oom_kills o WHERE o.container_id IN (SELECT id FROM scope) AND o.finished_at > $3),
+			(SELECT COALESCE(SUM(GREATEST(cs.restart_count - COALESCE(b.restart_count, 0), 0)), 0)
+				FROM container_statuses cs
+				LEFT JOIN verification_restarts b ON b.apply_id = $5 AND b.container_id = cs.container_id
+				WHERE cs.container_id IN (SELECT id FROM scope)),
+			COUNT(*),
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY m.cpu_usage), 0),
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY m.memory_usage), 0)::BIGINT,
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY m.cpu_throttled_ratio), 0)
+		FROM metrics_snapshots m
+		WHERE m.container_id IN (SELECT id FROM scope) AND m.timestamp > $3
+	`, v.workloadID, a.ContainerName, a.CreatedAt, newPodsOnly, a.ID,
+	).Scan(&a.OOMKills, &a.Restarts, &a.Samples, &a.P95CPU, &a.P95Memory, &a.P95Throttled)
+}
+
+// storeVerification records the signals and outcome of an apply, and the
+// outcome on its recommendation.
+func (c *Collector) storeVerification(v *verification, outcome, reason string, now time.Time) error {
+	a := &v.apply
+	var verifiedAt *time.Time
+	if outcome != models.OutcomeVerifying {
+		verifiedAt = &now
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE recommendation_applies SET
+			outcome = $2, outcome_reason = NULLIF($3, ''), verified_at = $4,
+			oom_kills = $5, restarts = $6, samples = $7, p95_cpu = $8, p95_memory = $9, p95_throttled = $10
+		WHERE id = $1
+	`, a.ID, outcome, reason, verifiedAt,
+		a.OOMKills, a.Restarts, a.Samples, a.P95CPU, a.P95Memory, a.P95Throttled)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE recommendations SET outcome = $2, outcome_reason = NULLIF($3, '') WHERE id = $1
+	`, a.RecommendationID, outcome, reason)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	a.Outcome, a.OutcomeReason, a.VerifiedAt = outcome, reason, verifiedAt
+	return nil
+}
+
+// target is the workload container the apply changed.
+func (v *verification) target() apply.Target {
+	return apply.Target{
+		Namespace: v.apply.Namespace,
+		Kind:      v.apply.WorkloadKind,
+		Name:      v.apply.WorkloadName,
+		Container: v.apply.ContainerName,
+	}
+}
+
+// canRollBack reports whether the collector rolls the apply back on a
+// regression: auto-rollback is on, the apply was made from the optimizer to a
+// kind it can apply to and no later apply replaced it. It doesn't matter
+// whether the recommendation was superseded since. Manual applies were made
+// outside the optimizer, so they are left to the user.
+func (c *Collector) canRollBack(v *verification) bool {
+	return c.applier != nil && v.apply.Mode != models.ApplyModeManual &&
+		!v.replaced && apply.Supported(v.apply.WorkloadKind)
+}
+
+// regressed reports a regressed apply and rolls it back when auto-rollback is
+// on.
+func (c *Collector) regressed(ctx context.Context, v *verification, reason string) {
+	a := &v.apply
+	target := v.target()
+	log.Printf("Recommendation %d regressed on %s: %s", a.RecommendationID, target, reason)
+
+	rolledBack := false
+	if c.canRollBack(v) {
+		if err := c.rollback(ctx, v, target, reason); err != nil {
+			log.Printf("Warning: failed to roll back recommendation %d on %s: %v", a.RecommendationID, target, err)
+		} else {
+			rolledBack = true
+			log.Printf("Rolled back recommendation %d on %s", a.RecommendationID, target)
+		}
+	}
+
+	c.notifyRegression(v, reason, rolledBack)
+}
+
+// notifyRegression posts a regressed apply to the webhook.
+func (c *Collector) notifyRegression(v *verification, reason string, rolledBack bool) {
+	a := &v.apply
+	if err := c.notify(verificationEvent{
+		Event:            models.OutcomeRegressed,
+		RecommendationID: a.RecommendationID,
+		Namespace:        a.Namespace,
+		WorkloadKind:     a.WorkloadKind,
+		WorkloadName:     a.WorkloadName,
+		ContainerName:    a.ContainerName,
+		Reason:           reason,
+		RolledBack:       rolledBack,
+		Apply:            a,
+	}); err != nil {
+		log.Printf("Warning: failed to notify the regression of recommendation %d: %v", a.RecommendationID, err)
+	}
+}
+
+// retryRollbacks rolls back the regressed applies whose rollback failed. They
+// stay regressed and are retried until the rollback succeeds, which is posted
+// to the webhook, or a later apply replaces them.
+func (c *Collector) retryRollbacks(ctx context.Context) error {
+	if c.applier == nil {
+		return nil
+	}
+	regressions, err := c.appliesWithOutcome(models.OutcomeRegressed)
+	if err != nil {
+		return err
+	}
+
+	for i := range regressions {
+		v := &regressions[i]
+		if !c.canRollBack(v) {
+			continue
+		}
+		a, target := &v.apply, v.target()
+		if err := c.rollback(ctx, v, target, a.OutcomeReason); err != nil {
+			log.Printf("Warning: failed to roll back recommendation %d on %s again: %v", a.RecommendationID, target, err)
+			continue
+		}
+		log.Printf("Rolled back recommendation %d on %s", a.RecommendationID, target)
+		c.notifyRegression(v, a.OutcomeReason, true)
+	}
+	return nil
+}
+
+// rollback restores the resources the apply replaced and records the
+// rollback.
+func (c *Collector) rollback(ctx context.Context, v *verification, target apply.Target, reason string) error {
+	if err := c.restore(ctx, v, target); err != nil {
+		return err
+	}
+	repo := repository.NewRepository(c.db)
+	_, err := repo.RecordRollback(&v.apply, collectorActor, "regressed: "+reason)
+	return err
+}
+
+// restore applies the resources the apply replaced, the way it was applied.
+func (c *Collector) restore(ctx context.Context, v *verification, target apply.Target) error {
+	a := &v.apply
+	previous := apply.Resources{
+		CPURequest:    a.PreviousCPURequest,
+		MemoryRequest: a.PreviousMemoryRequest,
+		CPULimit:      a.PreviousCPULimit,
+		MemoryLimit:   a.PreviousMemoryLimit,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, apply.Timeout)
+	defer cancel()
+	var err error
+	if a.Mode == models.ApplyModeResize {
+		_, err = c.applier.Resize(ctx, target, previous, false, false)
+	} else {
+		_, err = c.applier.Apply(ctx, target, previous, false)
+	}
+	return err
+}
+
+// verificationEvent is the JSON body sent to the webhook.
+type verificationEvent struct {
+	Event            string                      `json:"event"`
+	RecommendationID int64                       `json:"recommendation_id"`
+	Namespace        string                      `json:"namespace"`
+	WorkloadKind     string                      `json:"workload_kind"`
+	WorkloadName     string                      `json:"workload_name"`
+	ContainerName    string                      `json:"container_name"`
+	Reason           string                      `json:"reason"`
+	RolledBack       bool                        `json:"rolled_back"`
+	Apply            *models.RecommendationApply `json:"apply"`
+}
+
+// notify posts an event to the verification webhook, if one is configured.
+func (c *Collector) notify(event verificationEvent) error {
+	url := c.config.Verification.WebhookURL
+	if url == "" {
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
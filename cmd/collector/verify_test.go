@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/scaleops/k8s-optimizer/internal/apply"
+	"github.com/scaleops/k8s-optimizer/internal/config"
+	"github.com/scaleops/k8s-optimizer/internal/models"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const mi = 1024 * 1024
+
+func TestRollbackAfterOOMKill(t *testing.T) {
+	labels := map[string]string{"app": "web"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Name: "app",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("250m"),
+							corev1.ResourceMemory: resource.MustParse("200Mi"),
+						},
+					},
+				}}},
+			},
+		},
+	}
+	client := fake.NewClientset(deployment)
+
+	cfg := config.VerificationConfig{MinSamples: 10, MaxUsage: 1}
+	c := testCollector(t, config.ScopeConfig{})
+	c.config.Verification = cfg
+	c.applier = apply.NewForClient(client, config.ApplyConfig{FieldManager: "k8s-optimizer", Force: true})
+
+	v := &verification{apply: models.RecommendationApply{
+		RecommendationID:      1,
+		Mode:                  models.ApplyModeWorkload,
+		Namespace:             "shop",
+		WorkloadKind:          "Deployment",
+		WorkloadName:          "web",
+		ContainerName:         "app",
+		PreviousCPURequest:    0.5,
+		PreviousMemoryRequest: 256 * mi,
+		CPURequest:            0.25,
+		MemoryRequest:         200 * mi,
+		Outcome:               models.OutcomeVerifying,
+		OOMKills:              1,
+	}}
+
+	// The analysis bumping memory after the OOMKill keeps the applied
+	// recommendation instead of superseding it
+	if !verifyingApply(models.RecommendationApplied, v.apply.Outcome) {
+		t.Error("an applied recommendation under verification is superseded")
+	}
+	if verifyingApply(models.RecommendationApplied, models.OutcomeVerified) {
+		t.Error("a verified recommendation is held from being superseded")
+	}
+
+	if breached := v.regressions(cfg); len(breached) != 1 || breached[0] != "1 OOMKills" {
+		t.Fatalf("got regressions %v, want the OOMKill", breached)
+	}
+	if !c.canRollBack(v) {
+		t.Fatal("the regressed apply is not rolled back")
+	}
+	if err := c.restore(context.Background(), v, v.target()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	obj, err := client.AppsV1().Deployments("shop").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := obj.Spec.Template.Spec.Containers[0].Resources.Requests
+	if got := requests.Memory().Value(); got != 256*mi {
+		t.Errorf("got memory request %d, want the previous %d", got, int64(256*mi))
+	}
+	if got := requests.Cpu().MilliValue(); got != 500 {
+		t.Errorf("got CPU request %dm, want the previous 500m", got)
+	}
+
+	// Once a later apply replaced it, rolling it back would undo that one
+	v.replaced = true
+	if c.canRollBack(v) {
+		t.Error("an apply replaced by a later one is rolled back")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/scaleops/k8s-optimizer/internal/apply"
 	"github.com/scaleops/k8s-optimizer/internal/config"
 	"github.com/scaleops/k8s-optimizer/internal/database"
 	"github.com/scaleops/k8s-optimizer/internal/repository"
@@ -19,11 +21,17 @@ import (
 )
 
 func main() {
+	enableApply := flag.Bool("enable-apply", false, "Allow applying recommendations to workloads in the cluster")
+	flag.Parse()
+
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	if *enableApply {
+		cfg.Apply.Enabled = true
+	}
 
 	// Connect to database
 	db, err := database.NewDB(cfg.Database.ConnectionString())
@@ -39,9 +47,22 @@ func main() {
 
 	log.Println("Database connected and schema initialized")
 
+	// Applying to the cluster is opt-in and uses its own credentials
+	var applier *apply.Applier
+	if cfg.Apply.Enabled {
+		if !cfg.Web.AuthEnabled() {
+			log.Fatal("Applying to the cluster requires WEB_AUTH_USER and WEB_AUTH_PASSWORD")
+		}
+		applier, err = apply.New(cfg.Apply)
+		if err != nil {
+			log.Fatalf("Failed to set up applying to the cluster: %v", err)
+		}
+		log.Printf("Applying recommendations to the cluster is enabled (field manager %s)", cfg.Apply.FieldManager)
+	}
+
 	// Create repository and handlers
 	repo := repository.NewRepository(db)
-	handler := handlers.NewHandler(repo, cfg)
+	handler := handlers.NewHandler(repo, cfg, applier)
 
 	// Set Gin mode
 	gin.SetMode(gin.ReleaseMode)
@@ -52,7 +73,7 @@ func main() {
 	// Apply middleware
 	router.Use(middleware.Logger())
 	router.Use(middleware.Recovery())
-	router.Use(middleware.CORS())
+	router.Use(middleware.CORS(cfg.Web.CORSOrigins))
 
 	// Load HTML templates
 	router.LoadHTMLGlob(cfg.Web.TemplatesDir + "/*.html")
@@ -63,7 +84,7 @@ func main() {
 	}
 
 	// Setup routes
-	setupRoutes(router, handler)
+	setupRoutes(router, handler, cfg.Web)
 
 	// Create HTTP server
 	addr := fmt.Sprintf(":%d", cfg.Web.Port)
@@ -101,7 +122,7 @@ func main() {
 	log.Println("Server exited")
 }
 
-func setupRoutes(router *gin.Engine, h *handlers.Handler) {
+func setupRoutes(router *gin.Engine, h *handlers.Handler, web config.WebConfig) {
 	// Health check
 	router.GET("/health", h.HealthCheck)
 
@@ -110,15 +131,33 @@ func setupRoutes(router *gin.Engine, h *handlers.Handler) {
 
 	// API routes
 	api := router.Group("/api")
+
+	// Routes that change state require basic auth when it is configured
+	write := api.Group("")
+	if web.AuthEnabled() {
+		write.Use(middleware.BasicAuth(web.AuthUser, web.AuthPassword))
+	}
 	{
 		// Pods
 		api.GET("/pods", h.GetPods)
 		api.GET("/pod/:namespace/:name", h.GetPodDetail)
+		api.GET("/pod/:namespace/:name/history", h.GetPodHistory)
+
+		// Workloads
+		api.GET("/workloads", h.GetWorkloads)
 
 		// Recommendations
 		api.GET("/recommendations", h.GetRecommendations)
 		api.GET("/recommendations/:id/yaml", h.GetRecommendationYAML)
-		api.POST("/recommendations/:id/apply", h.ApplyRecommendation)
+		api.GET("/recommendations/:id/events", h.GetRecommendationEvents)
+		write.POST("/recommendations/:id/apply", h.ApplyRecommendation)
+		write.POST("/recommendations/:id/apply/cluster", h.ApplyRecommendationToCluster)
+		api.GET("/recommendations/:id/applies", h.GetRecommendationApplies)
+		write.POST("/recommendations/:id/rollback", h.RollbackRecommendation)
+		write.POST("/recommendations/:id/accept", h.AcceptRecommendation)
+		write.POST("/recommendations/:id/dismiss", h.DismissRecommendation)
+		write.POST("/recommendations/:id/snooze", h.SnoozeRecommendation)
+		write.POST("/recommendations/:id/reopen", h.ReopenRecommendation)
 
 		// Statistics
 		api.GET("/stats", h.GetStats)
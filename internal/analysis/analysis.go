@@ -0,0 +1,347 @@
+package analysis
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Status values assigned to an analysis.
+const (
+	StatusOptimal          = "optimal"
+	StatusOverProvisioned  = "over-provisioned"
+	StatusUnderProvisioned = "under-provisioned"
+	StatusAtRisk           = "at-risk"
+)
+
+// Confidence values assigned to an analysis.
+const (
+	ConfidenceLow    = "low"
+	ConfidenceMedium = "medium"
+	ConfidenceHigh   = "high"
+)
+
+// ErrNoSamples is returned when there is no usage data to analyze.
+var ErrNoSamples = errors.New("no metrics data")
+
+// Sample is a single usage observation of a container. Samples are recorded
+// into Usage periods for analysis.
+type Sample struct {
+	Timestamp time.Time
+	CPU       float64 // cores
+	Memory    int64   // bytes
+
+	// ThrottledRatio is the fraction of CFS periods throttled by the CPU
+	// limit, when HasThrottling is set.
+	ThrottledRatio float64
+	HasThrottling  bool
+}
+
+// Resources is a CPU/memory pair, used for both requests and recommendations.
+type Resources struct {
+	CPU    float64 // cores
+	Memory int64   // bytes
+}
+
+// Memory bases the memory policy can size from.
+const (
+	MemoryBasisMax = "max"
+	MemoryBasisP99 = "p99"
+)
+
+// Input is everything a Recommender needs to size one container.
+type Input struct {
+	Usage         []*Usage  // usage periods of all replicas in the window
+	Current       Resources // requests currently in force
+	CurrentLimits Resources // limits currently in force, 0 when unset
+
+	// OOMKills is the number of OOMKilled terminations in the window, and
+	// OOMMemory the largest memory limit (or request when unlimited) the
+	// container was killed at.
+	OOMKills  int
+	OOMMemory int64
+
+	// Restarts counts restarts of replicas that terminated within the window,
+	// and CrashLooping is set when any replica is in CrashLoopBackOff.
+	Restarts     int
+	CrashLooping bool
+
+	// Published is the recommendation currently published, if any. It is
+	// kept while the new one is within the hysteresis.
+	Published *Published
+}
+
+// Result is the structured outcome of an analysis.
+type Result struct {
+	Strategy           string
+	Stats              Stats
+	Current            Resources
+	CurrentLimits      Resources
+	Recommended        Resources
+	RecommendedLimits  Resources // a CPU limit of 0 means no limit
+	LimitPolicy        LimitPolicy
+	CPUWastePercent    float64
+	MemoryWastePercent float64
+	MonthlySavings     float64
+	Status             string
+	Confidence         string
+
+	// MemoryReason explains how the memory recommendation was derived.
+	MemoryReason string
+
+	// RiskReason explains why the container is at risk, if it is.
+	RiskReason string
+
+	// ThrottleReason explains the CPU limit recommendation, if there is one.
+	ThrottleReason string
+
+	// Segments is the usage under each set of requests seen in the window,
+	// and RequestChange the latest change to the current requests, if any.
+	Segments      []Segment
+	RequestChange *RequestChange
+
+	// Held is set when the published recommendation was kept because the new
+	// one was within the hysteresis, and StableSince is when the recommended
+	// values were first published.
+	Held        bool
+	StableSince time.Time
+}
+
+// Recommender sizes a container from its usage history.
+type Recommender interface {
+	// Name identifies the strategy in configuration and analysis records.
+	Name() string
+
+	// Recommend analyzes the input and returns the recommended requests.
+	Recommend(in Input) (*Result, error)
+}
+
+// Options tunes the sizing rules shared by all strategies.
+type Options struct {
+	Percentile float64 // usage percentile to size for, e.g. 0.95
+	Buffer     float64 // headroom added on top, e.g. 0.2 for 20%
+	MinCPU     float64 // cores
+	MinMemory  int64   // bytes
+
+	// Waste percentages beyond which a container is classified as over- or
+	// under-provisioned (the latter is negative).
+	OverProvisionedThreshold  float64
+	UnderProvisionedThreshold float64
+
+	CPUCostPerCore  float64 // $/core/month
+	MemoryCostPerGB float64 // $/GB/month
+
+	// HalfLife is the sample weight decay used by the histogram strategy.
+	HalfLife time.Duration
+
+	// Memory is incompressible, so memory is never sized below the observed
+	// MemoryBasis (max or p99 working set) plus MemoryMargin, and is bumped by
+	// OOMBump over the size it was killed at when the container was OOMKilled.
+	MemoryBasis  string
+	MemoryMargin float64
+	OOMBump      float64
+
+	// RestartThreshold is the number of recent restarts that marks a
+	// container at risk.
+	RestartThreshold int
+
+	// ThrottlingThreshold is the P95 throttled-periods ratio above which the
+	// CPU limit is considered too low, e.g. 0.25 for 25% of periods.
+	ThrottlingThreshold float64
+
+	// Limits derives limits from the recommended requests.
+	Limits LimitPolicy
+
+	// Hysteresis keeps the published recommendation until the new one
+	// differs from it significantly.
+	Hysteresis Hysteresis
+}
+
+// DefaultOptions returns the optimizer's standard sizing rules:
+// P95 + 20%, at least 10m CPU and 32Mi memory.
+func DefaultOptions() Options {
+	return Options{
+		Percentile:                0.95,
+		Buffer:                    0.2,
+		MinCPU:                    0.01,
+		MinMemory:                 32 * 1024 * 1024,
+		OverProvisionedThreshold:  30,
+		UnderProvisionedThreshold: -20,
+		HalfLife:                  24 * time.Hour,
+		MemoryBasis:               MemoryBasisMax,
+		MemoryMargin:              0.15,
+		OOMBump:                   0.25,
+		RestartThreshold:          3,
+		ThrottlingThreshold:       0.25,
+		Limits:                    DefaultLimitPolicy(),
+		Hysteresis:                Hysteresis{Percent: 0.1, CPU: 0.02, Memory: 32 * 1024 * 1024},
+	}
+}
+
+// New returns the Recommender for the named strategy.
+func New(strategy string, opts Options) (Recommender, error) {
+	if err := opts.Limits.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch strategy {
+	case "", StrategyPercentile:
+		return &percentileRecommender{opts: opts}, nil
+	case StrategyMaxMemory:
+		return &maxMemoryRecommender{opts: opts}, nil
+	case StrategyHistogram:
+		return &histogramRecommender{opts: opts}, nil
+	default:
+		return nil, fmt.Errorf("unknown analysis strategy %q", strategy)
+	}
+}
+
+// finish applies the minimums and the hysteresis and derives waste, savings,
+// status and confidence for a recommendation produced by a strategy.
+func finish(strategy string, opts Options, in Input, stats Stats, recommended Resources) *Result {
+	var memReason string
+	recommended.Memory, memReason = applyMemoryPolicy(strategy, opts, in, stats, recommended.Memory)
+
+	if recommended.CPU < opts.MinCPU {
+		recommended.CPU = opts.MinCPU
+	}
+	if recommended.Memory < opts.MinMemory {
+		recommended.Memory = opts.MinMemory
+	}
+
+	limits, throttleReason := recommendLimits(opts, in, stats, recommended)
+
+	// Keep the published recommendation while the change is insignificant
+	held := false
+	stableSince := time.Now()
+	if pub := in.Published; pub != nil && !opts.Hysteresis.Changed(*pub, recommended, limits) {
+		recommended, limits = pub.Requests, pub.Limits
+		held = true
+		stableSince = pub.Since
+	}
+
+	current := in.Current
+
+	// Calculate waste percentages
+	cpuWaste := float64(0)
+	memWaste := float64(0)
+	if current.CPU > 0 {
+		cpuWaste = ((current.CPU - recommended.CPU) / current.CPU) * 100
+	}
+	if current.Memory > 0 {
+		memWaste = float64(current.Memory-recommended.Memory) / float64(current.Memory) * 100
+	}
+
+	// Clamp waste to reasonable bounds
+	if cpuWaste < -100 {
+		cpuWaste = -100
+	}
+	if memWaste < -100 {
+		memWaste = -100
+	}
+
+	// Calculate monthly savings
+	cpuSavings := float64(0)
+	memSavings := float64(0)
+	if cpuWaste > 0 {
+		cpuSavings = (current.CPU - recommended.CPU) * opts.CPUCostPerCore
+	}
+	if memWaste > 0 {
+		memSavings = float64(current.Memory-recommended.Memory) / (1024 * 1024 * 1024) * opts.MemoryCostPerGB
+	}
+	monthlySavings := cpuSavings + memSavings
+	if monthlySavings < 0 {
+		monthlySavings = 0
+	}
+
+	// Determine status
+	status := StatusOptimal
+	if cpuWaste > opts.OverProvisionedThreshold || memWaste > opts.OverProvisionedThreshold {
+		status = StatusOverProvisioned
+	} else if cpuWaste < opts.UnderProvisionedThreshold || memWaste < opts.UnderProvisionedThreshold {
+		status = StatusUnderProvisioned
+	}
+
+	if throttleReason != "" {
+		status = StatusUnderProvisioned
+	}
+
+	// OOMKills and crash loops override the percentile math
+	riskReason := assessRisk(opts, in)
+	if riskReason != "" {
+		status = StatusAtRisk
+	}
+
+	// Determine confidence based on data points
+	confidence := ConfidenceLow
+	if stats.Samples >= 100 {
+		confidence = ConfidenceHigh
+	} else if stats.Samples >= 20 {
+		confidence = ConfidenceMedium
+	}
+
+	segments := Segments(in.Usage)
+
+	return &Result{
+		Strategy:           strategy,
+		Stats:              stats,
+		Current:            current,
+		CurrentLimits:      in.CurrentLimits,
+		Recommended:        recommended,
+		RecommendedLimits:  limits,
+		CPUWastePercent:    cpuWaste,
+		MemoryWastePercent: memWaste,
+		MonthlySavings:     monthlySavings,
+		Status:             status,
+		Confidence:         confidence,
+		MemoryReason:       memReason,
+		RiskReason:         riskReason,
+		ThrottleReason:     throttleReason,
+		LimitPolicy:        opts.Limits,
+		Segments:           segments,
+		RequestChange:      latestRequestChange(segments, in.Current),
+		Held:               held,
+		StableSince:        stableSince,
+	}
+}
+
+// assessRisk returns why a container is at risk of failing, or "" if it isn't.
+func assessRisk(opts Options, in Input) string {
+	switch {
+	case in.OOMKills > 0:
+		return fmt.Sprintf("%d OOMKill(s) in the analysis window", in.OOMKills)
+	case in.CrashLooping:
+		return "container is in CrashLoopBackOff"
+	case opts.RestartThreshold > 0 && in.Restarts >= opts.RestartThreshold:
+		return fmt.Sprintf("%d restarts in the analysis window", in.Restarts)
+	}
+	return ""
+}
+
+// applyMemoryPolicy raises a strategy's memory recommendation to the peak
+// working set plus margin, and above the size of any recent OOMKill.
+func applyMemoryPolicy(strategy string, opts Options, in Input, stats Stats, memory int64) (int64, string) {
+	reason := fmt.Sprintf("%s strategy", strategy)
+
+	basis, basisName := stats.MaxMemory, "max"
+	if opts.MemoryBasis == MemoryBasisP99 {
+		basis, basisName = stats.P99Memory, "P99"
+	}
+	if floor := int64(float64(basis) * (1 + opts.MemoryMargin)); floor > memory {
+		memory = floor
+		reason = fmt.Sprintf("%s working set %dMi + %.0f%% margin", basisName, basis/(1024*1024), opts.MemoryMargin*100)
+	}
+
+	if in.OOMKills > 0 {
+		killedAt := in.OOMMemory
+		if killedAt < stats.MaxMemory {
+			killedAt = stats.MaxMemory
+		}
+		if bumped := int64(float64(killedAt) * (1 + opts.OOMBump)); bumped > memory {
+			memory = bumped
+			reason = fmt.Sprintf("bumped %.0f%% above %dMi after %d OOMKill(s)", opts.OOMBump*100, killedAt/(1024*1024), in.OOMKills)
+		}
+	}
+
+	return memory, reason
+}
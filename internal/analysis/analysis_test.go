@@ -0,0 +1,305 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const mi = 1024 * 1024
+
+var testStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// addSamples records n samples of constant usage, 5 minutes apart, starting
+// after the period's last sample.
+func addSamples(u *Usage, n int, cpu float64, memory int64) *Usage {
+	ts := testStart
+	if u.Samples > 0 {
+		ts = u.End.Add(5 * time.Minute)
+	}
+	for i := 0; i < n; i++ {
+		u.Add(Sample{Timestamp: ts.Add(time.Duration(i) * 5 * time.Minute), CPU: cpu, Memory: memory})
+	}
+	return u
+}
+
+// approx reports whether got is within 5%, a histogram bucket, of want.
+func approx(got, want float64) bool {
+	if want == 0 {
+		return got == 0
+	}
+	return math.Abs(got-want)/math.Abs(want) <= 0.05
+}
+
+func TestNewUnknownStrategy(t *testing.T) {
+	if _, err := New("median", DefaultOptions()); err == nil {
+		t.Error("got no error for an unknown strategy")
+	}
+	r, err := New("", DefaultOptions())
+	if err != nil || r.Name() != StrategyPercentile {
+		t.Errorf("default strategy: got %v, %v", r, err)
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	// 95 quiet samples and 5 spikes
+	usage := NewUsage(Resources{})
+	addSamples(usage, 95, 0.5, 100*mi)
+	peak := int64(200 * mi)
+	addSamples(usage, 5, 2.0, peak)
+
+	tests := []struct {
+		strategy     string
+		cpu          float64
+		memory       int64
+		memoryReason string
+	}{
+		// P95 + 20%, with memory raised to the peak plus margin
+		{StrategyPercentile, 0.6, int64(float64(peak) * 1.15), "max working set 200Mi + 15% margin"},
+		{StrategyMaxMemory, 0.6, int64(float64(peak) * 1.2), "max-memory strategy"},
+		{StrategyHistogram, 0.6, int64(float64(peak) * 1.15), "max working set 200Mi + 15% margin"},
+	}
+
+	for _, tt := range tests {
+		r, err := New(tt.strategy, DefaultOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.strategy, err)
+		}
+		if _, err := r.Recommend(Input{}); err != ErrNoSamples {
+			t.Errorf("%s: got %v without samples, want ErrNoSamples", tt.strategy, err)
+		}
+
+		result, err := r.Recommend(Input{Usage: []*Usage{usage}, Current: Resources{CPU: 1, Memory: 512 * mi}})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.strategy, err)
+		}
+		if result.Strategy != tt.strategy {
+			t.Errorf("%s: got strategy %s", tt.strategy, result.Strategy)
+		}
+		if !approx(result.Recommended.CPU, tt.cpu) {
+			t.Errorf("%s: got CPU %v, want ~%v", tt.strategy, result.Recommended.CPU, tt.cpu)
+		}
+		if result.Recommended.Memory != tt.memory {
+			t.Errorf("%s: got memory %d, want %d", tt.strategy, result.Recommended.Memory, tt.memory)
+		}
+		if result.MemoryReason != tt.memoryReason {
+			t.Errorf("%s: got memory reason %q, want %q", tt.strategy, result.MemoryReason, tt.memoryReason)
+		}
+		if result.Stats.Samples != 100 || result.Confidence != ConfidenceHigh {
+			t.Errorf("%s: got %d samples with %s confidence", tt.strategy, result.Stats.Samples, result.Confidence)
+		}
+	}
+}
+
+func TestHistogramStrategyDecay(t *testing.T) {
+	// Busy ten days ago, quiet since
+	old := addSamples(NewUsage(Resources{}), 100, 2.0, 64*mi)
+	recent := NewUsage(Resources{})
+	for i := 0; i < 100; i++ {
+		recent.Add(Sample{Timestamp: old.End.Add(10*24*time.Hour + time.Duration(i)*time.Minute), CPU: 0.5, Memory: 64 * mi})
+	}
+	in := Input{Usage: []*Usage{old, recent}}
+
+	histogram, _ := New(StrategyHistogram, DefaultOptions())
+	result, err := histogram.Recommend(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !approx(result.Recommended.CPU, 0.6) {
+		t.Errorf("histogram: got CPU %v, want ~0.6 from recent usage", result.Recommended.CPU)
+	}
+
+	percentile, _ := New(StrategyPercentile, DefaultOptions())
+	result, err = percentile.Recommend(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !approx(result.Recommended.CPU, 2.4) {
+		t.Errorf("percentile: got CPU %v, want ~2.4 from all usage", result.Recommended.CPU)
+	}
+}
+
+func TestFinish(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CPUCostPerCore = 30
+	opts.MemoryCostPerGB = 4
+
+	tests := []struct {
+		name        string
+		in          Input
+		samples     int
+		recommended Resources
+
+		wantRecommended Resources
+		cpuWaste        float64
+		memWaste        float64
+		savings         float64
+		status          string
+		confidence      string
+	}{
+		{
+			name:            "over-provisioned",
+			in:              Input{Current: Resources{CPU: 1, Memory: 1024 * mi}},
+			samples:         150,
+			recommended:     Resources{CPU: 0.5, Memory: 512 * mi},
+			wantRecommended: Resources{CPU: 0.5, Memory: 512 * mi},
+			cpuWaste:        50,
+			memWaste:        50,
+			savings:         0.5*30 + 0.5*4,
+			status:          StatusOverProvisioned,
+			confidence:      ConfidenceHigh,
+		},
+		{
+			name:            "optimal",
+			in:              Input{Current: Resources{CPU: 1, Memory: 1024 * mi}},
+			samples:         50,
+			recommended:     Resources{CPU: 0.9, Memory: 1024 * mi},
+			wantRecommended: Resources{CPU: 0.9, Memory: 1024 * mi},
+			cpuWaste:        10,
+			savings:         0.1 * 30,
+			status:          StatusOptimal,
+			confidence:      ConfidenceMedium,
+		},
+		{
+			name:            "under-provisioned",
+			in:              Input{Current: Resources{CPU: 1, Memory: 1024 * mi}},
+			samples:         10,
+			recommended:     Resources{CPU: 1.5, Memory: 1024 * mi},
+			wantRecommended: Resources{CPU: 1.5, Memory: 1024 * mi},
+			cpuWaste:        -50,
+			status:          StatusUnderProvisioned,
+			confidence:      ConfidenceLow,
+		},
+		{
+			name:            "waste clamped",
+			in:              Input{Current: Resources{CPU: 0.1, Memory: 64 * mi}},
+			samples:         10,
+			recommended:     Resources{CPU: 1, Memory: 64 * mi},
+			wantRecommended: Resources{CPU: 1, Memory: 64 * mi},
+			cpuWaste:        -100,
+			status:          StatusUnderProvisioned,
+			confidence:      ConfidenceLow,
+		},
+		{
+			name:            "minimums",
+			in:              Input{Current: Resources{CPU: 1, Memory: 1024 * mi}},
+			samples:         100,
+			recommended:     Resources{CPU: 0.001, Memory: mi},
+			wantRecommended: Resources{CPU: 0.01, Memory: 32 * mi},
+			cpuWaste:        99,
+			memWaste:        96.875,
+			savings:         0.99*30 + 0.96875*4,
+			status:          StatusOverProvisioned,
+			confidence:      ConfidenceHigh,
+		},
+		{
+			name:            "no requests",
+			samples:         10,
+			recommended:     Resources{CPU: 0.5, Memory: 512 * mi},
+			wantRecommended: Resources{CPU: 0.5, Memory: 512 * mi},
+			status:          StatusOptimal,
+			confidence:      ConfidenceLow,
+		},
+		{
+			name:            "crash looping",
+			in:              Input{Current: Resources{CPU: 1, Memory: 1024 * mi}, CrashLooping: true},
+			samples:         100,
+			recommended:     Resources{CPU: 0.5, Memory: 512 * mi},
+			wantRecommended: Resources{CPU: 0.5, Memory: 512 * mi},
+			cpuWaste:        50,
+			memWaste:        50,
+			savings:         0.5*30 + 0.5*4,
+			status:          StatusAtRisk,
+			confidence:      ConfidenceHigh,
+		},
+	}
+
+	for _, tt := range tests {
+		result := finish(StrategyPercentile, opts, tt.in, Stats{Samples: tt.samples}, tt.recommended)
+		if result.Recommended != tt.wantRecommended {
+			t.Errorf("%s: got recommended %+v, want %+v", tt.name, result.Recommended, tt.wantRecommended)
+		}
+		if !approx(result.CPUWastePercent, tt.cpuWaste) || !approx(result.MemoryWastePercent, tt.memWaste) {
+			t.Errorf("%s: got waste %v/%v, want %v/%v", tt.name,
+				result.CPUWastePercent, result.MemoryWastePercent, tt.cpuWaste, tt.memWaste)
+		}
+		if math.Abs(result.MonthlySavings-tt.savings) > 1e-9 {
+			t.Errorf("%s: got savings %v, want %v", tt.name, result.MonthlySavings, tt.savings)
+		}
+		if result.Status != tt.status || result.Confidence != tt.confidence {
+			t.Errorf("%s: got %s with %s confidence, want %s with %s", tt.name,
+				result.Status, result.Confidence, tt.status, tt.confidence)
+		}
+	}
+}
+
+func TestMemoryPolicy(t *testing.T) {
+	p99 := DefaultOptions()
+	p99.MemoryBasis = MemoryBasisP99
+	peak, p99Memory := int64(100*mi), int64(80*mi)
+	stats := Stats{MaxMemory: peak, P99Memory: p99Memory}
+
+	tests := []struct {
+		name   string
+		opts   Options
+		in     Input
+		memory int64
+		want   int64
+		reason string
+	}{
+		{"above the peak", DefaultOptions(), Input{}, 200 * mi, 200 * mi, "percentile strategy"},
+		{"below the peak", DefaultOptions(), Input{}, 90 * mi, int64(float64(peak) * 1.15), "max working set 100Mi + 15% margin"},
+		{"p99 basis", p99, Input{}, 50 * mi, int64(float64(p99Memory) * 1.15), "P99 working set 80Mi + 15% margin"},
+		{
+			name:   "OOMKilled at the limit",
+			opts:   DefaultOptions(),
+			in:     Input{OOMKills: 2, OOMMemory: 128 * mi},
+			memory: 90 * mi,
+			want:   160 * mi,
+			reason: "bumped 25% above 128Mi after 2 OOMKill(s)",
+		},
+		{
+			name:   "OOMKilled below the peak",
+			opts:   DefaultOptions(),
+			in:     Input{OOMKills: 1, OOMMemory: 64 * mi},
+			memory: 90 * mi,
+			want:   125 * mi,
+			reason: "bumped 25% above 100Mi after 1 OOMKill(s)",
+		},
+		{
+			name:   "OOMKilled well below the recommendation",
+			opts:   DefaultOptions(),
+			in:     Input{OOMKills: 1, OOMMemory: 64 * mi},
+			memory: 400 * mi,
+			want:   400 * mi,
+			reason: "percentile strategy",
+		},
+	}
+
+	for _, tt := range tests {
+		got, reason := applyMemoryPolicy(StrategyPercentile, tt.opts, tt.in, stats, tt.memory)
+		if got != tt.want || reason != tt.reason {
+			t.Errorf("%s: got %d (%s), want %d (%s)", tt.name, got, reason, tt.want, tt.reason)
+		}
+	}
+}
+
+func TestOOMKillsMarkAtRisk(t *testing.T) {
+	usage := addSamples(NewUsage(Resources{}), 100, 0.5, 100*mi)
+	r, _ := New(StrategyPercentile, DefaultOptions())
+	result, err := r.Recommend(Input{
+		Usage:     []*Usage{usage},
+		Current:   Resources{CPU: 1, Memory: 128 * mi},
+		OOMKills:  1,
+		OOMMemory: 128 * mi,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != StatusAtRisk || result.RiskReason != "1 OOMKill(s) in the analysis window" {
+		t.Errorf("got %s (%s), want at-risk after an OOMKill", result.Status, result.RiskReason)
+	}
+	if result.Recommended.Memory != 160*mi {
+		t.Errorf("got memory %d, want %d", result.Recommended.Memory, 160*mi)
+	}
+}
@@ -0,0 +1,175 @@
+package analysis
+
+import (
+	"math"
+	"time"
+)
+
+// Histogram is an exponentially bucketed, weighted histogram in the style of
+// the Kubernetes Vertical Pod Autoscaler. Bucket i covers
+// [first*(ratio^i-1)/(ratio-1), first*(ratio^(i+1)-1)/(ratio-1)).
+type Histogram struct {
+	first   float64
+	ratio   float64
+	weights []float64
+	total   float64
+}
+
+// NewHistogram creates a histogram whose first bucket is first wide, each next
+// bucket ratio times wider than the previous, covering values up to max.
+func NewHistogram(first, max, ratio float64) *Histogram {
+	n := int(math.Ceil(math.Log(max*(ratio-1)/first+1)/math.Log(ratio))) + 1
+	return &Histogram{
+		first:   first,
+		ratio:   ratio,
+		weights: make([]float64, n),
+	}
+}
+
+// NewCPUHistogram covers 0-1000 cores with 10m resolution at the low end.
+func NewCPUHistogram() *Histogram {
+	return NewHistogram(0.01, 1000, 1.05)
+}
+
+// NewMemoryHistogram covers 0-1TiB with 10MiB resolution at the low end.
+func NewMemoryHistogram() *Histogram {
+	return NewHistogram(10*1024*1024, 1<<40, 1.05)
+}
+
+// NewThrottlingHistogram covers throttled-period ratios from 0 to 1.
+func NewThrottlingHistogram() *Histogram {
+	return NewHistogram(0.01, 1, 1.05)
+}
+
+// Layout returns the first bucket width, the growth ratio and the number of
+// buckets, so bucket indexes can be computed outside Go (e.g. in SQL).
+func (h *Histogram) Layout() (first, ratio float64, buckets int) {
+	return h.first, h.ratio, len(h.weights)
+}
+
+// Add records value with the given weight.
+func (h *Histogram) Add(value, weight float64) {
+	if weight <= 0 {
+		return
+	}
+	h.weights[h.bucket(value)] += weight
+	h.total += weight
+}
+
+// AddBucket adds weight to bucket i directly. Indexes out of range are
+// clamped to the first or last bucket.
+func (h *Histogram) AddBucket(i int, weight float64) {
+	if weight <= 0 {
+		return
+	}
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(h.weights) {
+		i = len(h.weights) - 1
+	}
+	h.weights[i] += weight
+	h.total += weight
+}
+
+// Merge adds the weights of other, a histogram with the same layout, scaled
+// by weight.
+func (h *Histogram) Merge(other *Histogram, weight float64) {
+	if other == nil || weight <= 0 {
+		return
+	}
+	for i, w := range other.weights {
+		h.weights[i] += w * weight
+	}
+	h.total += other.total * weight
+}
+
+// Total returns the sum of the weights.
+func (h *Histogram) Total() float64 {
+	return h.total
+}
+
+// Empty reports whether the histogram holds no weight.
+func (h *Histogram) Empty() bool {
+	return h.total == 0
+}
+
+// Percentile returns the upper bound of the bucket holding the p-th (0-1)
+// weighted percentile.
+func (h *Histogram) Percentile(p float64) float64 {
+	if h.total == 0 {
+		return 0
+	}
+
+	threshold := p * h.total
+	var sum float64
+	for i, w := range h.weights {
+		sum += w
+		if sum >= threshold {
+			return h.bucketStart(i + 1)
+		}
+	}
+	return h.bucketStart(len(h.weights))
+}
+
+func (h *Histogram) bucket(value float64) int {
+	if value <= 0 {
+		return 0
+	}
+	i := int(math.Floor(math.Log(value*(h.ratio-1)/h.first+1) / math.Log(h.ratio)))
+	if i >= len(h.weights) {
+		i = len(h.weights) - 1
+	}
+	return i
+}
+
+func (h *Histogram) bucketStart(i int) float64 {
+	return h.first * (math.Pow(h.ratio, float64(i)) - 1) / (h.ratio - 1)
+}
+
+// histogramRecommender sizes at a percentile of decaying-weight histograms,
+// so recent usage counts more than usage from days ago, as VPA does.
+type histogramRecommender struct {
+	opts Options
+}
+
+func (r *histogramRecommender) Name() string {
+	return StrategyHistogram
+}
+
+func (r *histogramRecommender) Recommend(in Input) (*Result, error) {
+	if totalSamples(in.Usage) == 0 {
+		return nil, ErrNoSamples
+	}
+
+	// Weight each period relative to the newest one: usage one half-life
+	// older counts half as much. Periods are days, so decay is per day.
+	newest := in.Usage[0].End
+	for _, u := range in.Usage {
+		if u.End.After(newest) {
+			newest = u.End
+		}
+	}
+
+	halfLife := r.opts.HalfLife
+	if halfLife <= 0 {
+		halfLife = 24 * time.Hour
+	}
+
+	cpu := NewCPUHistogram()
+	mem := NewMemoryHistogram()
+	for _, u := range in.Usage {
+		age := newest.Sub(u.End)
+		weight := math.Exp2(-float64(age) / float64(halfLife))
+		cpu.Merge(u.CPU, weight)
+		mem.Merge(u.Memory, weight)
+	}
+
+	stats := CalculateStats(in.Usage)
+	recommended := Resources{
+		CPU:    math.Min(cpu.Percentile(r.opts.Percentile), stats.MaxCPU) * (1 + r.opts.Buffer),
+		Memory: int64(math.Min(mem.Percentile(r.opts.Percentile), float64(stats.MaxMemory)) * (1 + r.opts.Buffer)),
+	}
+
+	return finish(r.Name(), r.opts, in, stats, recommended), nil
+}
@@ -0,0 +1,101 @@
+package analysis
+
+import (
+	"testing"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	// Buckets [0,1) [1,3) [3,7) [7,15) ... up to 100
+	h := NewHistogram(1, 100, 2)
+	if first, ratio, buckets := h.Layout(); first != 1 || ratio != 2 || buckets != 8 {
+		t.Fatalf("got layout %v %v %d, want 1 2 8", first, ratio, buckets)
+	}
+
+	tests := []struct {
+		value  float64
+		bucket int
+	}{
+		{-1, 0},
+		{0, 0},
+		{0.5, 0},
+		{1.5, 1},
+		{2.9, 1},
+		{3.5, 2},
+		{10, 3},
+		{1000, 7},
+	}
+	for _, tt := range tests {
+		if got := h.bucket(tt.value); got != tt.bucket {
+			t.Errorf("bucket(%v) = %d, want %d", tt.value, got, tt.bucket)
+		}
+	}
+	for i, want := range []float64{0, 1, 3, 7, 15} {
+		if got := h.bucketStart(i); got != want {
+			t.Errorf("bucketStart(%d) = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	h := NewHistogram(1, 100, 2)
+	if !h.Empty() || h.Percentile(0.95) != 0 {
+		t.Fatalf("empty histogram: got percentile %v", h.Percentile(0.95))
+	}
+
+	h.Add(0.5, 1)
+	h.Add(2, 1)
+	h.Add(5, 1)
+	h.Add(10, 1)
+	h.Add(50, 0) // ignored
+
+	// Percentiles are the upper bound of the bucket that reaches them
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0.25, 1},
+		{0.5, 3},
+		{0.75, 7},
+		{0.95, 15},
+		{1, 15},
+	}
+	for _, tt := range tests {
+		if got := h.Percentile(tt.p); got != tt.want {
+			t.Errorf("Percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if h.Total() != 4 {
+		t.Errorf("got total %v, want 4", h.Total())
+	}
+}
+
+func TestHistogramWeights(t *testing.T) {
+	h := NewHistogram(1, 100, 2)
+	h.Add(0.5, 3)
+	h.Add(10, 1)
+	if got := h.Percentile(0.75); got != 1 {
+		t.Errorf("weighted P75 = %v, want 1", got)
+	}
+
+	// Merging at half weight keeps the low bucket at 3 of 5
+	other := NewHistogram(1, 100, 2)
+	other.Add(10, 2)
+	h.Merge(other, 0.5)
+	h.Merge(nil, 1)
+	if h.Total() != 5 {
+		t.Errorf("got total %v after merge, want 5", h.Total())
+	}
+	if got := h.Percentile(0.6); got != 1 {
+		t.Errorf("P60 after merge = %v, want 1", got)
+	}
+	if got := h.Percentile(0.7); got != 15 {
+		t.Errorf("P70 after merge = %v, want 15", got)
+	}
+
+	// Bucket indexes out of range are clamped
+	h.AddBucket(-3, 1)
+	h.AddBucket(99, 1)
+	if h.weights[0] != 4 || h.weights[7] != 1 {
+		t.Errorf("got weights %v after AddBucket", h.weights)
+	}
+}
@@ -0,0 +1,100 @@
+package analysis
+
+import (
+	"fmt"
+)
+
+// Limit policies. Not every policy applies to both resources: LimitNone is
+// CPU only, LimitEqualRequest is memory only.
+const (
+	LimitKeepRatio    = "keep-ratio"    // keep the current limit/request ratio
+	LimitHeadroom     = "headroom"      // request plus a fixed headroom
+	LimitNone         = "none"          // no CPU limit
+	LimitEqualRequest = "equal-request" // memory limit equal to the request
+)
+
+// LimitPolicy decides how limits are derived from recommended requests.
+type LimitPolicy struct {
+	CPU      string
+	Memory   string
+	Headroom float64 // used by LimitHeadroom, e.g. 0.2 for 20%
+}
+
+// DefaultLimitPolicy sets both limits 20% above the requests.
+func DefaultLimitPolicy() LimitPolicy {
+	return LimitPolicy{CPU: LimitHeadroom, Memory: LimitHeadroom, Headroom: 0.2}
+}
+
+// String describes the policy for analysis records, e.g. "cpu=none,memory=equal-request".
+func (p LimitPolicy) String() string {
+	return fmt.Sprintf("cpu=%s,memory=%s", p.CPU, p.Memory)
+}
+
+// Validate checks that the policy names are known for their resource.
+func (p LimitPolicy) Validate() error {
+	switch p.CPU {
+	case LimitKeepRatio, LimitHeadroom, LimitNone:
+	default:
+		return fmt.Errorf("unknown CPU limit policy %q", p.CPU)
+	}
+	switch p.Memory {
+	case LimitKeepRatio, LimitHeadroom, LimitEqualRequest:
+	default:
+		return fmt.Errorf("unknown memory limit policy %q", p.Memory)
+	}
+	return nil
+}
+
+// recommendLimits derives limits for the recommended requests. A CPU limit of
+// 0 means the container should run without one. A container whose CPU limit
+// throttles it above the threshold gets a limit raised by the throttled ratio.
+func recommendLimits(opts Options, in Input, stats Stats, recommended Resources) (Resources, string) {
+	policy := opts.Limits
+	var limits Resources
+
+	switch policy.CPU {
+	case LimitNone:
+		limits.CPU = 0
+	case LimitKeepRatio:
+		if in.CurrentLimits.CPU > 0 && in.Current.CPU > 0 {
+			limits.CPU = recommended.CPU * in.CurrentLimits.CPU / in.Current.CPU
+		}
+	default:
+		limits.CPU = recommended.CPU * (1 + policy.Headroom)
+	}
+
+	switch policy.Memory {
+	case LimitEqualRequest:
+		limits.Memory = recommended.Memory
+	case LimitKeepRatio:
+		if in.CurrentLimits.Memory > 0 && in.Current.Memory > 0 {
+			limits.Memory = int64(float64(recommended.Memory) * float64(in.CurrentLimits.Memory) / float64(in.Current.Memory))
+		}
+	default:
+		limits.Memory = int64(float64(recommended.Memory) * (1 + policy.Headroom))
+	}
+	if limits.Memory > 0 && limits.Memory < recommended.Memory {
+		limits.Memory = recommended.Memory
+	}
+
+	// A request can look optimal while the limit throttles the container
+	if stats.ThrottledSamples == 0 || in.CurrentLimits.CPU <= 0 || stats.P95Throttled <= opts.ThrottlingThreshold {
+		return limits, ""
+	}
+
+	reason := fmt.Sprintf("CPU limit throttled in %.0f%% of periods (P95), above the %.0f%% threshold",
+		stats.P95Throttled*100, opts.ThrottlingThreshold*100)
+	if policy.CPU == LimitNone {
+		return limits, reason + "; removing the CPU limit"
+	}
+
+	throttleLimit := in.CurrentLimits.CPU * (1 + stats.P95Throttled)
+	if floor := recommended.CPU * (1 + opts.Buffer); throttleLimit < floor {
+		throttleLimit = floor
+	}
+	if throttleLimit > limits.CPU {
+		limits.CPU = throttleLimit
+	}
+
+	return limits, reason
+}
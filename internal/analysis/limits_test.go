@@ -0,0 +1,156 @@
+package analysis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestThrottlingStats(t *testing.T) {
+	usage := NewUsage(Resources{})
+	for i := 0; i < 20; i++ {
+		s := Sample{Timestamp: testStart, CPU: 0.5, Memory: 64 * mi}
+		if i%2 == 0 {
+			s.ThrottledRatio, s.HasThrottling = 0.5, true
+		}
+		usage.Add(s)
+	}
+
+	stats := CalculateStats([]*Usage{usage})
+	if stats.ThrottledSamples != 10 {
+		t.Errorf("got %d throttled samples, want the 10 that report throttling", stats.ThrottledSamples)
+	}
+	if !approx(stats.P95Throttled, 0.5) {
+		t.Errorf("got P95 throttled %v, want ~0.5", stats.P95Throttled)
+	}
+}
+
+func TestThrottledCPULimit(t *testing.T) {
+	none := DefaultOptions()
+	none.Limits.CPU = LimitNone
+
+	throttled := Stats{ThrottledSamples: 10, P95Throttled: 0.5}
+	limited := Input{Current: Resources{CPU: 0.2}, CurrentLimits: Resources{CPU: 0.5}}
+	recommended := Resources{CPU: 0.2, Memory: 64 * mi}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		in       Input
+		stats    Stats
+		cpuLimit float64
+		reason   string
+	}{
+		{
+			name:     "raised by the throttled ratio",
+			opts:     DefaultOptions(),
+			in:       limited,
+			stats:    throttled,
+			cpuLimit: 0.75,
+			reason:   "CPU limit throttled in 50% of periods (P95), above the 25% threshold",
+		},
+		{
+			name:     "below the threshold",
+			opts:     DefaultOptions(),
+			in:       limited,
+			stats:    Stats{ThrottledSamples: 10, P95Throttled: 0.2},
+			cpuLimit: 0.24,
+		},
+		{
+			name:     "no throttling data",
+			opts:     DefaultOptions(),
+			in:       limited,
+			cpuLimit: 0.24,
+		},
+		{
+			name:     "no current limit",
+			opts:     DefaultOptions(),
+			in:       Input{Current: Resources{CPU: 0.2}},
+			stats:    throttled,
+			cpuLimit: 0.24,
+		},
+		{
+			name:     "limit removed by policy",
+			opts:     none,
+			in:       limited,
+			stats:    throttled,
+			cpuLimit: 0,
+			reason:   "CPU limit throttled in 50% of periods (P95), above the 25% threshold; removing the CPU limit",
+		},
+	}
+
+	for _, tt := range tests {
+		limits, reason := recommendLimits(tt.opts, tt.in, tt.stats, recommended)
+		if !approx(limits.CPU, tt.cpuLimit) || reason != tt.reason {
+			t.Errorf("%s: got CPU limit %v (%q), want %v (%q)", tt.name, limits.CPU, reason, tt.cpuLimit, tt.reason)
+		}
+	}
+}
+
+func TestThrottlingMarksUnderProvisioned(t *testing.T) {
+	opts := DefaultOptions()
+	in := Input{Current: Resources{CPU: 1, Memory: 128 * mi}, CurrentLimits: Resources{CPU: 1}}
+	result := finish(StrategyPercentile, opts, in, Stats{Samples: 100, ThrottledSamples: 100, P95Throttled: 0.6}, Resources{CPU: 0.5, Memory: 128 * mi})
+	if result.Status != StatusUnderProvisioned || !strings.HasPrefix(result.ThrottleReason, "CPU limit throttled") {
+		t.Errorf("got %s (%q), want under-provisioned by throttling", result.Status, result.ThrottleReason)
+	}
+	if !approx(result.RecommendedLimits.CPU, 1.6) {
+		t.Errorf("got CPU limit %v, want ~1.6", result.RecommendedLimits.CPU)
+	}
+}
+
+func TestLimitPolicies(t *testing.T) {
+	recommended := Resources{CPU: 0.5, Memory: 200 * mi}
+	current := Input{Current: Resources{CPU: 1, Memory: 400 * mi}, CurrentLimits: Resources{CPU: 2, Memory: 600 * mi}}
+
+	tests := []struct {
+		policy LimitPolicy
+		in     Input
+		want   Resources
+	}{
+		{DefaultLimitPolicy(), current, Resources{CPU: 0.6, Memory: 240 * mi}},
+		{LimitPolicy{CPU: LimitHeadroom, Memory: LimitHeadroom, Headroom: 0.5}, current, Resources{CPU: 0.75, Memory: 300 * mi}},
+		{LimitPolicy{CPU: LimitKeepRatio, Memory: LimitKeepRatio}, current, Resources{CPU: 1, Memory: 300 * mi}},
+		// Without current limits there is no ratio to keep
+		{LimitPolicy{CPU: LimitKeepRatio, Memory: LimitKeepRatio}, Input{Current: current.Current}, Resources{}},
+		{LimitPolicy{CPU: LimitNone, Memory: LimitEqualRequest}, current, Resources{CPU: 0, Memory: 200 * mi}},
+		// A memory limit is never below the request
+		{LimitPolicy{CPU: LimitNone, Memory: LimitKeepRatio}, Input{Current: current.Current, CurrentLimits: Resources{Memory: 200 * mi}}, Resources{Memory: 200 * mi}},
+	}
+
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Limits = tt.policy
+		limits, _ := recommendLimits(opts, tt.in, Stats{}, recommended)
+		if !approx(limits.CPU, tt.want.CPU) || limits.Memory != tt.want.Memory {
+			t.Errorf("%s with limits %+v: got %+v, want %+v", tt.policy, tt.in.CurrentLimits, limits, tt.want)
+		}
+	}
+}
+
+func TestLimitPolicyValidate(t *testing.T) {
+	valid := []LimitPolicy{
+		DefaultLimitPolicy(),
+		{CPU: LimitNone, Memory: LimitEqualRequest},
+		{CPU: LimitKeepRatio, Memory: LimitKeepRatio},
+	}
+	for _, p := range valid {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%s: %v", p, err)
+		}
+	}
+
+	// none is CPU only and equal-request memory only
+	invalid := []LimitPolicy{
+		{CPU: LimitEqualRequest, Memory: LimitHeadroom},
+		{CPU: LimitHeadroom, Memory: LimitNone},
+		{CPU: "", Memory: LimitHeadroom},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%s: got no error", p)
+		}
+	}
+	if _, err := New(StrategyPercentile, Options{Limits: invalid[0]}); err == nil {
+		t.Error("New accepted an invalid limit policy")
+	}
+}
@@ -0,0 +1,93 @@
+package analysis
+
+import (
+	"sort"
+	"time"
+)
+
+// Segment summarizes usage while one set of requests was in force.
+type Segment struct {
+	Requests  Resources
+	Start     time.Time
+	End       time.Time
+	Samples   int
+	P95CPU    float64
+	P95Memory int64
+}
+
+// RequestChange is the most recent change of requests within the window.
+// The percentages are relative to the previous requests, and 0 when those
+// were unset.
+type RequestChange struct {
+	At            time.Time
+	From          Resources
+	To            Resources
+	CPUPercent    float64
+	MemoryPercent float64
+}
+
+// Segments groups usage periods by the requests in force during them,
+// ordered by when each set of requests was first seen. Periods without known
+// requests are skipped.
+func Segments(usage []*Usage) []Segment {
+	grouped := make(map[Resources][]*Usage)
+	var order []Resources
+	for _, u := range usage {
+		if u.Requests == (Resources{}) || u.Samples == 0 {
+			continue
+		}
+		if _, ok := grouped[u.Requests]; !ok {
+			order = append(order, u.Requests)
+		}
+		grouped[u.Requests] = append(grouped[u.Requests], u)
+	}
+
+	segments := make([]Segment, 0, len(order))
+	for _, requests := range order {
+		total := merge(grouped[requests])
+		seg := Segment{Requests: requests, Start: total.Start, End: total.End, Samples: total.Samples}
+		seg.P95CPU, seg.P95Memory = total.percentile(0.95)
+		segments = append(segments, seg)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Start.Before(segments[j].Start) })
+	return segments
+}
+
+// latestRequestChange finds when the current requests replaced the ones in
+// force before them, or nil when they did not change within the window.
+func latestRequestChange(segments []Segment, current Resources) *RequestChange {
+	var to *Segment
+	for i := range segments {
+		if segments[i].Requests == current {
+			to = &segments[i]
+		}
+	}
+	if to == nil {
+		return nil
+	}
+
+	// The previous requests are the ones last seen before the change
+	var from *Segment
+	for i := range segments {
+		seg := &segments[i]
+		if seg == to || seg.Start.After(to.Start) {
+			continue
+		}
+		if from == nil || seg.End.After(from.End) {
+			from = seg
+		}
+	}
+	if from == nil {
+		return nil
+	}
+
+	change := &RequestChange{At: to.Start, From: from.Requests, To: to.Requests}
+	if from.Requests.CPU > 0 {
+		change.CPUPercent = (to.Requests.CPU - from.Requests.CPU) / from.Requests.CPU * 100
+	}
+	if from.Requests.Memory > 0 {
+		change.MemoryPercent = float64(to.Requests.Memory-from.Requests.Memory) / float64(from.Requests.Memory) * 100
+	}
+	return change
+}
@@ -0,0 +1,53 @@
+package analysis
+
+import (
+	"math"
+	"time"
+)
+
+// Published is the recommendation currently published for a container.
+type Published struct {
+	Requests Resources
+	Limits   Resources // a CPU limit of 0 means no limit
+	Since    time.Time // when these values were first published
+}
+
+// Hysteresis decides when a new recommendation differs enough from the
+// published one to replace it. A value changes significantly when it moves
+// by more than both the relative threshold and the absolute minimum, so small
+// containers don't flap on tiny absolute changes and large ones on tiny
+// relative ones.
+type Hysteresis struct {
+	Percent float64 // relative change, e.g. 0.1 for 10%
+	CPU     float64 // cores
+	Memory  int64   // bytes
+}
+
+// Changed reports whether the recommended requests or limits differ
+// significantly from the published ones.
+func (h Hysteresis) Changed(published Published, requests, limits Resources) bool {
+	return h.cpuChanged(published.Requests.CPU, requests.CPU) ||
+		h.memoryChanged(published.Requests.Memory, requests.Memory) ||
+		h.cpuChanged(published.Limits.CPU, limits.CPU) ||
+		h.memoryChanged(published.Limits.Memory, limits.Memory)
+}
+
+func (h Hysteresis) cpuChanged(old, new float64) bool {
+	// Adding or removing a limit is always a change
+	if (old == 0) != (new == 0) {
+		return true
+	}
+	delta := math.Abs(new - old)
+	return delta > h.CPU && delta > old*h.Percent
+}
+
+func (h Hysteresis) memoryChanged(old, new int64) bool {
+	if (old == 0) != (new == 0) {
+		return true
+	}
+	delta := new - old
+	if delta < 0 {
+		delta = -delta
+	}
+	return delta > h.Memory && float64(delta) > float64(old)*h.Percent
+}
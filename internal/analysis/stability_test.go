@@ -0,0 +1,72 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHysteresisChanged(t *testing.T) {
+	h := DefaultOptions().Hysteresis // 10%, 20m, 32Mi
+	published := Published{
+		Requests: Resources{CPU: 1, Memory: 1024 * mi},
+		Limits:   Resources{CPU: 2, Memory: 2048 * mi},
+	}
+
+	tests := []struct {
+		name     string
+		requests Resources
+		limits   Resources
+		changed  bool
+	}{
+		{"unchanged", published.Requests, published.Limits, false},
+		{"jitter", Resources{CPU: 1.05, Memory: 1000 * mi}, published.Limits, false},
+		{"CPU beyond both thresholds", Resources{CPU: 1.2, Memory: 1024 * mi}, published.Limits, true},
+		{"memory beyond both thresholds", Resources{CPU: 1, Memory: 800 * mi}, published.Limits, true},
+		{"limit beyond both thresholds", published.Requests, Resources{CPU: 2.5, Memory: 2048 * mi}, true},
+		{"CPU limit removed", published.Requests, Resources{Memory: 2048 * mi}, true},
+	}
+
+	for _, tt := range tests {
+		if got := h.Changed(published, tt.requests, tt.limits); got != tt.changed {
+			t.Errorf("%s: Changed = %v, want %v", tt.name, got, tt.changed)
+		}
+	}
+
+	// Small containers need the absolute change too
+	small := Published{Requests: Resources{CPU: 0.05, Memory: 64 * mi}}
+	if h.Changed(small, Resources{CPU: 0.065, Memory: 80 * mi}, Resources{}) {
+		t.Error("small container: 30% changes below the absolute minimums count as changed")
+	}
+	if !h.Changed(small, Resources{CPU: 0.08, Memory: 64 * mi}, Resources{}) {
+		t.Error("small container: a 30m change beyond both thresholds is not counted")
+	}
+}
+
+func TestFinishHoldsPublished(t *testing.T) {
+	since := testStart.Add(-72 * time.Hour)
+	memory := int64(256 * mi)
+	published := &Published{
+		Requests: Resources{CPU: 0.5, Memory: memory},
+		Limits:   Resources{CPU: 0.6, Memory: int64(float64(memory) * 1.2)},
+		Since:    since,
+	}
+	in := Input{Current: Resources{CPU: 1, Memory: 512 * mi}, Published: published}
+
+	// Within the hysteresis the published values and their age are kept
+	result := finish(StrategyPercentile, DefaultOptions(), in, Stats{Samples: 100}, Resources{CPU: 0.51, Memory: 260 * mi})
+	if !result.Held || result.Recommended != published.Requests || result.RecommendedLimits != published.Limits {
+		t.Errorf("got held=%v %+v/%+v, want the published values", result.Held, result.Recommended, result.RecommendedLimits)
+	}
+	if !result.StableSince.Equal(since) {
+		t.Errorf("got stable since %v, want %v", result.StableSince, since)
+	}
+	if !approx(result.CPUWastePercent, 50) {
+		t.Errorf("got CPU waste %v, want it from the held recommendation", result.CPUWastePercent)
+	}
+
+	// A significant change replaces them
+	result = finish(StrategyPercentile, DefaultOptions(), in, Stats{Samples: 100}, Resources{CPU: 0.8, Memory: 256 * mi})
+	if result.Held || !approx(result.Recommended.CPU, 0.8) || !result.StableSince.After(since) {
+		t.Errorf("got held=%v CPU %v since %v, want the new recommendation", result.Held, result.Recommended.CPU, result.StableSince)
+	}
+}
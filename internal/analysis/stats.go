@@ -0,0 +1,58 @@
+package analysis
+
+import (
+	"math"
+)
+
+// Stats summarizes a usage series. Percentiles are read from histograms, so
+// they are accurate to the bucket width (5%).
+type Stats struct {
+	Samples int
+
+	AvgCPU float64
+	MaxCPU float64
+	P95CPU float64
+	P99CPU float64
+
+	AvgMemory int64
+	MaxMemory int64
+	P95Memory int64
+	P99Memory int64
+
+	// Throttling statistics over the samples that report it
+	ThrottledSamples int
+	P95Throttled     float64
+}
+
+// CalculateStats computes average, max, P95 and P99 of CPU and memory usage.
+func CalculateStats(usage []*Usage) Stats {
+	total := merge(usage)
+	stats := Stats{Samples: total.Samples}
+	if total.Samples == 0 {
+		return stats
+	}
+
+	stats.AvgCPU = total.CPUSum / float64(total.Samples)
+	stats.MaxCPU = total.MaxCPU
+	stats.P95CPU, stats.P95Memory = total.percentile(0.95)
+	stats.P99CPU, stats.P99Memory = total.percentile(0.99)
+
+	stats.AvgMemory = int64(total.MemorySum / float64(total.Samples))
+	stats.MaxMemory = total.MaxMemory
+
+	if !total.Throttled.Empty() {
+		stats.ThrottledSamples = int(math.Round(total.Throttled.Total()))
+		stats.P95Throttled = math.Min(total.Throttled.Percentile(0.95), 1)
+	}
+
+	return stats
+}
+
+// Percentile returns the p-th percentile (0-1) of the CPU and memory usage.
+func Percentile(usage []*Usage, p float64) (float64, int64) {
+	total := merge(usage)
+	if total.Samples == 0 {
+		return 0, 0
+	}
+	return total.percentile(p)
+}
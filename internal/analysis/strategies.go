@@ -0,0 +1,60 @@
+package analysis
+
+// Strategy names selectable through configuration.
+const (
+	StrategyPercentile = "percentile"
+	StrategyMaxMemory  = "max-memory"
+	StrategyHistogram  = "histogram"
+)
+
+// percentileRecommender sizes both resources at a usage percentile plus a
+// buffer (P95 + 20% by default). This is the optimizer's original behaviour.
+type percentileRecommender struct {
+	opts Options
+}
+
+func (r *percentileRecommender) Name() string {
+	return StrategyPercentile
+}
+
+func (r *percentileRecommender) Recommend(in Input) (*Result, error) {
+	if totalSamples(in.Usage) == 0 {
+		return nil, ErrNoSamples
+	}
+
+	stats := CalculateStats(in.Usage)
+	cpu, mem := Percentile(in.Usage, r.opts.Percentile)
+
+	recommended := Resources{
+		CPU:    cpu * (1 + r.opts.Buffer),
+		Memory: int64(float64(mem) * (1 + r.opts.Buffer)),
+	}
+
+	return finish(r.Name(), r.opts, in, stats, recommended), nil
+}
+
+// maxMemoryRecommender sizes CPU at a percentile but memory at the observed
+// maximum, since memory is incompressible and exceeding it means an OOMKill.
+type maxMemoryRecommender struct {
+	opts Options
+}
+
+func (r *maxMemoryRecommender) Name() string {
+	return StrategyMaxMemory
+}
+
+func (r *maxMemoryRecommender) Recommend(in Input) (*Result, error) {
+	if totalSamples(in.Usage) == 0 {
+		return nil, ErrNoSamples
+	}
+
+	stats := CalculateStats(in.Usage)
+	cpu, _ := Percentile(in.Usage, r.opts.Percentile)
+
+	recommended := Resources{
+		CPU:    cpu * (1 + r.opts.Buffer),
+		Memory: int64(float64(stats.MaxMemory) * (1 + r.opts.Buffer)),
+	}
+
+	return finish(r.Name(), r.opts, in, stats, recommended), nil
+}
@@ -0,0 +1,100 @@
+package analysis
+
+import (
+	"math"
+	"time"
+)
+
+// Usage summarizes a container's samples over a period, typically a day, as
+// sums, maxima and histograms. Analyses merge usage periods rather than
+// sorting samples, so their cost does not grow with the sampling rate.
+type Usage struct {
+	Start    time.Time // first sample
+	End      time.Time // last sample
+	Requests Resources // requests in force, zero when unknown
+
+	Samples   int
+	CPUSum    float64
+	MaxCPU    float64
+	MemorySum float64
+	MaxMemory int64
+
+	CPU       *Histogram
+	Memory    *Histogram
+	Throttled *Histogram // samples that report throttling
+}
+
+// NewUsage returns an empty usage period with the standard histograms.
+func NewUsage(requests Resources) *Usage {
+	return &Usage{
+		Requests:  requests,
+		CPU:       NewCPUHistogram(),
+		Memory:    NewMemoryHistogram(),
+		Throttled: NewThrottlingHistogram(),
+	}
+}
+
+// Add records a sample in the period.
+func (u *Usage) Add(s Sample) {
+	if u.Samples == 0 || s.Timestamp.Before(u.Start) {
+		u.Start = s.Timestamp
+	}
+	if u.Samples == 0 || s.Timestamp.After(u.End) {
+		u.End = s.Timestamp
+	}
+	u.Samples++
+	u.CPUSum += s.CPU
+	u.MaxCPU = math.Max(u.MaxCPU, s.CPU)
+	u.MemorySum += float64(s.Memory)
+	if s.Memory > u.MaxMemory {
+		u.MaxMemory = s.Memory
+	}
+	u.CPU.Add(s.CPU, 1)
+	u.Memory.Add(float64(s.Memory), 1)
+	if s.HasThrottling {
+		u.Throttled.Add(s.ThrottledRatio, 1)
+	}
+}
+
+// merge combines usage periods into one with unweighted histograms.
+func merge(usage []*Usage) *Usage {
+	total := NewUsage(Resources{})
+	for _, u := range usage {
+		if u.Samples == 0 {
+			continue
+		}
+		if total.Samples == 0 || u.Start.Before(total.Start) {
+			total.Start = u.Start
+		}
+		if total.Samples == 0 || u.End.After(total.End) {
+			total.End = u.End
+		}
+		total.Samples += u.Samples
+		total.CPUSum += u.CPUSum
+		total.MaxCPU = math.Max(total.MaxCPU, u.MaxCPU)
+		total.MemorySum += u.MemorySum
+		if u.MaxMemory > total.MaxMemory {
+			total.MaxMemory = u.MaxMemory
+		}
+		total.CPU.Merge(u.CPU, 1)
+		total.Memory.Merge(u.Memory, 1)
+		total.Throttled.Merge(u.Throttled, 1)
+	}
+	return total
+}
+
+// percentile returns the p-th percentile of the merged usage, capped at the
+// observed maxima since histogram buckets round up.
+func (u *Usage) percentile(p float64) (float64, int64) {
+	cpu := math.Min(u.CPU.Percentile(p), u.MaxCPU)
+	mem := math.Min(u.Memory.Percentile(p), float64(u.MaxMemory))
+	return cpu, int64(mem)
+}
+
+func totalSamples(usage []*Usage) int {
+	var n int
+	for _, u := range usage {
+		n += u.Samples
+	}
+	return n
+}
@@ -0,0 +1,81 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageAdd(t *testing.T) {
+	u := NewUsage(Resources{CPU: 1, Memory: 256 * mi})
+	// Samples may arrive out of order
+	for _, s := range []Sample{
+		{Timestamp: testStart.Add(time.Hour), CPU: 0.2, Memory: 100 * mi},
+		{Timestamp: testStart, CPU: 0.6, Memory: 50 * mi},
+		{Timestamp: testStart.Add(2 * time.Hour), CPU: 0.4, Memory: 150 * mi, ThrottledRatio: 0.1, HasThrottling: true},
+	} {
+		u.Add(s)
+	}
+
+	if !u.Start.Equal(testStart) || !u.End.Equal(testStart.Add(2*time.Hour)) {
+		t.Errorf("got period %v - %v", u.Start, u.End)
+	}
+	if u.Samples != 3 || !approx(u.CPUSum, 1.2) || u.MaxCPU != 0.6 || u.MemorySum != 300*mi || u.MaxMemory != 150*mi {
+		t.Errorf("got %d samples, CPU sum %v max %v, memory sum %v max %d",
+			u.Samples, u.CPUSum, u.MaxCPU, u.MemorySum, u.MaxMemory)
+	}
+	if u.CPU.Total() != 3 || u.Memory.Total() != 3 || u.Throttled.Total() != 1 {
+		t.Errorf("got histogram totals %v %v %v", u.CPU.Total(), u.Memory.Total(), u.Throttled.Total())
+	}
+}
+
+func TestCalculateStats(t *testing.T) {
+	// Two days of one replica and a day of another
+	day1 := addSamples(NewUsage(Resources{}), 50, 1.0, 400*mi)
+	day2 := addSamples(NewUsage(Resources{}), 45, 1.0, 400*mi)
+	other := addSamples(NewUsage(Resources{}), 5, 4.0, 1600*mi)
+	empty := NewUsage(Resources{})
+
+	stats := CalculateStats([]*Usage{day1, empty, day2, other})
+	if stats.Samples != 100 {
+		t.Fatalf("got %d samples, want 100", stats.Samples)
+	}
+	if !approx(stats.AvgCPU, 1.15) || stats.MaxCPU != 4 {
+		t.Errorf("got CPU avg %v max %v, want 1.15 and 4", stats.AvgCPU, stats.MaxCPU)
+	}
+	if stats.AvgMemory != 460*mi || stats.MaxMemory != 1600*mi {
+		t.Errorf("got memory avg %d max %d", stats.AvgMemory, stats.MaxMemory)
+	}
+
+	// Percentiles are bucket upper bounds, capped at the maxima
+	if !approx(stats.P95CPU, 1) || !approx(float64(stats.P95Memory), 400*mi) {
+		t.Errorf("got P95 %v/%d, want ~1 core and ~400Mi", stats.P95CPU, stats.P95Memory)
+	}
+	if stats.P99CPU != 4 || stats.P99Memory != 1600*mi {
+		t.Errorf("got P99 %v/%d, want the spikes capped at the maxima", stats.P99CPU, stats.P99Memory)
+	}
+	if stats.ThrottledSamples != 0 || stats.P95Throttled != 0 {
+		t.Errorf("got throttling stats without throttling samples: %+v", stats)
+	}
+
+	if got := CalculateStats([]*Usage{empty}); got != (Stats{}) {
+		t.Errorf("got %+v for no samples", got)
+	}
+	if cpu, memory := Percentile(nil, 0.95); cpu != 0 || memory != 0 {
+		t.Errorf("got percentile %v/%d for no usage", cpu, memory)
+	}
+}
+
+func TestMergeKeepsPeriods(t *testing.T) {
+	early := addSamples(NewUsage(Resources{}), 10, 0.5, 64*mi)
+	late := NewUsage(Resources{})
+	late.Add(Sample{Timestamp: early.End.Add(24 * time.Hour), CPU: 0.5, Memory: 64 * mi})
+
+	total := merge([]*Usage{late, early})
+	if !total.Start.Equal(early.Start) || !total.End.Equal(late.End) || total.Samples != 11 {
+		t.Errorf("got %d samples from %v to %v", total.Samples, total.Start, total.End)
+	}
+	// Merged histograms are unweighted
+	if total.CPU.Total() != 11 {
+		t.Errorf("got CPU histogram total %v, want 11", total.CPU.Total())
+	}
+}
@@ -0,0 +1,387 @@
+// Package apply writes recommended resources to the workloads that own the
+// analyzed containers, using server-side apply.
+package apply
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/scaleops/k8s-optimizer/internal/config"
+	"github.com/scaleops/k8s-optimizer/internal/models"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Timeout bounds the API server calls of one apply, resize or rollback.
+const Timeout = 10 * time.Second
+
+var (
+	// ErrUnsupportedKind is returned for workloads other than Deployments,
+	// StatefulSets and DaemonSets.
+	ErrUnsupportedKind = errors.New("unsupported workload kind")
+
+	// ErrContainerNotFound is returned when the workload's pod template has no
+	// container of the target's name.
+	ErrContainerNotFound = errors.New("container not found in workload")
+
+	// ErrRemoveInPlace is returned when a resize would remove a request or
+	// limit, which running pods don't allow.
+	ErrRemoveInPlace = errors.New("resources can't be removed in place")
+)
+
+// Target is a container of a workload.
+type Target struct {
+	Namespace string
+	Kind      string
+	Name      string
+	Container string
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("%s/%s %s/%s", t.Namespace, t.Kind, t.Name, t.Container)
+}
+
+// Resources are a container's requests and limits; zero means unset.
+type Resources struct {
+	CPURequest    float64 `json:"cpu_request"` // cores
+	MemoryRequest int64   `json:"memory_request"`
+	CPULimit      float64 `json:"cpu_limit"`
+	MemoryLimit   int64   `json:"memory_limit"`
+}
+
+// Result is the outcome of an apply, with the container's resources before
+// and as returned by the API server. Resizes report each pod, and the
+// resources of the first one resized.
+type Result struct {
+	Mode            string      `json:"mode"`
+	DryRun          bool        `json:"dry_run"`
+	Previous        Resources   `json:"previous"`
+	Applied         Resources   `json:"applied"`
+	ResourceVersion string      `json:"resource_version,omitempty"`
+	Generation      int64       `json:"generation,omitempty"`
+	Pods            []PodResize `json:"pods,omitempty"`
+}
+
+// Applier patches workload pod templates and resizes pods.
+type Applier struct {
+	client       kubernetes.Interface
+	fieldManager string
+	force        bool
+
+	mu            sync.Mutex
+	resizeChecked bool
+	resize        bool // the API server serves pods/resize
+}
+
+// New creates an Applier with the credentials of the apply configuration:
+// the in-cluster service account, or a kubeconfig and context.
+func New(cfg config.ApplyConfig) (*Applier, error) {
+	var restConfig *rest.Config
+	var err error
+	if cfg.InCluster {
+		restConfig, err = rest.InClusterConfig()
+	} else {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = cfg.Kubeconfig
+		restConfig, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			rules,
+			&clientcmd.ConfigOverrides{CurrentContext: cfg.Context},
+		).ClientConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to build kubeconfig: %w", err)
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	return NewForClient(client, cfg), nil
+}
+
+// NewForClient creates an Applier that uses an existing client, with the
+// field manager of the apply configuration.
+func NewForClient(client kubernetes.Interface, cfg config.ApplyConfig) *Applier {
+	return &Applier{client: client, fieldManager: cfg.FieldManager, force: cfg.Force}
+}
+
+// Supported reports whether workloads of kind can be applied to.
+func Supported(kind string) bool {
+	switch kind {
+	case "Deployment", "StatefulSet", "DaemonSet":
+		return true
+	}
+	return false
+}
+
+// Apply sets the container's requests and limits in the workload's pod
+// template, and removes those whose value is zero, such as the CPU limit of
+// the "none" limit policy. Server-side apply only removes fields the applier
+// owns, so removals are made with a strategic merge patch instead.
+// With dryRun the API server validates and returns the result without
+// persisting it.
+func (a *Applier) Apply(ctx context.Context, t Target, res Resources, dryRun bool) (*Result, error) {
+	if !Supported(t.Kind) {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedKind, t.Kind)
+	}
+
+	current, _, err := a.workload(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	previous, ok := containerResources(&current.Spec, t.Container)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, t)
+	}
+
+	var applied *corev1.PodTemplateSpec
+	var meta *metav1.ObjectMeta
+	if len(removedResources(previous, res)) > 0 {
+		applied, meta, err = a.patch(ctx, t, previous, res, dryRun)
+	} else {
+		applied, meta, err = a.serverSideApply(ctx, t, res, dryRun)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Mode:            models.ApplyModeWorkload,
+		DryRun:          dryRun,
+		Previous:        previous,
+		ResourceVersion: meta.ResourceVersion,
+		Generation:      meta.Generation,
+	}
+	result.Applied, _ = containerResources(&applied.Spec, t.Container)
+	return result, nil
+}
+
+// serverSideApply sets the resources that are non-zero, owned by the
+// applier's field manager.
+func (a *Applier) serverSideApply(ctx context.Context, t Target, res Resources, dryRun bool) (*corev1.PodTemplateSpec, *metav1.ObjectMeta, error) {
+	requests := corev1.ResourceList{}
+	if res.CPURequest > 0 {
+		requests[corev1.ResourceCPU] = cpuQuantity(res.CPURequest)
+	}
+	if res.MemoryRequest > 0 {
+		requests[corev1.ResourceMemory] = memoryQuantity(res.MemoryRequest)
+	}
+	limits := corev1.ResourceList{}
+	if res.CPULimit > 0 {
+		limits[corev1.ResourceCPU] = cpuQuantity(res.CPULimit)
+	}
+	if res.MemoryLimit > 0 {
+		limits[corev1.ResourceMemory] = memoryQuantity(res.MemoryLimit)
+	}
+	resources := corev1ac.ResourceRequirements()
+	if len(requests) > 0 {
+		resources.WithRequests(requests)
+	}
+	if len(limits) > 0 {
+		resources.WithLimits(limits)
+	}
+	template := corev1ac.PodTemplateSpec().WithSpec(corev1ac.PodSpec().WithContainers(
+		corev1ac.Container().WithName(t.Container).WithResources(resources),
+	))
+
+	opts := metav1.ApplyOptions{FieldManager: a.fieldManager, Force: a.force}
+	if dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+
+	apps := a.client.AppsV1()
+	switch t.Kind {
+	case "Deployment":
+		obj, err := apps.Deployments(t.Namespace).Apply(ctx,
+			appsv1ac.Deployment(t.Name, t.Namespace).WithSpec(appsv1ac.DeploymentSpec().WithTemplate(template)), opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &obj.Spec.Template, &obj.ObjectMeta, nil
+	case "StatefulSet":
+		obj, err := apps.StatefulSets(t.Namespace).Apply(ctx,
+			appsv1ac.StatefulSet(t.Name, t.Namespace).WithSpec(appsv1ac.StatefulSetSpec().WithTemplate(template)), opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &obj.Spec.Template, &obj.ObjectMeta, nil
+	case "DaemonSet":
+		obj, err := apps.DaemonSets(t.Namespace).Apply(ctx,
+			appsv1ac.DaemonSet(t.Name, t.Namespace).WithSpec(appsv1ac.DaemonSetSpec().WithTemplate(template)), opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &obj.Spec.Template, &obj.ObjectMeta, nil
+	}
+	return nil, nil, fmt.Errorf("%w %q", ErrUnsupportedKind, t.Kind)
+}
+
+// patch sets the non-zero resources and deletes the zero ones the container
+// has with a strategic merge patch of the pod template.
+func (a *Applier) patch(ctx context.Context, t Target, previous, res Resources, dryRun bool) (*corev1.PodTemplateSpec, *metav1.ObjectMeta, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []map[string]interface{}{
+						{"name": t.Container, "resources": resourcesPatch(previous, res)},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := metav1.PatchOptions{FieldManager: a.fieldManager}
+	if dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+
+	apps := a.client.AppsV1()
+	switch t.Kind {
+	case "Deployment":
+		obj, err := apps.Deployments(t.Namespace).Patch(ctx, t.Name, types.StrategicMergePatchType, data, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &obj.Spec.Template, &obj.ObjectMeta, nil
+	case "StatefulSet":
+		obj, err := apps.StatefulSets(t.Namespace).Patch(ctx, t.Name, types.StrategicMergePatchType, data, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &obj.Spec.Template, &obj.ObjectMeta, nil
+	case "DaemonSet":
+		obj, err := apps.DaemonSets(t.Namespace).Patch(ctx, t.Name, types.StrategicMergePatchType, data, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &obj.Spec.Template, &obj.ObjectMeta, nil
+	}
+	return nil, nil, fmt.Errorf("%w %q", ErrUnsupportedKind, t.Kind)
+}
+
+// resourcesPatch is the strategic merge patch of a container's resources
+// from previous to res: a null value deletes a resource.
+func resourcesPatch(previous, res Resources) map[string]interface{} {
+	requests := map[string]interface{}{}
+	limits := map[string]interface{}{}
+	setQuantity(requests, corev1.ResourceCPU, res.CPURequest > 0, previous.CPURequest > 0, formatCPU(res.CPURequest))
+	setQuantity(requests, corev1.ResourceMemory, res.MemoryRequest > 0, previous.MemoryRequest > 0, formatMemory(res.MemoryRequest))
+	setQuantity(limits, corev1.ResourceCPU, res.CPULimit > 0, previous.CPULimit > 0, formatCPU(res.CPULimit))
+	setQuantity(limits, corev1.ResourceMemory, res.MemoryLimit > 0, previous.MemoryLimit > 0, formatMemory(res.MemoryLimit))
+
+	resources := map[string]interface{}{}
+	if len(requests) > 0 {
+		resources["requests"] = requests
+	}
+	if len(limits) > 0 {
+		resources["limits"] = limits
+	}
+	return resources
+}
+
+func setQuantity(list map[string]interface{}, name corev1.ResourceName, set, had bool, value string) {
+	switch {
+	case set:
+		list[string(name)] = value
+	case had:
+		list[string(name)] = nil
+	}
+}
+
+// removedResources names the resources the container has that res sets to
+// zero.
+func removedResources(previous, res Resources) []string {
+	var removed []string
+	if res.CPURequest == 0 && previous.CPURequest > 0 {
+		removed = append(removed, "CPU request")
+	}
+	if res.MemoryRequest == 0 && previous.MemoryRequest > 0 {
+		removed = append(removed, "memory request")
+	}
+	if res.CPULimit == 0 && previous.CPULimit > 0 {
+		removed = append(removed, "CPU limit")
+	}
+	if res.MemoryLimit == 0 && previous.MemoryLimit > 0 {
+		removed = append(removed, "memory limit")
+	}
+	return removed
+}
+
+// workload reads the workload's current pod template and pod selector.
+func (a *Applier) workload(ctx context.Context, t Target) (*corev1.PodTemplateSpec, *metav1.LabelSelector, error) {
+	apps := a.client.AppsV1()
+	switch t.Kind {
+	case "Deployment":
+		obj, err := apps.Deployments(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return &obj.Spec.Template, obj.Spec.Selector, nil
+	case "StatefulSet":
+		obj, err := apps.StatefulSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return &obj.Spec.Template, obj.Spec.Selector, nil
+	case "DaemonSet":
+		obj, err := apps.DaemonSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return &obj.Spec.Template, obj.Spec.Selector, nil
+	}
+	return nil, nil, fmt.Errorf("%w %q", ErrUnsupportedKind, t.Kind)
+}
+
+// containerResources returns the resources of the named container of a pod
+// spec.
+func containerResources(spec *corev1.PodSpec, name string) (Resources, bool) {
+	for _, c := range spec.Containers {
+		if c.Name != name {
+			continue
+		}
+		var res Resources
+		if q, ok := c.Resources.Requests[corev1.ResourceCPU]; ok {
+			res.CPURequest = q.AsApproximateFloat64()
+		}
+		if q, ok := c.Resources.Requests[corev1.ResourceMemory]; ok {
+			res.MemoryRequest = q.Value()
+		}
+		if q, ok := c.Resources.Limits[corev1.ResourceCPU]; ok {
+			res.CPULimit = q.AsApproximateFloat64()
+		}
+		if q, ok := c.Resources.Limits[corev1.ResourceMemory]; ok {
+			res.MemoryLimit = q.Value()
+		}
+		return res, true
+	}
+	return Resources{}, false
+}
+
+// cpuQuantity formats cores in millicores, as the YAML patches do.
+func cpuQuantity(cores float64) resource.Quantity {
+	return *resource.NewMilliQuantity(int64(math.Round(cores*1000)), resource.DecimalSI)
+}
+
+// memoryQuantity formats bytes exactly, so a rollback restores the snapshot
+// as it was, as the YAML patches do.
+func memoryQuantity(bytes int64) resource.Quantity {
+	return *resource.NewQuantity(bytes, resource.BinarySI)
+}
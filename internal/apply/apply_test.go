@@ -0,0 +1,193 @@
+package apply
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/scaleops/k8s-optimizer/internal/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const mi = 1024 * 1024
+
+var labels = map[string]string{"app": "web"}
+
+// limitedContainer has CPU and memory requests and limits, and an
+// ephemeral-storage request the applier doesn't manage.
+func limitedContainer() corev1.Container {
+	return corev1.Container{
+		Name: "app",
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:              resource.MustParse("500m"),
+				corev1.ResourceMemory:           resource.MustParse("256Mi"),
+				corev1.ResourceEphemeralStorage: resource.MustParse("1Gi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("1"),
+				corev1.ResourceMemory: resource.MustParse("512Mi"),
+			},
+		},
+	}
+}
+
+func deployment() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{limitedContainer()}},
+			},
+		},
+	}
+}
+
+func patchTypes(client *fake.Clientset) []types.PatchType {
+	var patches []types.PatchType
+	for _, action := range client.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			patches = append(patches, patch.GetPatchType())
+		}
+	}
+	return patches
+}
+
+func TestApplyRemovesCPULimit(t *testing.T) {
+	client := fake.NewClientset(deployment())
+	applier := NewForClient(client, config.ApplyConfig{FieldManager: "k8s-optimizer"})
+	target := Target{Namespace: "shop", Kind: "Deployment", Name: "web", Container: "app"}
+
+	// The "none" limit policy recommends no CPU limit
+	result, err := applier.Apply(context.Background(), target, Resources{
+		CPURequest:    0.25,
+		MemoryRequest: 300 * mi,
+		MemoryLimit:   400 * mi,
+	}, false)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	want := Resources{CPURequest: 0.25, MemoryRequest: 300 * mi, MemoryLimit: 400 * mi}
+	if result.Applied != want {
+		t.Errorf("got applied %+v, want %+v", result.Applied, want)
+	}
+	if prev := (Resources{CPURequest: 0.5, MemoryRequest: 256 * mi, CPULimit: 1, MemoryLimit: 512 * mi}); result.Previous != prev {
+		t.Errorf("got previous %+v, want %+v", result.Previous, prev)
+	}
+	if got := patchTypes(client); len(got) != 1 || got[0] != types.StrategicMergePatchType {
+		t.Errorf("got patches %v, want one strategic merge patch", got)
+	}
+
+	obj, err := client.AppsV1().Deployments("shop").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources := obj.Spec.Template.Spec.Containers[0].Resources
+	if _, ok := resources.Limits[corev1.ResourceCPU]; ok {
+		t.Errorf("CPU limit was not removed: %v", resources.Limits)
+	}
+	if _, ok := resources.Requests[corev1.ResourceEphemeralStorage]; !ok {
+		t.Errorf("ephemeral-storage request was removed: %v", resources.Requests)
+	}
+}
+
+func TestApplyServerSide(t *testing.T) {
+	// The template's resources are owned by whoever created it
+	client := fake.NewClientset(deployment())
+	applier := NewForClient(client, config.ApplyConfig{FieldManager: "k8s-optimizer", Force: true})
+	target := Target{Namespace: "shop", Kind: "Deployment", Name: "web", Container: "app"}
+
+	res := Resources{CPURequest: 0.25, MemoryRequest: 300 * mi, CPULimit: 0.5, MemoryLimit: 400 * mi}
+	result, err := applier.Apply(context.Background(), target, res, false)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if result.Applied != res {
+		t.Errorf("got applied %+v, want %+v", result.Applied, res)
+	}
+	if got := patchTypes(client); len(got) != 1 || got[0] != types.ApplyPatchType {
+		t.Errorf("got patches %v, want one server-side apply", got)
+	}
+}
+
+func TestApplyRestoresExactMemory(t *testing.T) {
+	client := fake.NewClientset(deployment())
+	applier := NewForClient(client, config.ApplyConfig{FieldManager: "k8s-optimizer", Force: true})
+	target := Target{Namespace: "shop", Kind: "Deployment", Name: "web", Container: "app"}
+
+	// A snapshot taken from a manifest that set 1G rather than Mi
+	previous := Resources{CPURequest: 0.5, MemoryRequest: 1000 * 1000 * 1000, CPULimit: 1, MemoryLimit: 1500*mi + 1}
+	result, err := applier.Apply(context.Background(), target, previous, false)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if result.Applied != previous {
+		t.Errorf("got applied %+v, want %+v", result.Applied, previous)
+	}
+
+	obj, err := client.AppsV1().Deployments("shop").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources := obj.Spec.Template.Spec.Containers[0].Resources
+	if got := resources.Requests.Memory().Value(); got != previous.MemoryRequest {
+		t.Errorf("got memory request %d, want %d", got, previous.MemoryRequest)
+	}
+	if got := resources.Limits.Memory().Value(); got != previous.MemoryLimit {
+		t.Errorf("got memory limit %d, want %d", got, previous.MemoryLimit)
+	}
+}
+
+func TestResizeCannotRemoveLimit(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web-1", Labels: labels},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{limitedContainer()}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	client := fake.NewClientset(deployment(), pod)
+	applier := NewForClient(client, config.ApplyConfig{FieldManager: "k8s-optimizer"})
+	target := Target{Namespace: "shop", Kind: "Deployment", Name: "web", Container: "app"}
+
+	_, err := applier.Resize(context.Background(), target, Resources{
+		CPURequest:    0.25,
+		MemoryRequest: 300 * mi,
+		MemoryLimit:   400 * mi,
+	}, false, false)
+	if !errors.Is(err, ErrRemoveInPlace) {
+		t.Fatalf("got error %v, want ErrRemoveInPlace", err)
+	}
+	if got := patchTypes(client); len(got) != 0 {
+		t.Errorf("got patches %v, want none", got)
+	}
+}
+
+func TestResourcesPatch(t *testing.T) {
+	previous := Resources{CPURequest: 0.5, MemoryRequest: 256 * mi, CPULimit: 1}
+	got := resourcesPatch(previous, Resources{CPURequest: 0.25, MemoryRequest: 300 * mi, MemoryLimit: 400 * mi})
+
+	requests, _ := got["requests"].(map[string]interface{})
+	limits, _ := got["limits"].(map[string]interface{})
+	if requests["cpu"] != "250m" || requests["memory"] != "300Mi" {
+		t.Errorf("got requests %v", requests)
+	}
+	if cpu, ok := limits["cpu"]; !ok || cpu != nil {
+		t.Errorf("got CPU limit %v, want null to delete it", limits["cpu"])
+	}
+	if limits["memory"] != "400Mi" {
+		t.Errorf("got memory limit %v", limits["memory"])
+	}
+
+	// Resources the container doesn't have are left out
+	if got := resourcesPatch(Resources{}, Resources{CPURequest: 0.1}); len(got) != 1 {
+		t.Errorf("got %v, want only requests", got)
+	}
+}
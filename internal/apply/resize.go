@@ -0,0 +1,195 @@
+package apply
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/scaleops/k8s-optimizer/internal/models"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ErrNoPodsResized is returned when none of the workload's pods could be
+// resized; the result reports why for each pod.
+var ErrNoPodsResized = errors.New("no pods resized")
+
+// Pod resize outcomes.
+const (
+	PodResized = "resized"
+	PodSkipped = "skipped"
+	PodFailed  = "failed"
+)
+
+// PodResize is the outcome of resizing one pod.
+type PodResize struct {
+	Pod      string    `json:"pod"`
+	Status   string    `json:"status"`
+	Message  string    `json:"message,omitempty"`
+	Previous Resources `json:"previous"`
+	Applied  Resources `json:"applied"`
+}
+
+// SupportsResize reports whether the API server serves the pods/resize
+// subresource. The answer is cached once discovery succeeds.
+func (a *Applier) SupportsResize() (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.resizeChecked {
+		return a.resize, nil
+	}
+
+	resources, err := a.client.Discovery().ServerResourcesForGroupVersion("v1")
+	if err != nil {
+		return false, fmt.Errorf("failed to discover pod subresources: %w", err)
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == "pods/resize" {
+			a.resize = true
+		}
+	}
+	a.resizeChecked = true
+	return a.resize, nil
+}
+
+// Resize sets the container's requests and limits on the workload's running
+// pods in place, leaving the pod template alone: pods created later still
+// get the template's resources. Resources can't be removed in place, so a
+// zero value for one the pods have fails with ErrRemoveInPlace. Pods whose
+// resizePolicy restarts the container for a changed resource are skipped
+// unless allowRestart is set.
+func (a *Applier) Resize(ctx context.Context, t Target, res Resources, dryRun, allowRestart bool) (*Result, error) {
+	if !Supported(t.Kind) {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedKind, t.Kind)
+	}
+
+	_, labelSelector, err := a.workload(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector of %s: %w", t, err)
+	}
+	pods, err := a.client.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	opts := metav1.PatchOptions{FieldManager: a.fieldManager}
+	if dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+
+	// Check every pod before resizing any, so none is left half done
+	var running []*corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		if previous, ok := containerResources(&pod.Spec, t.Container); ok {
+			if removed := removedResources(previous, res); len(removed) > 0 {
+				return nil, fmt.Errorf("%w: the %s of %s; apply to the workload instead",
+					ErrRemoveInPlace, strings.Join(removed, " and "), pod.Name)
+			}
+		}
+		running = append(running, pod)
+	}
+
+	result := &Result{Mode: models.ApplyModeResize, DryRun: dryRun}
+	resized := 0
+	for _, pod := range running {
+		outcome := a.resizePod(ctx, pod, t.Container, res, allowRestart, opts)
+		if outcome.Status == PodResized {
+			if resized == 0 {
+				result.Previous, result.Applied = outcome.Previous, outcome.Applied
+			}
+			resized++
+		}
+		result.Pods = append(result.Pods, outcome)
+	}
+
+	if resized == 0 {
+		return result, fmt.Errorf("%w of %s (%d running)", ErrNoPodsResized, t, len(result.Pods))
+	}
+	return result, nil
+}
+
+// resizePod resizes the container of one pod.
+func (a *Applier) resizePod(ctx context.Context, pod *corev1.Pod, container string, res Resources, allowRestart bool, opts metav1.PatchOptions) PodResize {
+	outcome := PodResize{Pod: pod.Name}
+	previous, ok := containerResources(&pod.Spec, container)
+	if !ok {
+		outcome.Status, outcome.Message = PodSkipped, ErrContainerNotFound.Error()
+		return outcome
+	}
+	outcome.Previous = previous
+
+	if !allowRestart {
+		if restarts := restartingResources(pod, container, previous, res); len(restarts) > 0 {
+			outcome.Status = PodSkipped
+			outcome.Message = fmt.Sprintf("resizing %s restarts the container", strings.Join(restarts, " and "))
+			return outcome
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []map[string]interface{}{
+				{"name": container, "resources": resourcesPatch(previous, res)},
+			},
+		},
+	})
+	if err != nil {
+		outcome.Status, outcome.Message = PodFailed, err.Error()
+		return outcome
+	}
+
+	out, err := a.client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.StrategicMergePatchType, patch, opts, "resize")
+	if err != nil {
+		outcome.Status, outcome.Message = PodFailed, err.Error()
+		return outcome
+	}
+	outcome.Status = PodResized
+	outcome.Applied, _ = containerResources(&out.Spec, container)
+	return outcome
+}
+
+func formatCPU(cores float64) string {
+	q := cpuQuantity(cores)
+	return q.String()
+}
+
+func formatMemory(bytes int64) string {
+	q := memoryQuantity(bytes)
+	return q.String()
+}
+
+// restartingResources returns the changed resources whose resize policy
+// restarts the container.
+func restartingResources(pod *corev1.Pod, container string, previous, desired Resources) []string {
+	changed := map[corev1.ResourceName]bool{
+		corev1.ResourceCPU: formatCPU(previous.CPURequest) != formatCPU(desired.CPURequest) ||
+			formatCPU(previous.CPULimit) != formatCPU(desired.CPULimit),
+		corev1.ResourceMemory: formatMemory(previous.MemoryRequest) != formatMemory(desired.MemoryRequest) ||
+			formatMemory(previous.MemoryLimit) != formatMemory(desired.MemoryLimit),
+	}
+
+	var restarts []string
+	for _, c := range pod.Spec.Containers {
+		if c.Name != container {
+			continue
+		}
+		// Resources without a policy default to NotRequired
+		for _, policy := range c.ResizePolicy {
+			if changed[policy.ResourceName] && policy.RestartPolicy == corev1.RestartContainer {
+				restarts = append(restarts, string(policy.ResourceName))
+			}
+		}
+	}
+	return restarts
+}
@@ -4,14 +4,23 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 type Config struct {
 	Database   DatabaseConfig
 	Kubernetes KubernetesConfig
+	Scope      ScopeConfig
+	Metrics    MetricsConfig
 	Analysis   AnalysisConfig
+	Retention  RetentionConfig
 	Web        WebConfig
+	Apply      ApplyConfig
+
+	Verification VerificationConfig
 }
 
 type DatabaseConfig struct {
@@ -28,20 +37,166 @@ type KubernetesConfig struct {
 	ConfigPath string
 }
 
+// ScopeConfig selects the pods the collector tracks. Namespace patterns are
+// globs (e.g. "team-*"); exclusions win over inclusions.
+type ScopeConfig struct {
+	IncludeNamespaces []string // empty includes every namespace
+	ExcludeNamespaces []string
+	PodSelector       string // Kubernetes label selector, e.g. "app,tier!=test"
+}
+
+type MetricsConfig struct {
+	Source        string // metrics-server, prometheus or kubelet
+	PrometheusURL string
+	Backfill      bool // backfill new workloads from Prometheus history
+}
+
 type AnalysisConfig struct {
-	WindowDays         int
-	CollectionInterval time.Duration
-	CPUCostPerCore     float64
-	MemoryCostPerGB    float64
+	Strategy            string // percentile, max-memory or histogram
+	PolicyFile          string
+	Policies            PolicySet // window, percentile, buffer, minimums and thresholds
+	CollectionInterval  time.Duration
+	Workers             int // containers analyzed concurrently
+	CPUCostPerCore      float64
+	MemoryCostPerGB     float64
+	MemoryBasis         string  // max or p99 working set
+	MemoryMargin        float64 // safety margin over MemoryBasis
+	OOMBump             float64 // increase over the size a container was OOMKilled at
+	RestartThreshold    int     // recent restarts that mark a container at risk
+	ThrottlingThreshold float64 // P95 throttled-periods ratio that flags a CPU limit as too low
+	Limits              LimitPolicyConfig
+	NamespaceLimits     map[string]LimitPolicyConfig // per-namespace overrides of Limits
+
+	// Live recommendations no analysis refreshed for this many days expire
+	RecommendationExpiryDays int
+
+	// A new recommendation replaces the published one only when a request or
+	// limit moves by more than both the relative and the absolute minimum
+	RecommendationMinChange       float64 // relative, e.g. 0.1 for 10%
+	RecommendationMinChangeCPU    float64 // cores
+	RecommendationMinChangeMemory int64   // bytes
+}
+
+type LimitPolicyConfig struct {
+	CPU      string // keep-ratio, headroom or none
+	Memory   string // keep-ratio, headroom or equal-request
+	Headroom float64
+}
+
+// LimitsFor returns the limit policy that applies to the namespace.
+func (c *AnalysisConfig) LimitsFor(namespace string) LimitPolicyConfig {
+	if policy, ok := c.NamespaceLimits[namespace]; ok {
+		return policy
+	}
+	return c.Limits
+}
+
+// RetentionConfig bounds how long data is kept, in days; 0 keeps it forever.
+// Raw samples are rolled up into hourly and daily aggregates before they
+// expire.
+type RetentionConfig struct {
+	DeletedPodDays int // data of pods gone from the cluster
+	RawDays        int // per-collection samples
+	HourlyDays     int // hourly rollups
+	DailyDays      int // daily rollups
+	HistogramDays  int // daily usage histograms analyses read
+}
+
+// ResolutionBoundaries returns the oldest timestamps still covered by raw
+// samples and by hourly rollups at now. Older data is only available at the
+// next coarser resolution.
+func (c RetentionConfig) ResolutionBoundaries(now time.Time) (raw, hourly time.Time) {
+	if c.RawDays > 0 {
+		raw = now.Add(-time.Duration(c.RawDays) * 24 * time.Hour).Truncate(time.Hour)
+	}
+	if c.HourlyDays > 0 {
+		hourly = now.Add(-time.Duration(c.HourlyDays) * 24 * time.Hour).Truncate(24 * time.Hour)
+	}
+	if hourly.After(raw) {
+		hourly = raw
+	}
+	return raw, hourly
 }
 
 type WebConfig struct {
 	Port         int
 	TemplatesDir string
 	StaticDir    string
+
+	// Basic auth credentials required by the routes that change state. They
+	// are required when applying to the cluster is enabled.
+	AuthUser     string
+	AuthPassword string
+
+	// Origins allowed to make cross-origin requests; none when empty
+	CORSOrigins []string
+}
+
+// AuthEnabled reports whether basic auth credentials are configured.
+func (c WebConfig) AuthEnabled() bool {
+	return c.AuthUser != "" && c.AuthPassword != ""
+}
+
+// ApplyConfig lets the web server apply recommendations to workloads with its
+// own Kubernetes credentials. It is off unless enabled.
+type ApplyConfig struct {
+	Enabled      bool
+	InCluster    bool
+	Kubeconfig   string // KUBECONFIG or ~/.kube/config when empty
+	Context      string
+	FieldManager string // server-side apply field manager
+	Force        bool   // take over resource fields owned by other managers
+}
+
+// VerificationConfig has the collector watch the workload of an applied
+// recommendation for regressions during a period after the apply. A zero
+// period disables verification.
+type VerificationConfig struct {
+	Period       time.Duration
+	MaxOOMKills  int     // OOMKills allowed during the period
+	MaxRestarts  int     // container restarts allowed during the period
+	MaxThrottled float64 // P95 throttled-periods ratio
+	MaxUsage     float64 // P95 usage as a fraction of the applied request
+	MinSamples   int     // usage samples needed before judging usage and throttling
+	AutoRollback bool    // roll regressed applies back with the apply credentials
+	WebhookURL   string  // receives regressions as JSON
 }
 
 func Load() (*Config, error) {
+	limits := LimitPolicyConfig{
+		CPU:      getEnv("LIMIT_POLICY_CPU", "headroom"),
+		Memory:   getEnv("LIMIT_POLICY_MEMORY", "headroom"),
+		Headroom: getEnvFloat("LIMIT_HEADROOM", 0.2),
+	}
+	namespaceLimits, err := parseNamespaceLimits(getEnv("LIMIT_POLICY_NAMESPACES", ""), limits)
+	if err != nil {
+		return nil, err
+	}
+
+	minChangeCPU, err := getEnvQuantity("RECOMMENDATION_MIN_CHANGE_CPU", "20m")
+	if err != nil {
+		return nil, err
+	}
+	minChangeMemory, err := getEnvQuantity("RECOMMENDATION_MIN_CHANGE_MEMORY", "32Mi")
+	if err != nil {
+		return nil, err
+	}
+
+	policyFile := getEnv("ANALYSIS_POLICY_FILE", "")
+	policies, err := loadPolicies(policyFile, AnalysisPolicy{
+		Name:                      DefaultPolicyName,
+		WindowDays:                getEnvInt("ANALYSIS_WINDOW_DAYS", 7),
+		Percentile:                0.95,
+		Buffer:                    0.2,
+		MinCPU:                    0.01,
+		MinMemory:                 32 * 1024 * 1024,
+		OverProvisionedThreshold:  30,
+		UnderProvisionedThreshold: -20,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := &Config{
 		Database: DatabaseConfig{
 			Host:     getEnv("DB_HOST", "localhost"),
@@ -55,16 +210,69 @@ func Load() (*Config, error) {
 			InCluster:  getEnvBool("K8S_IN_CLUSTER", false),
 			ConfigPath: getEnv("KUBECONFIG", ""),
 		},
+		Scope: ScopeConfig{
+			IncludeNamespaces: getEnvList("COLLECT_NAMESPACES"),
+			ExcludeNamespaces: getEnvListDefault("COLLECT_EXCLUDE_NAMESPACES", "kube-system"),
+			PodSelector:       getEnv("COLLECT_POD_SELECTOR", ""),
+		},
+		Metrics: MetricsConfig{
+			Source:        getEnv("METRICS_SOURCE", "metrics-server"),
+			PrometheusURL: getEnv("PROMETHEUS_URL", "http://localhost:9090"),
+			Backfill:      getEnvBool("METRICS_BACKFILL", false),
+		},
 		Analysis: AnalysisConfig{
-			WindowDays:         getEnvInt("ANALYSIS_WINDOW_DAYS", 7),
-			CollectionInterval: time.Duration(getEnvInt("COLLECTION_INTERVAL_MINUTES", 5)) * time.Minute,
-			CPUCostPerCore:     getEnvFloat("CPU_COST_PER_CORE", 30.0),
-			MemoryCostPerGB:    getEnvFloat("MEMORY_COST_PER_GB", 10.0),
+			Strategy:            getEnv("ANALYSIS_STRATEGY", "percentile"),
+			PolicyFile:          policyFile,
+			Policies:            policies,
+			CollectionInterval:  time.Duration(getEnvInt("COLLECTION_INTERVAL_MINUTES", 5)) * time.Minute,
+			Workers:             getEnvInt("ANALYSIS_WORKERS", 4),
+			CPUCostPerCore:      getEnvFloat("CPU_COST_PER_CORE", 30.0),
+			MemoryCostPerGB:     getEnvFloat("MEMORY_COST_PER_GB", 10.0),
+			MemoryBasis:         getEnv("MEMORY_BASIS", "max"),
+			MemoryMargin:        getEnvFloat("MEMORY_MARGIN", 0.15),
+			OOMBump:             getEnvFloat("OOM_BUMP", 0.25),
+			RestartThreshold:    getEnvInt("RESTART_THRESHOLD", 3),
+			ThrottlingThreshold: getEnvFloat("THROTTLING_THRESHOLD", 0.25),
+			Limits:              limits,
+			NamespaceLimits:     namespaceLimits,
+
+			RecommendationExpiryDays:      getEnvInt("RECOMMENDATION_EXPIRY_DAYS", 7),
+			RecommendationMinChange:       getEnvFloat("RECOMMENDATION_MIN_CHANGE", 0.1),
+			RecommendationMinChangeCPU:    minChangeCPU.AsApproximateFloat64(),
+			RecommendationMinChangeMemory: minChangeMemory.Value(),
+		},
+		Retention: RetentionConfig{
+			DeletedPodDays: getEnvInt("RETENTION_DELETED_POD_DAYS", 30),
+			RawDays:        getEnvInt("RETENTION_RAW_DAYS", 14),
+			HourlyDays:     getEnvInt("RETENTION_HOURLY_DAYS", 90),
+			DailyDays:      getEnvInt("RETENTION_DAILY_DAYS", 730),
+			HistogramDays:  getEnvInt("RETENTION_HISTOGRAM_DAYS", 90),
 		},
 		Web: WebConfig{
 			Port:         getEnvInt("WEB_PORT", 8080),
 			TemplatesDir: getEnv("TEMPLATES_DIR", "web/templates"),
 			StaticDir:    getEnv("STATIC_DIR", "web/static"),
+			AuthUser:     getEnv("WEB_AUTH_USER", ""),
+			AuthPassword: getEnv("WEB_AUTH_PASSWORD", ""),
+			CORSOrigins:  getEnvList("WEB_CORS_ORIGINS"),
+		},
+		Apply: ApplyConfig{
+			Enabled:      getEnvBool("APPLY_ENABLED", false),
+			InCluster:    getEnvBool("APPLY_IN_CLUSTER", getEnvBool("K8S_IN_CLUSTER", false)),
+			Kubeconfig:   getEnv("APPLY_KUBECONFIG", ""),
+			Context:      getEnv("APPLY_KUBE_CONTEXT", ""),
+			FieldManager: getEnv("APPLY_FIELD_MANAGER", "k8s-optimizer"),
+			Force:        getEnvBool("APPLY_FORCE", false),
+		},
+		Verification: VerificationConfig{
+			Period:       time.Duration(getEnvInt("VERIFY_PERIOD_HOURS", 24)) * time.Hour,
+			MaxOOMKills:  getEnvInt("VERIFY_MAX_OOM_KILLS", 0),
+			MaxRestarts:  getEnvInt("VERIFY_MAX_RESTARTS", 3),
+			MaxThrottled: getEnvFloat("VERIFY_MAX_THROTTLED", 0.25),
+			MaxUsage:     getEnvFloat("VERIFY_MAX_USAGE", 1.0),
+			MinSamples:   getEnvInt("VERIFY_MIN_SAMPLES", 12),
+			AutoRollback: getEnvBool("VERIFY_AUTO_ROLLBACK", false),
+			WebhookURL:   getEnv("VERIFY_WEBHOOK_URL", ""),
 		},
 	}
 
@@ -76,6 +284,43 @@ func (c *DatabaseConfig) ConnectionString() string {
 		c.Host, c.Port, c.User, c.Password, c.DBName, c.SSLMode)
 }
 
+// parseNamespaceLimits parses per-namespace limit policies in the form
+// "namespace=cpu/memory[/headroom],...", e.g. "batch=none/equal-request".
+// The headroom defaults to the global one.
+func parseNamespaceLimits(value string, defaults LimitPolicyConfig) (map[string]LimitPolicyConfig, error) {
+	policies := make(map[string]LimitPolicyConfig)
+	if value == "" {
+		return policies, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		namespace, spec, ok := strings.Cut(entry, "=")
+		if !ok || namespace == "" {
+			return nil, fmt.Errorf("invalid LIMIT_POLICY_NAMESPACES entry %q", entry)
+		}
+		parts := strings.Split(spec, "/")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid LIMIT_POLICY_NAMESPACES entry %q: want namespace=cpu/memory[/headroom]", entry)
+		}
+
+		policy := LimitPolicyConfig{CPU: parts[0], Memory: parts[1], Headroom: defaults.Headroom}
+		if len(parts) == 3 {
+			headroom, err := strconv.ParseFloat(parts[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid headroom in LIMIT_POLICY_NAMESPACES entry %q: %w", entry, err)
+			}
+			policy.Headroom = headroom
+		}
+		policies[namespace] = policy
+	}
+
+	return policies, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -101,6 +346,43 @@ func getEnvFloat(key string, defaultValue float64) float64 {
 	return defaultValue
 }
 
+// getEnvQuantity parses a Kubernetes quantity such as "20m" or "32Mi".
+func getEnvQuantity(key, defaultValue string) (resource.Quantity, error) {
+	value := getEnv(key, defaultValue)
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return q, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return q, nil
+}
+
+// getEnvList splits a comma-separated variable, skipping empty items.
+func getEnvList(key string) []string {
+	return SplitList(os.Getenv(key))
+}
+
+// getEnvListDefault is getEnvList with a default for when the variable is
+// unset; set empty, the list is empty.
+func getEnvListDefault(key, defaultValue string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		value = defaultValue
+	}
+	return SplitList(value)
+}
+
+// SplitList splits a comma-separated list, trimming spaces and skipping
+// empty items.
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolVal, err := strconv.ParseBool(value); err == nil {
@@ -109,4 +391,3 @@ func getEnvBool(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
-
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// DefaultPolicyName names the policy used when no override matches.
+const DefaultPolicyName = "default"
+
+// AnalysisPolicy is the resolved set of sizing rules applied to a container.
+type AnalysisPolicy struct {
+	Name       string
+	WindowDays int
+	Percentile float64 // e.g. 0.95
+	Buffer     float64 // e.g. 0.2 for 20%
+	MinCPU     float64 // cores
+	MinMemory  int64   // bytes
+
+	// Waste percentages beyond which a container is over- or
+	// under-provisioned (the latter is negative).
+	OverProvisionedThreshold  float64
+	UnderProvisionedThreshold float64
+}
+
+// PolicySet is the default analysis policy and the overrides loaded from the
+// policy file, in file order.
+type PolicySet struct {
+	Default   AnalysisPolicy
+	Overrides []PolicyOverride
+}
+
+// PolicyOverride applies its rules to pods in one of Namespaces whose labels
+// match Selector. Either may be empty, but not both.
+type PolicyOverride struct {
+	Namespaces []string
+	Selector   labels.Selector // nil matches every pod
+	Policy     AnalysisPolicy
+}
+
+// For returns the policy for a pod: the first matching override, or the
+// default policy.
+func (s PolicySet) For(namespace string, podLabels map[string]string) AnalysisPolicy {
+	for _, o := range s.Overrides {
+		if o.matches(namespace, podLabels) {
+			return o.Policy
+		}
+	}
+	return s.Default
+}
+
+// MaxWindowDays returns the longest window of any policy, which bounds how
+// much history is worth keeping or backfilling.
+func (s PolicySet) MaxWindowDays() int {
+	days := s.Default.WindowDays
+	for _, o := range s.Overrides {
+		if o.Policy.WindowDays > days {
+			days = o.Policy.WindowDays
+		}
+	}
+	return days
+}
+
+// All returns the default policy followed by every override.
+func (s PolicySet) All() []AnalysisPolicy {
+	policies := []AnalysisPolicy{s.Default}
+	for _, o := range s.Overrides {
+		policies = append(policies, o.Policy)
+	}
+	return policies
+}
+
+func (o PolicyOverride) matches(namespace string, podLabels map[string]string) bool {
+	if len(o.Namespaces) > 0 {
+		found := false
+		for _, ns := range o.Namespaces {
+			if ns == namespace {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if o.Selector != nil && !o.Selector.Matches(labels.Set(podLabels)) {
+		return false
+	}
+	return true
+}
+
+// policyFile is the YAML layout of ANALYSIS_POLICY_FILE:
+//
+//	default:
+//	  windowDays: 7
+//	  percentile: 0.95
+//	  buffer: 0.2
+//	policies:
+//	  - name: prod
+//	    namespaces: [prod]
+//	    selector: tier in (frontend,backend)
+//	    percentile: 0.99
+//	    buffer: 0.3
+//	    minCPU: 50m
+//	    minMemory: 64Mi
+type policyFile struct {
+	Default  policyRules      `yaml:"default"`
+	Policies []policyOverride `yaml:"policies"`
+}
+
+type policyOverride struct {
+	Name        string   `yaml:"name"`
+	Namespaces  []string `yaml:"namespaces"`
+	Selector    string   `yaml:"selector"`
+	policyRules `yaml:",inline"`
+}
+
+// policyRules are the settings a policy may set; unset ones are inherited
+// from the default policy.
+type policyRules struct {
+	WindowDays                *int     `yaml:"windowDays"`
+	Percentile                *float64 `yaml:"percentile"`
+	Buffer                    *float64 `yaml:"buffer"`
+	MinCPU                    string   `yaml:"minCPU"`
+	MinMemory                 string   `yaml:"minMemory"`
+	OverProvisionedThreshold  *float64 `yaml:"overProvisionedThreshold"`
+	UnderProvisionedThreshold *float64 `yaml:"underProvisionedThreshold"`
+}
+
+// loadPolicies reads the policy file at path on top of the built-in default
+// policy. An empty path yields the default policy only.
+func loadPolicies(path string, defaults AnalysisPolicy) (PolicySet, error) {
+	set := PolicySet{Default: defaults}
+	if path == "" {
+		return set, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return set, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	var file policyFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return set, fmt.Errorf("failed to parse policy file %s: %w", path, err)
+	}
+
+	set.Default, err = file.Default.apply(defaults)
+	if err != nil {
+		return set, fmt.Errorf("policy file %s: default: %w", path, err)
+	}
+
+	for i, o := range file.Policies {
+		if o.Name == "" {
+			return set, fmt.Errorf("policy file %s: policy %d has no name", path, i)
+		}
+		if len(o.Namespaces) == 0 && o.Selector == "" {
+			return set, fmt.Errorf("policy file %s: policy %s needs namespaces or a selector", path, o.Name)
+		}
+
+		override := PolicyOverride{Namespaces: o.Namespaces}
+		if o.Selector != "" {
+			override.Selector, err = labels.Parse(o.Selector)
+			if err != nil {
+				return set, fmt.Errorf("policy file %s: policy %s: invalid selector: %w", path, o.Name, err)
+			}
+		}
+		override.Policy, err = o.policyRules.apply(set.Default)
+		if err != nil {
+			return set, fmt.Errorf("policy file %s: policy %s: %w", path, o.Name, err)
+		}
+		override.Policy.Name = o.Name
+
+		set.Overrides = append(set.Overrides, override)
+	}
+
+	return set, nil
+}
+
+// apply returns base with the rules that are set overridden.
+func (r policyRules) apply(base AnalysisPolicy) (AnalysisPolicy, error) {
+	policy := base
+	if r.WindowDays != nil {
+		policy.WindowDays = *r.WindowDays
+	}
+	if r.Percentile != nil {
+		policy.Percentile = *r.Percentile
+	}
+	if r.Buffer != nil {
+		policy.Buffer = *r.Buffer
+	}
+	if r.MinCPU != "" {
+		q, err := resource.ParseQuantity(r.MinCPU)
+		if err != nil {
+			return policy, fmt.Errorf("invalid minCPU %q: %w", r.MinCPU, err)
+		}
+		policy.MinCPU = q.AsApproximateFloat64()
+	}
+	if r.MinMemory != "" {
+		q, err := resource.ParseQuantity(r.MinMemory)
+		if err != nil {
+			return policy, fmt.Errorf("invalid minMemory %q: %w", r.MinMemory, err)
+		}
+		policy.MinMemory = q.Value()
+	}
+	if r.OverProvisionedThreshold != nil {
+		policy.OverProvisionedThreshold = *r.OverProvisionedThreshold
+	}
+	if r.UnderProvisionedThreshold != nil {
+		policy.UnderProvisionedThreshold = *r.UnderProvisionedThreshold
+	}
+
+	if policy.WindowDays <= 0 {
+		return policy, fmt.Errorf("windowDays must be positive, got %d", policy.WindowDays)
+	}
+	if policy.Percentile <= 0 || policy.Percentile > 1 {
+		return policy, fmt.Errorf("percentile must be in (0, 1], got %g", policy.Percentile)
+	}
+	if policy.Buffer < 0 {
+		return policy, fmt.Errorf("buffer must not be negative, got %g", policy.Buffer)
+	}
+
+	return policy, nil
+}
@@ -26,6 +26,16 @@ func NewDB(connectionString string) (*DB, error) {
 
 func (db *DB) InitSchema() error {
 	schema := `
+	CREATE TABLE IF NOT EXISTS workloads (
+		id SERIAL PRIMARY KEY,
+		namespace VARCHAR(255) NOT NULL,
+		kind VARCHAR(64) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(namespace, kind, name)
+	);
+
 	CREATE TABLE IF NOT EXISTS pods (
 		id SERIAL PRIMARY KEY,
 		namespace VARCHAR(255) NOT NULL,
@@ -91,7 +101,7 @@ func (db *DB) InitSchema() error {
 
 	CREATE TABLE IF NOT EXISTS recommendations (
 		id SERIAL PRIMARY KEY,
-		analysis_id INTEGER REFERENCES analyses(id) ON DELETE CASCADE,
+		analysis_id INTEGER REFERENCES analyses(id) ON DELETE SET NULL,
 		namespace VARCHAR(255),
 		pod_name VARCHAR(255),
 		container_name VARCHAR(255),
@@ -107,8 +117,264 @@ func (db *DB) InitSchema() error {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
+	CREATE TABLE IF NOT EXISTS oom_kills (
+		id SERIAL PRIMARY KEY,
+		container_id INTEGER REFERENCES containers(id) ON DELETE CASCADE,
+		finished_at TIMESTAMP NOT NULL,
+		memory_request BIGINT,
+		memory_limit BIGINT,
+		UNIQUE(container_id, finished_at)
+	);
+
+	CREATE TABLE IF NOT EXISTS container_statuses (
+		id SERIAL PRIMARY KEY,
+		container_id INTEGER REFERENCES containers(id) ON DELETE CASCADE,
+		restart_count INTEGER NOT NULL DEFAULT 0,
+		ready BOOLEAN,
+		state VARCHAR(50),
+		state_reason VARCHAR(255),
+		last_termination_reason VARCHAR(255),
+		last_exit_code INTEGER,
+		last_started_at TIMESTAMP,
+		last_finished_at TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(container_id)
+	);
+
+	ALTER TABLE pods ADD COLUMN IF NOT EXISTS workload_id INTEGER REFERENCES workloads(id) ON DELETE SET NULL;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS workload_id INTEGER REFERENCES workloads(id) ON DELETE CASCADE;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS workload_kind VARCHAR(64);
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS workload_name VARCHAR(255);
+	ALTER TABLE metrics_snapshots ADD COLUMN IF NOT EXISTS cpu_throttled_ratio DOUBLE PRECISION;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS p95_cpu_throttled DOUBLE PRECISION;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS current_cpu_limit DOUBLE PRECISION;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS recommended_cpu_limit DOUBLE PRECISION;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS recommended_cpu_limit DOUBLE PRECISION;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS current_mem_limit BIGINT;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS recommended_memory_limit BIGINT;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS limit_policy VARCHAR(64);
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS current_cpu_limit DOUBLE PRECISION;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS current_memory_limit BIGINT;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS recommended_memory_limit BIGINT;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS policy VARCHAR(255);
+	ALTER TABLE workloads ADD COLUMN IF NOT EXISTS excluded BOOLEAN DEFAULT false;
+	ALTER TABLE workloads ADD COLUMN IF NOT EXISTS override_percentile DOUBLE PRECISION;
+	ALTER TABLE workloads ADD COLUMN IF NOT EXISTS override_buffer DOUBLE PRECISION;
+	ALTER TABLE workloads ADD COLUMN IF NOT EXISTS override_min_cpu DOUBLE PRECISION;
+	ALTER TABLE workloads ADD COLUMN IF NOT EXISTS override_min_memory BIGINT;
+	ALTER TABLE containers ADD COLUMN IF NOT EXISTS excluded BOOLEAN DEFAULT false;
+	CREATE TABLE IF NOT EXISTS analysis_segments (
+		id SERIAL PRIMARY KEY,
+		analysis_id INTEGER REFERENCES analyses(id) ON DELETE CASCADE,
+		cpu_request DOUBLE PRECISION,
+		mem_request BIGINT,
+		start_at TIMESTAMP NOT NULL,
+		end_at TIMESTAMP NOT NULL,
+		samples INTEGER NOT NULL,
+		p95_cpu DOUBLE PRECISION,
+		p95_memory BIGINT
+	);
+
+	CREATE TABLE IF NOT EXISTS metrics_hourly (
+		container_id INTEGER REFERENCES containers(id) ON DELETE CASCADE,
+		bucket TIMESTAMP NOT NULL,
+		samples INTEGER NOT NULL,
+		avg_cpu DOUBLE PRECISION,
+		max_cpu DOUBLE PRECISION,
+		p95_cpu DOUBLE PRECISION,
+		avg_memory BIGINT,
+		max_memory BIGINT,
+		p95_memory BIGINT,
+		p95_throttled DOUBLE PRECISION,
+		PRIMARY KEY(container_id, bucket)
+	);
+
+	CREATE TABLE IF NOT EXISTS metrics_daily (
+		container_id INTEGER REFERENCES containers(id) ON DELETE CASCADE,
+		bucket TIMESTAMP NOT NULL,
+		samples INTEGER NOT NULL,
+		avg_cpu DOUBLE PRECISION,
+		max_cpu DOUBLE PRECISION,
+		p95_cpu DOUBLE PRECISION,
+		avg_memory BIGINT,
+		max_memory BIGINT,
+		p95_memory BIGINT,
+		p95_throttled DOUBLE PRECISION,
+		PRIMARY KEY(container_id, bucket)
+	);
+
+	CREATE TABLE IF NOT EXISTS usage_histograms (
+		container_id INTEGER REFERENCES containers(id) ON DELETE CASCADE,
+		day TIMESTAMP NOT NULL,
+		first_at TIMESTAMP NOT NULL,
+		last_at TIMESTAMP NOT NULL,
+		samples INTEGER NOT NULL,
+		cpu_sum DOUBLE PRECISION NOT NULL,
+		max_cpu DOUBLE PRECISION NOT NULL,
+		memory_sum DOUBLE PRECISION NOT NULL,
+		max_memory BIGINT NOT NULL,
+		cpu_buckets JSONB NOT NULL,
+		memory_buckets JSONB NOT NULL,
+		throttled_buckets JSONB NOT NULL,
+		PRIMARY KEY(container_id, day)
+	);
+
+	CREATE TABLE IF NOT EXISTS recommendation_events (
+		id SERIAL PRIMARY KEY,
+		recommendation_id INTEGER REFERENCES recommendations(id) ON DELETE CASCADE,
+		from_state VARCHAR(20) NOT NULL,
+		to_state VARCHAR(20) NOT NULL,
+		actor VARCHAR(255) NOT NULL,
+		reason TEXT,
+		snoozed_until TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS recommendation_applies (
+		id SERIAL PRIMARY KEY,
+		recommendation_id INTEGER REFERENCES recommendations(id) ON DELETE CASCADE,
+		actor VARCHAR(255) NOT NULL,
+		namespace VARCHAR(255) NOT NULL,
+		workload_kind VARCHAR(64) NOT NULL,
+		workload_name VARCHAR(255) NOT NULL,
+		container_name VARCHAR(255) NOT NULL,
+		previous_cpu_request DOUBLE PRECISION,
+		previous_memory_request BIGINT,
+		previous_cpu_limit DOUBLE PRECISION,
+		previous_memory_limit BIGINT,
+		cpu_request DOUBLE PRECISION,
+		memory_request BIGINT,
+		cpu_limit DOUBLE PRECISION,
+		memory_limit BIGINT,
+		resource_version VARCHAR(64),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS verification_restarts (
+		apply_id INTEGER REFERENCES recommendation_applies(id) ON DELETE CASCADE,
+		container_id INTEGER REFERENCES containers(id) ON DELETE CASCADE,
+		restart_count INTEGER NOT NULL,
+		PRIMARY KEY(apply_id, container_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS rollup_state (
+		resolution VARCHAR(16) PRIMARY KEY,
+		rolled_until TIMESTAMP NOT NULL
+	);
+
+	ALTER TABLE pods ADD COLUMN IF NOT EXISTS first_seen_at TIMESTAMP;
+	ALTER TABLE pods ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP;
+	ALTER TABLE pods ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+	ALTER TABLE pods ADD COLUMN IF NOT EXISTS backfilled BOOLEAN NOT NULL DEFAULT false;
+	UPDATE pods SET first_seen_at = created_at, last_seen_at = updated_at WHERE first_seen_at IS NULL;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS requests_changed_at TIMESTAMP;
+	ALTER TABLE usage_histograms ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS container_name VARCHAR(255);
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS is_current BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS workload_id INTEGER REFERENCES workloads(id) ON DELETE CASCADE;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS superseded_at TIMESTAMP;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS state VARCHAR(20) NOT NULL DEFAULT 'open';
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS state_changed_at TIMESTAMP;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS state_actor VARCHAR(255);
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS state_reason TEXT;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS snoozed_until TIMESTAMP;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS stable_since TIMESTAMP;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS stable_since TIMESTAMP;
+	ALTER TABLE containers ADD COLUMN IF NOT EXISTS container_index INTEGER;
+	ALTER TABLE containers ADD COLUMN IF NOT EXISTS has_requests BOOLEAN;
+	ALTER TABLE containers ADD COLUMN IF NOT EXISTS has_limits BOOLEAN;
+	ALTER TABLE pods ADD COLUMN IF NOT EXISTS resize_status VARCHAR(32);
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS resize_status VARCHAR(32);
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS resize_updated_at TIMESTAMP;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS mode VARCHAR(16) NOT NULL DEFAULT 'workload';
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS rolled_back_at TIMESTAMP;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS rolled_back_by VARCHAR(255);
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS outcome VARCHAR(16);
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS outcome_reason TEXT;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS verify_until TIMESTAMP;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS verified_at TIMESTAMP;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS oom_kills INTEGER;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS restarts INTEGER;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS samples INTEGER;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS p95_cpu DOUBLE PRECISION;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS p95_memory BIGINT;
+	ALTER TABLE recommendation_applies ADD COLUMN IF NOT EXISTS p95_throttled DOUBLE PRECISION;
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS outcome VARCHAR(16);
+	ALTER TABLE recommendations ADD COLUMN IF NOT EXISTS outcome_reason TEXT;
+
+	-- Recommendations and their history outlive the analyses, and so the
+	-- pods, they were made from
+	DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'recommendations_analysis_id_fkey' AND confdeltype = 'c') THEN
+			ALTER TABLE recommendations DROP CONSTRAINT recommendations_analysis_id_fkey;
+			ALTER TABLE recommendations ADD CONSTRAINT recommendations_analysis_id_fkey
+				FOREIGN KEY (analysis_id) REFERENCES analyses(id) ON DELETE SET NULL;
+		END IF;
+	END $$;
+
+	-- Every run used to add an analysis and a recommendation; mark the latest
+	-- of each workload container current and supersede the rest
+	UPDATE analyses a SET container_name = c.container_name
+	FROM containers c
+	WHERE c.id = a.container_id AND a.container_name IS NULL;
+	UPDATE analyses SET is_current = true
+	WHERE id IN (
+		SELECT DISTINCT ON (workload_id, container_name) id
+		FROM analyses
+		WHERE workload_id IS NOT NULL
+		ORDER BY workload_id, container_name, analyzed_at DESC, id DESC
+	) AND NOT EXISTS (SELECT 1 FROM analyses WHERE is_current);
+	UPDATE recommendations r SET workload_id = a.workload_id
+	FROM analyses a
+	WHERE a.id = r.analysis_id AND r.workload_id IS NULL;
+	UPDATE recommendations SET superseded_at = created_at, state = 'superseded', state_changed_at = created_at
+	WHERE state NOT IN ('superseded', 'expired') AND (workload_id IS NULL OR id NOT IN (
+		SELECT DISTINCT ON (workload_id, container_name) id
+		FROM recommendations
+		WHERE state NOT IN ('superseded', 'expired') AND workload_id IS NOT NULL
+		ORDER BY workload_id, container_name, created_at DESC, id DESC
+	));
+	UPDATE recommendations SET state = 'superseded', state_changed_at = superseded_at
+	WHERE superseded_at IS NOT NULL AND state <> 'superseded';
+	UPDATE recommendations SET state = 'applied', state_changed_at = COALESCE(updated_at, created_at)
+	WHERE applied AND state = 'open';
+	UPDATE recommendations SET stable_since = created_at WHERE stable_since IS NULL;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS cpu_request_change_percent DOUBLE PRECISION;
+	ALTER TABLE analyses ADD COLUMN IF NOT EXISTS memory_request_change_percent DOUBLE PRECISION;
+
+	-- resource_requests used to grow a row per collection; keep only changes
+	DELETE FROM resource_requests WHERE id IN (
+		SELECT id FROM (
+			SELECT id,
+				ROW_NUMBER() OVER w AS n,
+				cpu_request IS NOT DISTINCT FROM LAG(cpu_request) OVER w
+					AND cpu_limit IS NOT DISTINCT FROM LAG(cpu_limit) OVER w
+					AND mem_request IS NOT DISTINCT FROM LAG(mem_request) OVER w
+					AND mem_limit IS NOT DISTINCT FROM LAG(mem_limit) OVER w AS unchanged
+			FROM resource_requests
+			WINDOW w AS (PARTITION BY container_id ORDER BY updated_at, id)
+		) h
+		WHERE n > 1 AND unchanged
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_pods_namespace ON pods(namespace);
+	CREATE INDEX IF NOT EXISTS idx_pods_workload ON pods(workload_id);
+	CREATE INDEX IF NOT EXISTS idx_pods_deleted ON pods(deleted_at);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_resource_requests_container ON resource_requests(container_id, updated_at);
+	CREATE INDEX IF NOT EXISTS idx_analysis_segments_analysis ON analysis_segments(analysis_id);
+	CREATE INDEX IF NOT EXISTS idx_analyses_workload ON analyses(workload_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_analyses_current ON analyses(workload_id, container_name) WHERE is_current;
+	DROP INDEX IF EXISTS idx_recommendations_live;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_recommendations_active ON recommendations(workload_id, container_name) WHERE state NOT IN ('superseded', 'expired');
+	CREATE INDEX IF NOT EXISTS idx_recommendations_state ON recommendations(state);
+	CREATE INDEX IF NOT EXISTS idx_recommendation_events_recommendation ON recommendation_events(recommendation_id);
+	CREATE INDEX IF NOT EXISTS idx_recommendation_applies_recommendation ON recommendation_applies(recommendation_id);
+	CREATE INDEX IF NOT EXISTS idx_recommendation_applies_outcome ON recommendation_applies(outcome);
 	CREATE INDEX IF NOT EXISTS idx_metrics_timestamp ON metrics_snapshots(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_metrics_hourly_bucket ON metrics_hourly(bucket);
+	CREATE INDEX IF NOT EXISTS idx_metrics_daily_bucket ON metrics_daily(bucket);
+	CREATE INDEX IF NOT EXISTS idx_usage_histograms_day ON usage_histograms(day);
 	CREATE INDEX IF NOT EXISTS idx_analyses_status ON analyses(status);
 	CREATE INDEX IF NOT EXISTS idx_recommendations_applied ON recommendations(applied);
 	`
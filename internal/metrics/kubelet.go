@@ -0,0 +1,252 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// KubeletSource reads usage from each node's kubelet /stats/summary endpoint
+// and CPU throttling from its /metrics/cadvisor endpoint, both reached through
+// the API server node proxy.
+type KubeletSource struct {
+	client    rest.Interface
+	nodes     corelisters.NodeLister
+	namespace string
+
+	// CFS counters from the previous scrape, to turn them into a ratio
+	mu      sync.Mutex
+	lastCFS map[ContainerKey]cfsCounters
+}
+
+type cfsCounters struct {
+	periods   float64
+	throttled float64
+}
+
+// NewKubeletSource creates a source that scrapes every node known to the lister.
+// client is a core/v1 REST client, e.g. clientset.CoreV1().RESTClient().
+func NewKubeletSource(client rest.Interface, nodes corelisters.NodeLister, namespace string) *KubeletSource {
+	return &KubeletSource{
+		client:    client,
+		nodes:     nodes,
+		namespace: namespace,
+		lastCFS:   make(map[ContainerKey]cfsCounters),
+	}
+}
+
+func (s *KubeletSource) Name() string {
+	return "kubelet"
+}
+
+// kubeletSummary is the subset of the kubelet stats/v1alpha1 Summary API we use.
+type kubeletSummary struct {
+	Pods []struct {
+		PodRef struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"podRef"`
+		Containers []struct {
+			Name string `json:"name"`
+			CPU  *struct {
+				UsageNanoCores *uint64 `json:"usageNanoCores"`
+			} `json:"cpu"`
+			Memory *struct {
+				WorkingSetBytes *uint64 `json:"workingSetBytes"`
+			} `json:"memory"`
+		} `json:"containers"`
+	} `json:"pods"`
+}
+
+// Collect scrapes all nodes. Nodes that fail are skipped; an error is only
+// returned when no node could be scraped.
+func (s *KubeletSource) Collect(ctx context.Context) (map[ContainerKey]Usage, error) {
+	nodes, err := s.nodes.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := make(map[ContainerKey]Usage)
+	cfs := make(map[ContainerKey]cfsCounters)
+	var lastErr error
+	scraped := 0
+	for _, node := range nodes {
+		summary, err := s.summary(ctx, node.Name)
+		if err != nil {
+			lastErr = fmt.Errorf("node %s: %w", node.Name, err)
+			continue
+		}
+		scraped++
+
+		for _, pod := range summary.Pods {
+			if s.namespace != "" && pod.PodRef.Namespace != s.namespace {
+				continue
+			}
+			for _, container := range pod.Containers {
+				var u Usage
+				if container.CPU != nil && container.CPU.UsageNanoCores != nil {
+					u.CPU = float64(*container.CPU.UsageNanoCores) / 1e9
+				}
+				if container.Memory != nil && container.Memory.WorkingSetBytes != nil {
+					u.Memory = int64(*container.Memory.WorkingSetBytes)
+				}
+				key := ContainerKey{Namespace: pod.PodRef.Namespace, Pod: pod.PodRef.Name, Container: container.Name}
+				usage[key] = u
+			}
+		}
+
+		// Throttling is best effort; usage is still valid without it
+		counters, err := s.cadvisorCFS(ctx, node.Name)
+		if err != nil {
+			continue
+		}
+		for key, c := range counters {
+			cfs[key] = c
+		}
+	}
+
+	for key, current := range cfs {
+		u, ok := usage[key]
+		if !ok {
+			continue
+		}
+		previous, ok := s.lastCFS[key]
+		periods := current.periods - previous.periods
+		if !ok || periods <= 0 {
+			continue
+		}
+		u.ThrottledRatio = (current.throttled - previous.throttled) / periods
+		u.HasThrottling = true
+		usage[key] = u
+	}
+	s.lastCFS = cfs
+
+	if scraped == 0 && lastErr != nil {
+		return nil, fmt.Errorf("failed to scrape kubelet stats: %w", lastErr)
+	}
+
+	return usage, nil
+}
+
+func (s *KubeletSource) summary(ctx context.Context, node string) (*kubeletSummary, error) {
+	body, err := s.client.Get().
+		Resource("nodes").
+		Name(node).
+		SubResource("proxy").
+		Suffix("stats/summary").
+		DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var summary kubeletSummary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		return nil, fmt.Errorf("failed to decode stats summary: %w", err)
+	}
+	return &summary, nil
+}
+
+// cadvisorCFS scrapes the node's cAdvisor metrics for cumulative CFS period counters.
+func (s *KubeletSource) cadvisorCFS(ctx context.Context, node string) (map[ContainerKey]cfsCounters, error) {
+	body, err := s.client.Get().
+		Resource("nodes").
+		Name(node).
+		SubResource("proxy").
+		Suffix("metrics/cadvisor").
+		DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[ContainerKey]cfsCounters)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		name, labelSet, value, ok := parseExpositionLine(scanner.Text())
+		if !ok || (name != "container_cpu_cfs_periods_total" && name != "container_cpu_cfs_throttled_periods_total") {
+			continue
+		}
+
+		key := ContainerKey{Namespace: labelSet["namespace"], Pod: labelSet["pod"], Container: labelSet["container"]}
+		if key.Container == "" || key.Container == "POD" {
+			continue
+		}
+		if s.namespace != "" && key.Namespace != s.namespace {
+			continue
+		}
+
+		c := counters[key]
+		if name == "container_cpu_cfs_periods_total" {
+			c.periods = value
+		} else {
+			c.throttled = value
+		}
+		counters[key] = c
+	}
+
+	return counters, scanner.Err()
+}
+
+// parseExpositionLine parses a Prometheus text exposition sample line of the
+// form name{label="value",...} value [timestamp].
+func parseExpositionLine(line string) (string, map[string]string, float64, bool) {
+	if line == "" || line[0] == '#' {
+		return "", nil, 0, false
+	}
+
+	lbrace := strings.IndexByte(line, '{')
+	rbrace := strings.LastIndexByte(line, '}')
+	if lbrace < 0 || rbrace < lbrace {
+		return "", nil, 0, false
+	}
+
+	fields := strings.Fields(line[rbrace+1:])
+	if len(fields) == 0 {
+		return "", nil, 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, false
+	}
+
+	labelSet := make(map[string]string)
+	pairs := line[lbrace+1 : rbrace]
+	for pairs != "" {
+		eq := strings.IndexByte(pairs, '=')
+		if eq < 0 || eq+1 >= len(pairs) || pairs[eq+1] != '"' {
+			break
+		}
+		name := strings.TrimSpace(pairs[:eq])
+
+		// Find the closing quote, skipping escaped characters
+		var sb strings.Builder
+		i := eq + 2
+		for ; i < len(pairs) && pairs[i] != '"'; i++ {
+			if pairs[i] == '\\' && i+1 < len(pairs) {
+				i++
+				if pairs[i] == 'n' {
+					sb.WriteByte('\n')
+					continue
+				}
+			}
+			sb.WriteByte(pairs[i])
+		}
+		labelSet[name] = sb.String()
+
+		pairs = strings.TrimLeft(pairs[min(i+1, len(pairs)):], ", ")
+	}
+
+	return line[:lbrace], labelSet, value, true
+}
@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseExpositionLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		name   string
+		labels map[string]string
+		value  float64
+		ok     bool
+	}{
+		{
+			line:   `container_cpu_cfs_periods_total{container="app",namespace="shop",pod="web-1"} 1200 1700000000000`,
+			name:   "container_cpu_cfs_periods_total",
+			labels: map[string]string{"container": "app", "namespace": "shop", "pod": "web-1"},
+			value:  1200,
+			ok:     true,
+		},
+		{
+			line:   `metric{path="a\"b\\c",desc="line\nbreak", empty=""} 1.5e3`,
+			name:   "metric",
+			labels: map[string]string{"path": `a"b\c`, "desc": "line\nbreak", "empty": ""},
+			value:  1500,
+			ok:     true,
+		},
+		{line: "# HELP container_cpu_cfs_periods_total Number of elapsed periods."},
+		{line: ""},
+		{line: "metric_without_labels 1"},
+		{line: `metric{a="b"}`},
+		{line: `metric{a="b"} not-a-number`},
+	}
+
+	for _, tt := range tests {
+		name, labels, value, ok := parseExpositionLine(tt.line)
+		if ok != tt.ok {
+			t.Errorf("%q: ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if name != tt.name || value != tt.value {
+			t.Errorf("%q: got %s %v, want %s %v", tt.line, name, value, tt.name, tt.value)
+		}
+		if len(labels) != len(tt.labels) {
+			t.Errorf("%q: got labels %v, want %v", tt.line, labels, tt.labels)
+		}
+		for k, v := range tt.labels {
+			if labels[k] != v {
+				t.Errorf("%q: label %s = %q, want %q", tt.line, k, labels[k], v)
+			}
+		}
+	}
+}
+
+// fakeKubelet serves the node proxy endpoints of node-1; cadvisor returns
+// the next body of each scrape.
+func fakeKubelet(t *testing.T, summary string, cadvisor []string) *httptest.Server {
+	t.Helper()
+	scrapes := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/nodes/node-1/proxy/stats/summary":
+			fmt.Fprint(w, summary)
+		case "/api/v1/nodes/node-1/proxy/metrics/cadvisor":
+			fmt.Fprint(w, cadvisor[min(scrapes, len(cadvisor)-1)])
+			scrapes++
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func kubeletSource(t *testing.T, server *httptest.Server, namespace string, nodes ...string) *KubeletSource {
+	t.Helper()
+	client, err := rest.RESTClientFor(&rest.Config{
+		Host: server.URL,
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &schema.GroupVersion{Version: "v1"},
+			NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		},
+		APIPath: "/api",
+	})
+	if err != nil {
+		t.Fatalf("RESTClientFor: %v", err)
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range nodes {
+		if err := indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewKubeletSource(client, corelisters.NewNodeLister(indexer), namespace)
+}
+
+const kubeletSummaryJSON = `{"pods":[
+	{"podRef":{"name":"web-1","namespace":"shop"},"containers":[
+		{"name":"app","cpu":{"usageNanoCores":250000000},"memory":{"workingSetBytes":104857600}},
+		{"name":"sidecar","cpu":{},"memory":null}
+	]},
+	{"podRef":{"name":"dns","namespace":"kube-system"},"containers":[
+		{"name":"coredns","cpu":{"usageNanoCores":1000000},"memory":{"workingSetBytes":1048576}}
+	]}
+]}`
+
+func cadvisorBody(periods, throttled int) string {
+	return strings.Join([]string{
+		"# TYPE container_cpu_cfs_periods_total counter",
+		fmt.Sprintf(`container_cpu_cfs_periods_total{container="app",namespace="shop",pod="web-1"} %d`, periods),
+		fmt.Sprintf(`container_cpu_cfs_throttled_periods_total{container="app",namespace="shop",pod="web-1"} %d`, throttled),
+		`container_cpu_cfs_periods_total{container="POD",namespace="shop",pod="web-1"} 5`,
+		`container_memory_working_set_bytes{container="app",namespace="shop",pod="web-1"} 1`,
+	}, "\n")
+}
+
+func TestKubeletCollect(t *testing.T) {
+	server := fakeKubelet(t, kubeletSummaryJSON, []string{cadvisorBody(100, 10), cadvisorBody(300, 60)})
+	defer server.Close()
+	source := kubeletSource(t, server, "shop", "node-1")
+
+	usage, err := source.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	app := ContainerKey{Namespace: "shop", Pod: "web-1", Container: "app"}
+	if got, want := usage[app], (Usage{CPU: 0.25, Memory: 100 << 20}); got != want {
+		t.Errorf("first scrape: got %+v, want %+v without throttling", got, want)
+	}
+	if got, want := usage[ContainerKey{Namespace: "shop", Pod: "web-1", Container: "sidecar"}], (Usage{}); got != want {
+		t.Errorf("sidecar without stats: got %+v, want %+v", got, want)
+	}
+	if len(usage) != 2 {
+		t.Errorf("got %d containers, want the 2 of the namespace: %v", len(usage), usage)
+	}
+
+	// Throttling is the ratio of the counter deltas between scrapes
+	usage, err = source.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if got, want := usage[app], (Usage{CPU: 0.25, Memory: 100 << 20, ThrottledRatio: 0.25, HasThrottling: true}); got != want {
+		t.Errorf("second scrape: got %+v, want %+v", got, want)
+	}
+}
+
+func TestKubeletCollectSkipsFailedNodes(t *testing.T) {
+	server := fakeKubelet(t, kubeletSummaryJSON, []string{cadvisorBody(100, 10)})
+	defer server.Close()
+
+	usage, err := kubeletSource(t, server, "", "node-1", "node-2").Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if len(usage) != 3 {
+		t.Errorf("got %d containers, want the 3 of node-1: %v", len(usage), usage)
+	}
+
+	if _, err := kubeletSource(t, server, "", "node-2").Collect(context.Background()); err == nil {
+		t.Error("got no error when no node could be scraped")
+	}
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metricsv1beta1 "k8s.io/metrics/pkg/client/clientset/versioned"
+)
+
+// MetricsServerSource reads usage from the metrics.k8s.io API served by metrics-server.
+type MetricsServerSource struct {
+	client    metricsv1beta1.Interface
+	namespace string
+}
+
+// NewMetricsServerSource creates a source for the given namespace (empty for all).
+func NewMetricsServerSource(client metricsv1beta1.Interface, namespace string) *MetricsServerSource {
+	return &MetricsServerSource{client: client, namespace: namespace}
+}
+
+func (s *MetricsServerSource) Name() string {
+	return "metrics-server"
+}
+
+func (s *MetricsServerSource) Collect(ctx context.Context) (map[ContainerKey]Usage, error) {
+	list, err := s.client.MetricsV1beta1().PodMetricses(s.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pod metrics: %w", err)
+	}
+
+	usage := make(map[ContainerKey]Usage)
+	for _, pm := range list.Items {
+		for _, cm := range pm.Containers {
+			key := ContainerKey{Namespace: pm.Namespace, Pod: pm.Name, Container: cm.Name}
+			usage[key] = Usage{
+				CPU:    float64(cm.Usage.Cpu().MilliValue()) / 1000.0,
+				Memory: cm.Usage.Memory().Value(),
+			}
+		}
+	}
+
+	return usage, nil
+}
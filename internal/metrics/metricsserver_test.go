@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metricsapi "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	"k8s.io/metrics/pkg/client/clientset/versioned/fake"
+)
+
+func podMetrics(namespace, name string, containers ...metricsapi.ContainerMetrics) *metricsapi.PodMetrics {
+	return &metricsapi.PodMetrics{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Containers: containers,
+	}
+}
+
+func containerMetrics(name, cpu, memory string) metricsapi.ContainerMetrics {
+	return metricsapi.ContainerMetrics{
+		Name: name,
+		Usage: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(memory),
+		},
+	}
+}
+
+func TestMetricsServerCollect(t *testing.T) {
+	// The fake lists pod metrics as the "pods" resource, which the object
+	// tracker does not guess for PodMetrics
+	client := fake.NewSimpleClientset()
+	gvr := metricsapi.SchemeGroupVersion.WithResource("pods")
+	for _, pm := range []*metricsapi.PodMetrics{
+		podMetrics("shop", "web-1", containerMetrics("app", "250m", "100Mi"), containerMetrics("sidecar", "5m", "16Mi")),
+		podMetrics("kube-system", "dns", containerMetrics("coredns", "1m", "8Mi")),
+	} {
+		if err := client.Tracker().Create(gvr, pm, pm.Namespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := NewMetricsServerSource(client, "").Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	want := map[ContainerKey]Usage{
+		{Namespace: "shop", Pod: "web-1", Container: "app"}:          {CPU: 0.25, Memory: 100 << 20},
+		{Namespace: "shop", Pod: "web-1", Container: "sidecar"}:      {CPU: 0.005, Memory: 16 << 20},
+		{Namespace: "kube-system", Pod: "dns", Container: "coredns"}: {CPU: 0.001, Memory: 8 << 20},
+	}
+	if len(usage) != len(want) {
+		t.Fatalf("got %d containers, want %d: %v", len(usage), len(want), usage)
+	}
+	for key, w := range want {
+		if got := usage[key]; got != w {
+			t.Errorf("%v: got %+v, want %+v", key, got, w)
+		}
+	}
+
+	usage, err = NewMetricsServerSource(client, "shop").Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if len(usage) != 2 {
+		t.Errorf("got %d containers, want the 2 of the namespace: %v", len(usage), usage)
+	}
+}
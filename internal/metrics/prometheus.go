@@ -0,0 +1,259 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrometheusSource reads cAdvisor container metrics through the Prometheus HTTP API.
+type PrometheusSource struct {
+	baseURL   string
+	namespace string
+	client    *http.Client
+}
+
+// NewPrometheusSource creates a source querying the Prometheus server at baseURL,
+// restricted to the given namespace (empty for all).
+func NewPrometheusSource(baseURL, namespace string, client *http.Client) *PrometheusSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &PrometheusSource{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		namespace: namespace,
+		client:    client,
+	}
+}
+
+func (s *PrometheusSource) Name() string {
+	return "prometheus"
+}
+
+func (s *PrometheusSource) Collect(ctx context.Context) (map[ContainerKey]Usage, error) {
+	selector := s.containerSelector()
+
+	cpu, err := s.query(ctx, fmt.Sprintf(
+		`sum by (namespace, pod, container) (rate(container_cpu_usage_seconds_total{%s}[5m]))`, selector))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cpu usage: %w", err)
+	}
+
+	mem, err := s.query(ctx, fmt.Sprintf(
+		`max by (namespace, pod, container) (container_memory_working_set_bytes{%s})`, selector))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query memory usage: %w", err)
+	}
+
+	throttled, err := s.query(ctx, fmt.Sprintf(
+		`sum by (namespace, pod, container) (rate(container_cpu_cfs_throttled_periods_total{%[1]s}[5m]))
+		 / sum by (namespace, pod, container) (rate(container_cpu_cfs_periods_total{%[1]s}[5m]))`, selector))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cpu throttling: %w", err)
+	}
+
+	usage := make(map[ContainerKey]Usage)
+	for _, sample := range cpu {
+		u := usage[sample.key()]
+		u.CPU = sample.value
+		usage[sample.key()] = u
+	}
+	for _, sample := range mem {
+		u := usage[sample.key()]
+		u.Memory = int64(sample.value)
+		usage[sample.key()] = u
+	}
+	for _, sample := range throttled {
+		u, ok := usage[sample.key()]
+		if !ok || math.IsNaN(sample.value) {
+			continue
+		}
+		u.ThrottledRatio = sample.value
+		u.HasThrottling = true
+		usage[sample.key()] = u
+	}
+
+	return usage, nil
+}
+
+// maxRangePoints is Prometheus' limit on points per series in a range query.
+const maxRangePoints = 11000
+
+// History replays past usage through range queries, keyed by the container
+// of every pod that matched the query.
+func (s *PrometheusSource) History(ctx context.Context, q HistoryQuery) (map[ContainerKey][]Sample, error) {
+	step := q.Step
+	if minStep := q.End.Sub(q.Start) / maxRangePoints; step < minStep {
+		step = minStep
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+
+	selector := fmt.Sprintf(`namespace=%q,pod=~%q,container=%q`, q.Namespace, q.PodPattern, q.Container)
+
+	cpu, err := s.queryRange(ctx, fmt.Sprintf(
+		`sum by (namespace, pod, container) (rate(container_cpu_usage_seconds_total{%s}[5m]))`, selector), q.Start, q.End, step)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cpu history: %w", err)
+	}
+
+	mem, err := s.queryRange(ctx, fmt.Sprintf(
+		`max by (namespace, pod, container) (container_memory_working_set_bytes{%s})`, selector), q.Start, q.End, step)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query memory history: %w", err)
+	}
+
+	// Join both series on timestamp; points missing either value are dropped
+	history := make(map[ContainerKey][]Sample)
+	for key, cpuPoints := range cpu {
+		memPoints := mem[key]
+		for ts, cpuValue := range cpuPoints {
+			memValue, ok := memPoints[ts]
+			if !ok {
+				continue
+			}
+			history[key] = append(history[key], Sample{
+				Timestamp: time.Unix(ts, 0),
+				Usage:     Usage{CPU: cpuValue, Memory: int64(memValue)},
+			})
+		}
+	}
+	for key := range history {
+		samples := history[key]
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+	}
+
+	return history, nil
+}
+
+// queryRange runs a range query and returns each series' points keyed by unix second.
+func (s *PrometheusSource) queryRange(ctx context.Context, q string, start, end time.Time, step time.Duration) (map[ContainerKey]map[int64]float64, error) {
+	resp, err := s.get(ctx, "/api/v1/query_range", url.Values{
+		"query": {q},
+		"start": {strconv.FormatInt(start.Unix(), 10)},
+		"end":   {strconv.FormatInt(end.Unix(), 10)},
+		"step":  {strconv.FormatFloat(step.Seconds(), 'f', -1, 64)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[ContainerKey]map[int64]float64, len(resp.Data.Result))
+	for _, r := range resp.Data.Result {
+		key := promSample{labels: r.Metric}.key()
+		points := make(map[int64]float64, len(r.Values))
+		for _, pair := range r.Values {
+			ts, value, err := parsePromValue(pair)
+			if err != nil {
+				return nil, err
+			}
+			points[int64(ts)] = value
+		}
+		series[key] = points
+	}
+	return series, nil
+}
+
+// containerSelector matches real containers, excluding the pod sandbox and
+// cgroup aggregates cAdvisor reports with an empty container label.
+func (s *PrometheusSource) containerSelector() string {
+	selector := `container!="",container!="POD"`
+	if s.namespace != "" {
+		selector += fmt.Sprintf(`,namespace=%q`, s.namespace)
+	}
+	return selector
+}
+
+type promSample struct {
+	labels map[string]string
+	value  float64
+}
+
+func (p promSample) key() ContainerKey {
+	return ContainerKey{
+		Namespace: p.labels["namespace"],
+		Pod:       p.labels["pod"],
+		Container: p.labels["container"],
+	}
+}
+
+type promResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string    `json:"metric"`
+			Value  [2]json.RawMessage   `json:"value"`
+			Values [][2]json.RawMessage `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// query runs an instant query and returns the resulting vector.
+func (s *PrometheusSource) query(ctx context.Context, q string) ([]promSample, error) {
+	resp, err := s.get(ctx, "/api/v1/query", url.Values{"query": {q}})
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]promSample, 0, len(resp.Data.Result))
+	for _, r := range resp.Data.Result {
+		_, value, err := parsePromValue(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, promSample{labels: r.Metric, value: value})
+	}
+	return samples, nil
+}
+
+func (s *PrometheusSource) get(ctx context.Context, path string, params url.Values) (*promResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var resp promResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode prometheus response (HTTP %d): %w", res.StatusCode, err)
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("prometheus query failed (HTTP %d): %s", res.StatusCode, resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// parsePromValue decodes a [<unix seconds>, "<value>"] pair.
+func parsePromValue(pair [2]json.RawMessage) (float64, float64, error) {
+	var ts float64
+	if err := json.Unmarshal(pair[0], &ts); err != nil {
+		return 0, 0, fmt.Errorf("invalid sample timestamp: %w", err)
+	}
+
+	var raw string
+	if err := json.Unmarshal(pair[1], &raw); err != nil {
+		return 0, 0, fmt.Errorf("invalid sample value: %w", err)
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid sample value %q: %w", raw, err)
+	}
+
+	return ts, value, nil
+}
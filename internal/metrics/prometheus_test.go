@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePrometheus serves canned query results, picked by the first entry of
+// responses whose key is a substring of the query.
+func fakePrometheus(t *testing.T, path string, responses map[string]string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			t.Errorf("unexpected path %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query().Get("query")
+		for match, body := range responses {
+			if strings.Contains(query, match) {
+				fmt.Fprint(w, body)
+				return
+			}
+		}
+		t.Errorf("unexpected query %s", query)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":"error","error":"unexpected query"}`)
+	}))
+}
+
+func vector(samples ...string) string {
+	return `{"status":"success","data":{"resultType":"vector","result":[` + strings.Join(samples, ",") + `]}}`
+}
+
+func TestPrometheusCollect(t *testing.T) {
+	server := fakePrometheus(t, "/api/v1/query", map[string]string{
+		"container_cpu_cfs_throttled_periods_total": vector(
+			`{"metric":{"namespace":"shop","pod":"web-1","container":"app"},"value":[1700000000,"0.25"]}`,
+			`{"metric":{"namespace":"shop","pod":"web-2","container":"app"},"value":[1700000000,"NaN"]}`,
+			`{"metric":{"namespace":"shop","pod":"gone","container":"app"},"value":[1700000000,"0.5"]}`,
+		),
+		"container_cpu_usage_seconds_total": vector(
+			`{"metric":{"namespace":"shop","pod":"web-1","container":"app"},"value":[1700000000,"0.5"]}`,
+			`{"metric":{"namespace":"shop","pod":"web-2","container":"app"},"value":[1700000000,"0.125"]}`,
+		),
+		"container_memory_working_set_bytes": vector(
+			`{"metric":{"namespace":"shop","pod":"web-1","container":"app"},"value":[1700000000,"104857600"]}`,
+			`{"metric":{"namespace":"shop","pod":"web-2","container":"app"},"value":[1700000000,"52428800"]}`,
+		),
+	})
+	defer server.Close()
+
+	usage, err := NewPrometheusSource(server.URL+"/", "", server.Client()).Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+
+	want := map[ContainerKey]Usage{
+		{Namespace: "shop", Pod: "web-1", Container: "app"}: {CPU: 0.5, Memory: 100 << 20, ThrottledRatio: 0.25, HasThrottling: true},
+		{Namespace: "shop", Pod: "web-2", Container: "app"}: {CPU: 0.125, Memory: 50 << 20},
+	}
+	if len(usage) != len(want) {
+		t.Fatalf("got %d containers, want %d: %v", len(usage), len(want), usage)
+	}
+	for key, w := range want {
+		if got := usage[key]; got != w {
+			t.Errorf("%v: got %+v, want %+v", key, got, w)
+		}
+	}
+}
+
+func TestPrometheusCollectError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":"error","error":"parse error"}`)
+	}))
+	defer server.Close()
+
+	_, err := NewPrometheusSource(server.URL, "", server.Client()).Collect(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "parse error") {
+		t.Fatalf("got error %v, want the Prometheus error", err)
+	}
+}
+
+func TestPrometheusNamespaceSelector(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+		fmt.Fprint(w, vector())
+	}))
+	defer server.Close()
+
+	if _, err := NewPrometheusSource(server.URL, "shop", server.Client()).Collect(context.Background()); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	for _, q := range queries {
+		if !strings.Contains(q, `namespace="shop"`) || !strings.Contains(q, `container!="POD"`) {
+			t.Errorf("query %q does not select real containers of the namespace", q)
+		}
+	}
+}
+
+func TestPrometheusHistory(t *testing.T) {
+	matrix := func(values string) string {
+		return `{"status":"success","data":{"resultType":"matrix","result":[` +
+			`{"metric":{"namespace":"shop","pod":"web-1","container":"app"},"values":[` + values + `]}]}}`
+	}
+	server := fakePrometheus(t, "/api/v1/query_range", map[string]string{
+		"container_cpu_usage_seconds_total":  matrix(`[1700000120,"0.3"],[1700000000,"0.1"],[1700000060,"0.2"]`),
+		"container_memory_working_set_bytes": matrix(`[1700000000,"1048576"],[1700000120,"3145728"]`),
+	})
+	defer server.Close()
+
+	start := time.Unix(1700000000, 0)
+	history, err := NewPrometheusSource(server.URL, "", server.Client()).History(context.Background(), HistoryQuery{
+		Namespace:  "shop",
+		PodPattern: "web-.*",
+		Container:  "app",
+		Start:      start,
+		End:        start.Add(2 * time.Minute),
+		Step:       time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+
+	// The point without a memory value is dropped; the rest are in order
+	got := history[ContainerKey{Namespace: "shop", Pod: "web-1", Container: "app"}]
+	want := []Sample{
+		{Timestamp: start, Usage: Usage{CPU: 0.1, Memory: 1 << 20}},
+		{Timestamp: start.Add(2 * time.Minute), Usage: Usage{CPU: 0.3, Memory: 3 << 20}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !got[i].Timestamp.Equal(want[i].Timestamp) || got[i].Usage != want[i].Usage {
+			t.Errorf("sample %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPrometheusHistoryStep(t *testing.T) {
+	var steps []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		steps = append(steps, r.URL.Query().Get("step"))
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+	}))
+	defer server.Close()
+
+	// 30 days at a 1s step exceeds the points limit, so the step is raised
+	start := time.Unix(1700000000, 0)
+	_, err := NewPrometheusSource(server.URL, "", server.Client()).History(context.Background(), HistoryQuery{
+		Start: start,
+		End:   start.Add(30 * 24 * time.Hour),
+		Step:  time.Second,
+	})
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	for _, step := range steps {
+		if step == "1" {
+			t.Errorf("step was not raised to the points limit")
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"context"
+	"time"
+)
+
+// ContainerKey identifies a container in the cluster.
+type ContainerKey struct {
+	Namespace string
+	Pod       string
+	Container string
+}
+
+// Usage is a point-in-time resource usage sample for a single container.
+type Usage struct {
+	CPU    float64 // cores
+	Memory int64   // working set bytes
+
+	// ThrottledRatio is the fraction of CFS periods in which the container
+	// was throttled by its CPU limit. HasThrottling is false when the source
+	// cannot report it or the container has no CPU limit.
+	ThrottledRatio float64
+	HasThrottling  bool
+}
+
+// MetricsSource provides current container usage for the cluster.
+type MetricsSource interface {
+	// Name identifies the source in logs and configuration.
+	Name() string
+
+	// Collect returns the latest usage of every container the source knows about.
+	Collect(ctx context.Context) (map[ContainerKey]Usage, error)
+}
+
+// Sample is a usage observation at a point in time.
+type Sample struct {
+	Timestamp time.Time
+	Usage
+}
+
+// HistoryQuery selects past usage of one container across the pods matching
+// PodPattern (a regular expression), e.g. all replicas of a workload.
+type HistoryQuery struct {
+	Namespace  string
+	PodPattern string
+	Container  string
+	Start      time.Time
+	End        time.Time
+	Step       time.Duration
+}
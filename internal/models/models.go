@@ -4,14 +4,24 @@ import (
 	"time"
 )
 
-type Pod struct {
+type Workload struct {
 	ID        int64     `json:"id"`
 	Namespace string    `json:"namespace"`
-	PodName   string    `json:"pod_name"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+type Pod struct {
+	ID         int64     `json:"id"`
+	Namespace  string    `json:"namespace"`
+	PodName    string    `json:"pod_name"`
+	WorkloadID int64     `json:"workload_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
 type Container struct {
 	ID            int64     `json:"id"`
 	PodID         int64     `json:"pod_id"`
@@ -21,6 +31,14 @@ type Container struct {
 	UpdatedAt     time.Time `json:"updated_at"`
 }
 
+// ContainerLayout is where a container is in its workload's pod template and
+// which resource lists it has, as seen on a live replica.
+type ContainerLayout struct {
+	Index       int  `json:"index"`
+	HasRequests bool `json:"has_requests"`
+	HasLimits   bool `json:"has_limits"`
+}
+
 type MetricsSnapshot struct {
 	ID          int64     `json:"id"`
 	ContainerID int64     `json:"container_id"`
@@ -39,53 +57,271 @@ type ResourceRequest struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
+type ContainerStatus struct {
+	ContainerName         string     `json:"container_name"`
+	RestartCount          int        `json:"restart_count"`
+	Ready                 bool       `json:"ready"`
+	State                 string     `json:"state"`
+	StateReason           string     `json:"state_reason"`
+	LastTerminationReason string     `json:"last_termination_reason"`
+	LastExitCode          *int       `json:"last_exit_code"`
+	LastStartedAt         *time.Time `json:"last_started_at"`
+	LastFinishedAt        *time.Time `json:"last_finished_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+}
+
+// Overrides are the optimizer settings a workload's annotations apply.
+type Overrides struct {
+	Excluded           bool     `json:"excluded"`
+	ExcludedContainers []string `json:"excluded_containers"`
+	Percentile         *float64 `json:"percentile"`
+	Buffer             *float64 `json:"buffer"`
+	MinCPU             *float64 `json:"min_cpu"`
+	MinMemory          *int64   `json:"min_memory"`
+}
+
 type Analysis struct {
-	ID                 int64     `json:"id"`
-	ContainerID        int64     `json:"container_id"`
-	AnalyzedAt         time.Time `json:"analyzed_at"`
-	WindowStart        time.Time `json:"window_start"`
-	WindowEnd          time.Time `json:"window_end"`
-	AvgCPU             float64   `json:"avg_cpu"`
-	MaxCPU             float64   `json:"max_cpu"`
-	P95CPU             float64   `json:"p95_cpu"`
-	P99CPU             float64   `json:"p99_cpu"`
-	AvgMemory          int64     `json:"avg_memory"`
-	MaxMemory          int64     `json:"max_memory"`
-	P95Memory          int64     `json:"p95_memory"`
-	P99Memory          int64     `json:"p99_memory"`
-	CurrentCPURequest  float64   `json:"current_cpu_request"`
-	CurrentMemRequest  int64     `json:"current_mem_request"`
-	RecommendedCPU     float64   `json:"recommended_cpu"`
-	RecommendedMemory  int64     `json:"recommended_memory"`
-	CPUWastePercent    float64   `json:"cpu_waste_percent"`
-	MemoryWastePercent float64   `json:"memory_waste_percent"`
-	MonthlySavings     float64   `json:"monthly_savings"`
-	Status             string    `json:"status"`
-	Confidence         string    `json:"confidence"`
+	ID                     int64     `json:"id"`
+	ContainerID            int64     `json:"container_id"`
+	WorkloadID             int64     `json:"workload_id"`
+	AnalyzedAt             time.Time `json:"analyzed_at"`
+	WindowStart            time.Time `json:"window_start"`
+	WindowEnd              time.Time `json:"window_end"`
+	AvgCPU                 float64   `json:"avg_cpu"`
+	MaxCPU                 float64   `json:"max_cpu"`
+	P95CPU                 float64   `json:"p95_cpu"`
+	P99CPU                 float64   `json:"p99_cpu"`
+	AvgMemory              int64     `json:"avg_memory"`
+	MaxMemory              int64     `json:"max_memory"`
+	P95Memory              int64     `json:"p95_memory"`
+	P99Memory              int64     `json:"p99_memory"`
+	CurrentCPURequest      float64   `json:"current_cpu_request"`
+	CurrentMemRequest      int64     `json:"current_mem_request"`
+	RecommendedCPU         float64   `json:"recommended_cpu"`
+	RecommendedMemory      int64     `json:"recommended_memory"`
+	CPUWastePercent        float64   `json:"cpu_waste_percent"`
+	MemoryWastePercent     float64   `json:"memory_waste_percent"`
+	MonthlySavings         float64   `json:"monthly_savings"`
+	Status                 string    `json:"status"`
+	Confidence             string    `json:"confidence"`
+	P95CPUThrottled        float64   `json:"p95_cpu_throttled"`
+	CurrentCPULimit        float64   `json:"current_cpu_limit"`
+	CurrentMemLimit        int64     `json:"current_mem_limit"`
+	RecommendedCPULimit    float64   `json:"recommended_cpu_limit"`
+	RecommendedMemoryLimit int64     `json:"recommended_memory_limit"`
+	LimitPolicy            string    `json:"limit_policy"`
+	Policy                 string    `json:"policy"`
+
+	// Latest change of requests within the window, if any
+	RequestsChangedAt          *time.Time `json:"requests_changed_at"`
+	CPURequestChangePercent    *float64   `json:"cpu_request_change_percent"`
+	MemoryRequestChangePercent *float64   `json:"memory_request_change_percent"`
+
+	// When the recommended values were first published; they are kept until a
+	// new analysis differs from them significantly
+	StableSince *time.Time `json:"stable_since"`
+}
+
+// RequestChange is one entry of a workload container's request/limit history.
+type RequestChange struct {
+	ContainerName string    `json:"container_name"`
+	ChangedAt     time.Time `json:"changed_at"`
+	CPURequest    float64   `json:"cpu_request"`
+	CPULimit      float64   `json:"cpu_limit"`
+	MemRequest    int64     `json:"mem_request"`
+	MemLimit      int64     `json:"mem_limit"`
 }
 
 type Recommendation struct {
-	ID                int64     `json:"id"`
-	AnalysisID        int64     `json:"analysis_id"`
-	Namespace         string    `json:"namespace"`
-	PodName           string    `json:"pod_name"`
-	ContainerName     string    `json:"container_name"`
-	CurrentCPU        float64   `json:"current_cpu"`
-	CurrentMemory     int64     `json:"current_memory"`
-	RecommendedCPU    float64   `json:"recommended_cpu"`
-	RecommendedMemory int64     `json:"recommended_memory"`
-	MonthlySavings    float64   `json:"monthly_savings"`
-	Confidence        string    `json:"confidence"`
-	Status            string    `json:"status"`
-	Reason            string    `json:"reason"`
-	Applied           bool      `json:"applied"`
-	CreatedAt         time.Time `json:"created_at"`
+	ID                     int64      `json:"id"`
+	AnalysisID             int64      `json:"analysis_id"`
+	Namespace              string     `json:"namespace"`
+	PodName                string     `json:"pod_name"`
+	ContainerName          string     `json:"container_name"`
+	WorkloadKind           string     `json:"workload_kind"`
+	WorkloadName           string     `json:"workload_name"`
+	CurrentCPU             float64    `json:"current_cpu"`
+	CurrentMemory          int64      `json:"current_memory"`
+	RecommendedCPU         float64    `json:"recommended_cpu"`
+	RecommendedMemory      int64      `json:"recommended_memory"`
+	CurrentCPULimit        float64    `json:"current_cpu_limit"`
+	CurrentMemoryLimit     int64      `json:"current_memory_limit"`
+	RecommendedCPULimit    float64    `json:"recommended_cpu_limit"` // 0 means no CPU limit
+	RecommendedMemoryLimit int64      `json:"recommended_memory_limit"`
+	MonthlySavings         float64    `json:"monthly_savings"`
+	Confidence             string     `json:"confidence"`
+	Status                 string     `json:"status"`
+	Reason                 string     `json:"reason"`
+	Applied                bool       `json:"applied"`
+	CreatedAt              time.Time  `json:"created_at"`
+	UpdatedAt              time.Time  `json:"updated_at"`
+	SupersededAt           *time.Time `json:"superseded_at,omitempty"` // nil while live
+	State                  string     `json:"state"`
+	StateChangedAt         *time.Time `json:"state_changed_at,omitempty"`
+	StateActor             string     `json:"state_actor,omitempty"`
+	StateReason            string     `json:"state_reason,omitempty"`
+	SnoozedUntil           *time.Time `json:"snoozed_until,omitempty"`
+
+	// StableSince is when the recommended values were first published, and
+	// StableHours how long they have been stable since.
+	StableSince time.Time `json:"stable_since"`
+	StableHours float64   `json:"stable_hours"`
+
+	// ResizeStatus tracks an in-place resize of the workload's pods until it
+	// completes; empty when the recommendation was not applied by resizing.
+	ResizeStatus    string     `json:"resize_status,omitempty"`
+	ResizeUpdatedAt *time.Time `json:"resize_updated_at,omitempty"`
+
+	// Outcome is the result of verifying the last apply; empty when it was
+	// not verified.
+	Outcome       string `json:"outcome,omitempty"`
+	OutcomeReason string `json:"outcome_reason,omitempty"`
+}
+
+// Resize statuses of a recommendation applied by resizing pods in place,
+// from the PodResizePending and PodResizeInProgress pod conditions.
+const (
+	ResizeRequested  = "requested"
+	ResizeInProgress = "in-progress"
+	ResizeDeferred   = "deferred"   // feasible, but not now
+	ResizeInfeasible = "infeasible" // the node can't fit it
+	ResizeError      = "error"
+	ResizeCompleted  = "completed"
+)
+
+// Outcomes of the verification the collector runs after an apply.
+const (
+	OutcomeVerifying = "verifying" // within the verification period
+	OutcomeVerified  = "verified"  // no regression during the period
+	OutcomeRegressed = "regressed" // a threshold was breached
+)
+
+// Recommendation states. Users move live recommendations between open,
+// accepted, snoozed, dismissed and applied. The collector supersedes them when
+// a newer analysis changes the recommended resources, expires them when their
+// workload stops being analyzed and reopens snoozed ones when they are due.
+const (
+	RecommendationOpen       = "open"
+	RecommendationAccepted   = "accepted"
+	RecommendationDismissed  = "dismissed"
+	RecommendationSnoozed    = "snoozed"
+	RecommendationApplied    = "applied"
+	RecommendationSuperseded = "superseded"
+	RecommendationExpired    = "expired"
+)
+
+// RecommendationStates lists every state, in lifecycle order.
+var RecommendationStates = []string{
+	RecommendationOpen, RecommendationAccepted, RecommendationDismissed, RecommendationSnoozed,
+	RecommendationApplied, RecommendationSuperseded, RecommendationExpired,
+}
+
+// recommendationTransitions are the state changes users may make.
+// Superseded and expired are final.
+var recommendationTransitions = map[string][]string{
+	RecommendationOpen:      {RecommendationAccepted, RecommendationDismissed, RecommendationSnoozed, RecommendationApplied},
+	RecommendationAccepted:  {RecommendationOpen, RecommendationDismissed, RecommendationSnoozed, RecommendationApplied},
+	RecommendationSnoozed:   {RecommendationOpen, RecommendationAccepted, RecommendationDismissed, RecommendationSnoozed, RecommendationApplied},
+	RecommendationDismissed: {RecommendationOpen},
+	RecommendationApplied:   {RecommendationOpen},
+}
+
+// CanTransition reports whether a user may move a recommendation from one
+// state to another.
+func CanTransition(from, to string) bool {
+	for _, s := range recommendationTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Modes of applying a recommendation to the cluster.
+const (
+	ApplyModeWorkload = "workload" // server-side apply to the owning workload
+	ApplyModeResize   = "resize"   // resize the running pods in place
+	ApplyModeManual   = "manual"   // marked applied by a user
+)
+
+// RecommendationApply records a recommendation applied to its workload, with
+// a snapshot of the container's resources before and after. Rolling back
+// restores the snapshot.
+type RecommendationApply struct {
+	ID                    int64     `json:"id"`
+	RecommendationID      int64     `json:"recommendation_id"`
+	Actor                 string    `json:"actor"`
+	Mode                  string    `json:"mode"` // workload, resize or manual
+	Namespace             string    `json:"namespace"`
+	WorkloadKind          string    `json:"workload_kind"`
+	WorkloadName          string    `json:"workload_name"`
+	ContainerName         string    `json:"container_name"`
+	PreviousCPURequest    float64   `json:"previous_cpu_request"`
+	PreviousMemoryRequest int64     `json:"previous_memory_request"`
+	PreviousCPULimit      float64   `json:"previous_cpu_limit"`
+	PreviousMemoryLimit   int64     `json:"previous_memory_limit"`
+	CPURequest            float64   `json:"cpu_request"`
+	MemoryRequest         int64     `json:"memory_request"`
+	CPULimit              float64   `json:"cpu_limit"`
+	MemoryLimit           int64     `json:"memory_limit"`
+	ResourceVersion       string    `json:"resource_version"`
+	CreatedAt             time.Time `json:"created_at"`
+
+	RolledBackAt *time.Time `json:"rolled_back_at,omitempty"`
+	RolledBackBy string     `json:"rolled_back_by,omitempty"`
+
+	// Verification: the outcome, and the signals of the workload's container
+	// observed since the apply
+	Outcome       string     `json:"outcome,omitempty"`
+	OutcomeReason string     `json:"outcome_reason,omitempty"`
+	VerifyUntil   *time.Time `json:"verify_until,omitempty"`
+	VerifiedAt    *time.Time `json:"verified_at,omitempty"` // when the outcome was decided
+	OOMKills      int        `json:"oom_kills"`
+	Restarts      int        `json:"restarts"`
+	Samples       int        `json:"samples"`
+	P95CPU        float64    `json:"p95_cpu"`
+	P95Memory     int64      `json:"p95_memory"`
+	P95Throttled  float64    `json:"p95_throttled"`
+}
+
+// RecommendationEvent is a recorded state change of a recommendation.
+type RecommendationEvent struct {
+	ID               int64      `json:"id"`
+	RecommendationID int64      `json:"recommendation_id"`
+	FromState        string     `json:"from_state"`
+	ToState          string     `json:"to_state"`
+	Actor            string     `json:"actor"`
+	Reason           string     `json:"reason,omitempty"`
+	SnoozedUntil     *time.Time `json:"snoozed_until,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
 }
 
 type PodDetail struct {
+	Namespace          string     `json:"namespace"`
+	PodName            string     `json:"pod_name"`
+	ContainerName      string     `json:"container_name"`
+	Status             string     `json:"status"`
+	CPUWastePercent    float64    `json:"cpu_waste_percent"`
+	MemoryWastePercent float64    `json:"memory_waste_percent"`
+	MonthlySavings     float64    `json:"monthly_savings"`
+	CurrentCPU         float64    `json:"current_cpu"`
+	CurrentMemory      int64      `json:"current_memory"`
+	RecommendedCPU     float64    `json:"recommended_cpu"`
+	RecommendedMemory  int64      `json:"recommended_memory"`
+	Confidence         string     `json:"confidence"`
+	FirstSeenAt        *time.Time `json:"first_seen_at"`
+	LastSeenAt         *time.Time `json:"last_seen_at"`
+	DeletedAt          *time.Time `json:"deleted_at"`        // set once the pod is gone from the cluster
+	RecommendationID   *int64     `json:"recommendation_id"` // live recommendation of the workload container
+}
+
+type WorkloadDetail struct {
+	ID                 int64   `json:"id"`
 	Namespace          string  `json:"namespace"`
-	PodName            string  `json:"pod_name"`
+	Kind               string  `json:"kind"`
+	Name               string  `json:"name"`
 	ContainerName      string  `json:"container_name"`
+	PodCount           int     `json:"pod_count"`
 	Status             string  `json:"status"`
 	CPUWastePercent    float64 `json:"cpu_waste_percent"`
 	MemoryWastePercent float64 `json:"memory_waste_percent"`
@@ -101,6 +337,7 @@ type Statistics struct {
 	TotalPods           int       `json:"total_pods"`
 	OverProvisioned     int       `json:"over_provisioned"`
 	UnderProvisioned    int       `json:"under_provisioned"`
+	AtRisk              int       `json:"at_risk"`
 	Optimal             int       `json:"optimal"`
 	TotalMonthlySavings float64   `json:"total_monthly_savings"`
 	TotalCPUWasteCores  float64   `json:"total_cpu_waste_cores"`
@@ -113,4 +350,9 @@ type UsageHistory struct {
 	Timestamp time.Time `json:"timestamp"`
 	CPU       float64   `json:"cpu"`
 	Memory    int64     `json:"memory"`
+
+	// Set for hourly and daily rollups, where CPU and Memory are averages
+	ContainerName string  `json:"container_name,omitempty"`
+	MaxCPU        float64 `json:"max_cpu,omitempty"`
+	MaxMemory     int64   `json:"max_memory,omitempty"`
 }
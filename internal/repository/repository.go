@@ -2,6 +2,7 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -18,7 +19,9 @@ func NewRepository(db *database.DB) *Repository {
 	return &Repository{db: db}
 }
 
-func (r *Repository) GetPods(namespace, status, sortBy string, limit int) ([]models.PodDetail, error) {
+// GetPods lists analyzed pods; pods gone from the cluster are only included
+// with includeInactive.
+func (r *Repository) GetPods(namespace, status, sortBy string, limit int, includeInactive bool) ([]models.PodDetail, error) {
 	query := `
 		SELECT 
 			p.namespace,
@@ -32,15 +35,25 @@ func (r *Repository) GetPods(namespace, status, sortBy string, limit int) ([]mod
 			a.current_mem_request,
 			a.recommended_cpu,
 			a.recommended_memory,
-			a.confidence
+			a.confidence,
+			p.first_seen_at,
+			p.last_seen_at,
+			p.deleted_at,
+			lr.id
 		FROM pods p
 		JOIN containers c ON c.pod_id = p.id
-		JOIN analyses a ON a.container_id = c.id
+		JOIN analyses a ON a.is_current AND a.workload_id = p.workload_id AND a.container_name = c.container_name
+		LEFT JOIN recommendations lr ON lr.workload_id = p.workload_id AND lr.container_name = c.container_name
+			AND lr.state NOT IN ('superseded', 'expired')
 		WHERE 1=1
 	`
 	args := []interface{}{}
 	argCount := 1
 
+	if !includeInactive {
+		query += " AND p.deleted_at IS NULL"
+	}
+
 	if namespace != "" {
 		query += fmt.Sprintf(" AND p.namespace = $%d", argCount)
 		args = append(args, namespace)
@@ -89,6 +102,10 @@ func (r *Repository) GetPods(namespace, status, sortBy string, limit int) ([]mod
 			&p.RecommendedCPU,
 			&p.RecommendedMemory,
 			&p.Confidence,
+			&p.FirstSeenAt,
+			&p.LastSeenAt,
+			&p.DeletedAt,
+			&p.RecommendationID,
 		)
 		if err != nil {
 			return nil, err
@@ -99,6 +116,98 @@ func (r *Repository) GetPods(namespace, status, sortBy string, limit int) ([]mod
 	return pods, nil
 }
 
+// GetWorkloads lists the current analysis of each workload container;
+// workloads without running pods are only included with includeInactive.
+func (r *Repository) GetWorkloads(namespace, status, sortBy string, limit int, includeInactive bool) ([]models.WorkloadDetail, error) {
+	query := `
+		SELECT 
+			w.id,
+			w.namespace,
+			w.kind,
+			w.name,
+			a.container_name,
+			(SELECT COUNT(*) FROM pods wp WHERE wp.workload_id = w.id AND wp.deleted_at IS NULL) as pod_count,
+			a.status,
+			a.cpu_waste_percent,
+			a.memory_waste_percent,
+			a.monthly_savings,
+			a.current_cpu_request,
+			a.current_mem_request,
+			a.recommended_cpu,
+			a.recommended_memory,
+			a.confidence
+		FROM analyses a
+		JOIN workloads w ON w.id = a.workload_id
+		WHERE a.is_current
+	`
+	args := []interface{}{}
+	argCount := 1
+
+	if !includeInactive {
+		query += " AND EXISTS (SELECT 1 FROM pods ap WHERE ap.workload_id = w.id AND ap.deleted_at IS NULL)"
+	}
+
+	if namespace != "" {
+		query += fmt.Sprintf(" AND w.namespace = $%d", argCount)
+		args = append(args, namespace)
+		argCount++
+	}
+
+	if status != "" {
+		query += fmt.Sprintf(" AND a.status = $%d", argCount)
+		args = append(args, status)
+		argCount++
+	}
+
+	// Default sort by savings descending
+	orderBy := "a.monthly_savings DESC"
+	if sortBy == "waste" {
+		orderBy = "a.cpu_waste_percent DESC"
+	} else if sortBy == "name" {
+		orderBy = "w.name ASC"
+	}
+	query += " ORDER BY " + orderBy
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", argCount)
+		args = append(args, limit)
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var workloads []models.WorkloadDetail
+	for rows.Next() {
+		var w models.WorkloadDetail
+		err := rows.Scan(
+			&w.ID,
+			&w.Namespace,
+			&w.Kind,
+			&w.Name,
+			&w.ContainerName,
+			&w.PodCount,
+			&w.Status,
+			&w.CPUWastePercent,
+			&w.MemoryWastePercent,
+			&w.MonthlySavings,
+			&w.CurrentCPU,
+			&w.CurrentMemory,
+			&w.RecommendedCPU,
+			&w.RecommendedMemory,
+			&w.Confidence,
+		)
+		if err != nil {
+			return nil, err
+		}
+		workloads = append(workloads, w)
+	}
+
+	return workloads, nil
+}
+
 func (r *Repository) GetPodDetail(namespace, podName string) (*models.PodDetail, *models.Analysis, []models.UsageHistory, error) {
 	// Get pod detail
 	query := `
@@ -114,10 +223,16 @@ func (r *Repository) GetPodDetail(namespace, podName string) (*models.PodDetail,
 			a.current_mem_request,
 			a.recommended_cpu,
 			a.recommended_memory,
-			a.confidence
+			a.confidence,
+			p.first_seen_at,
+			p.last_seen_at,
+			p.deleted_at,
+			lr.id
 		FROM pods p
 		JOIN containers c ON c.pod_id = p.id
-		JOIN analyses a ON a.container_id = c.id
+		JOIN analyses a ON a.is_current AND a.workload_id = p.workload_id AND a.container_name = c.container_name
+		LEFT JOIN recommendations lr ON lr.workload_id = p.workload_id AND lr.container_name = c.container_name
+			AND lr.state NOT IN ('superseded', 'expired')
 		WHERE p.namespace = $1 AND p.pod_name = $2
 		LIMIT 1
 	`
@@ -136,6 +251,10 @@ func (r *Repository) GetPodDetail(namespace, podName string) (*models.PodDetail,
 		&pod.RecommendedCPU,
 		&pod.RecommendedMemory,
 		&pod.Confidence,
+		&pod.FirstSeenAt,
+		&pod.LastSeenAt,
+		&pod.DeletedAt,
+		&pod.RecommendationID,
 	)
 	if err != nil {
 		return nil, nil, nil, err
@@ -144,23 +263,28 @@ func (r *Repository) GetPodDetail(namespace, podName string) (*models.PodDetail,
 	// Get full analysis
 	analysisQuery := `
 		SELECT 
-			a.id, a.container_id, a.analyzed_at, a.window_start, a.window_end,
+			a.id, a.container_id, COALESCE(a.workload_id, 0), a.analyzed_at, a.window_start, a.window_end,
 			a.avg_cpu, a.max_cpu, a.p95_cpu, a.p99_cpu,
 			a.avg_memory, a.max_memory, a.p95_memory, a.p99_memory,
 			a.current_cpu_request, a.current_mem_request,
 			a.recommended_cpu, a.recommended_memory,
 			a.cpu_waste_percent, a.memory_waste_percent, a.monthly_savings,
-			a.status, a.confidence
+			a.status, a.confidence,
+			COALESCE(a.p95_cpu_throttled, 0), COALESCE(a.current_cpu_limit, 0), COALESCE(a.current_mem_limit, 0),
+			COALESCE(a.recommended_cpu_limit, 0), COALESCE(a.recommended_memory_limit, 0), COALESCE(a.limit_policy, ''),
+			COALESCE(a.policy, ''),
+			a.requests_changed_at, a.cpu_request_change_percent, a.memory_request_change_percent,
+			a.stable_since
 		FROM pods p
 		JOIN containers c ON c.pod_id = p.id
-		JOIN analyses a ON a.container_id = c.id
+		JOIN analyses a ON a.is_current AND a.workload_id = p.workload_id AND a.container_name = c.container_name
 		WHERE p.namespace = $1 AND p.pod_name = $2
 		LIMIT 1
 	`
 
 	var analysis models.Analysis
 	err = r.db.QueryRow(analysisQuery, namespace, podName).Scan(
-		&analysis.ID, &analysis.ContainerID, &analysis.AnalyzedAt,
+		&analysis.ID, &analysis.ContainerID, &analysis.WorkloadID, &analysis.AnalyzedAt,
 		&analysis.WindowStart, &analysis.WindowEnd,
 		&analysis.AvgCPU, &analysis.MaxCPU, &analysis.P95CPU, &analysis.P99CPU,
 		&analysis.AvgMemory, &analysis.MaxMemory, &analysis.P95Memory, &analysis.P99Memory,
@@ -168,6 +292,11 @@ func (r *Repository) GetPodDetail(namespace, podName string) (*models.PodDetail,
 		&analysis.RecommendedCPU, &analysis.RecommendedMemory,
 		&analysis.CPUWastePercent, &analysis.MemoryWastePercent, &analysis.MonthlySavings,
 		&analysis.Status, &analysis.Confidence,
+		&analysis.P95CPUThrottled, &analysis.CurrentCPULimit, &analysis.CurrentMemLimit,
+		&analysis.RecommendedCPULimit, &analysis.RecommendedMemoryLimit, &analysis.LimitPolicy,
+		&analysis.Policy,
+		&analysis.RequestsChangedAt, &analysis.CPURequestChangePercent, &analysis.MemoryRequestChangePercent,
+		&analysis.StableSince,
 	)
 	if err != nil {
 		return &pod, nil, nil, err
@@ -200,18 +329,212 @@ func (r *Repository) GetPodDetail(namespace, podName string) (*models.PodDetail,
 	return &pod, &analysis, history, nil
 }
 
-func (r *Repository) GetRecommendations(confidence string, minSavings float64, limit int) ([]models.Recommendation, error) {
+// GetUsageHistory returns the usage of the pod's containers since the given
+// time at the given resolution: raw, hourly or daily.
+func (r *Repository) GetUsageHistory(namespace, podName, resolution string, since time.Time) ([]models.UsageHistory, error) {
+	var query string
+	switch resolution {
+	case "raw":
+		query = `
+			SELECT c.container_name, m.timestamp, m.cpu_usage, m.memory_usage, m.cpu_usage, m.memory_usage
+			FROM pods p
+			JOIN containers c ON c.pod_id = p.id
+			JOIN metrics_snapshots m ON m.container_id = c.id
+			WHERE p.namespace = $1 AND p.pod_name = $2 AND m.timestamp >= $3
+			ORDER BY c.container_name, m.timestamp
+		`
+	case "hourly", "daily":
+		query = fmt.Sprintf(`
+			SELECT c.container_name, m.bucket, m.avg_cpu, m.avg_memory, m.max_cpu, m.max_memory
+			FROM pods p
+			JOIN containers c ON c.pod_id = p.id
+			JOIN metrics_%s m ON m.container_id = c.id
+			WHERE p.namespace = $1 AND p.pod_name = $2 AND m.bucket >= $3
+			ORDER BY c.container_name, m.bucket
+		`, resolution)
+	default:
+		return nil, fmt.Errorf("unknown resolution %q", resolution)
+	}
+
+	rows, err := r.db.Query(query, namespace, podName, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []models.UsageHistory{}
+	for rows.Next() {
+		var h models.UsageHistory
+		if err := rows.Scan(&h.ContainerName, &h.Timestamp, &h.CPU, &h.Memory, &h.MaxCPU, &h.MaxMemory); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+
+	return history, nil
+}
+
+func (r *Repository) GetContainerStatuses(namespace, podName string) ([]models.ContainerStatus, error) {
+	query := `
+		SELECT 
+			c.container_name, s.restart_count, COALESCE(s.ready, false),
+			COALESCE(s.state, ''), COALESCE(s.state_reason, ''),
+			COALESCE(s.last_termination_reason, ''), s.last_exit_code,
+			s.last_started_at, s.last_finished_at, s.updated_at
+		FROM pods p
+		JOIN containers c ON c.pod_id = p.id
+		JOIN container_statuses s ON s.container_id = c.id
+		WHERE p.namespace = $1 AND p.pod_name = $2
+		ORDER BY c.container_name
+	`
+
+	rows, err := r.db.Query(query, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []models.ContainerStatus
+	for rows.Next() {
+		var s models.ContainerStatus
+		err := rows.Scan(
+			&s.ContainerName, &s.RestartCount, &s.Ready,
+			&s.State, &s.StateReason,
+			&s.LastTerminationReason, &s.LastExitCode,
+			&s.LastStartedAt, &s.LastFinishedAt, &s.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+
+	return statuses, nil
+}
+
+// GetRequestHistory returns the request/limit changes of the containers of
+// the pod's workload across all its replicas, oldest first.
+func (r *Repository) GetRequestHistory(namespace, podName string) ([]models.RequestChange, error) {
+	query := `
+		SELECT c.container_name, rr.updated_at,
+			COALESCE(rr.cpu_request, 0), COALESCE(rr.cpu_limit, 0),
+			COALESCE(rr.mem_request, 0), COALESCE(rr.mem_limit, 0)
+		FROM pods sp
+		JOIN pods p ON p.workload_id = sp.workload_id
+		JOIN containers c ON c.pod_id = p.id
+		JOIN resource_requests rr ON rr.container_id = c.id
+		WHERE sp.namespace = $1 AND sp.pod_name = $2
+		ORDER BY c.container_name, rr.updated_at
+	`
+
+	rows, err := r.db.Query(query, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Every replica records its own spec; keep only actual changes
+	history := []models.RequestChange{}
+	last := make(map[string]models.RequestChange)
+	for rows.Next() {
+		var rc models.RequestChange
+		err := rows.Scan(
+			&rc.ContainerName, &rc.ChangedAt,
+			&rc.CPURequest, &rc.CPULimit, &rc.MemRequest, &rc.MemLimit,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if prev, ok := last[rc.ContainerName]; ok &&
+			prev.CPURequest == rc.CPURequest && prev.CPULimit == rc.CPULimit &&
+			prev.MemRequest == rc.MemRequest && prev.MemLimit == rc.MemLimit {
+			continue
+		}
+		last[rc.ContainerName] = rc
+		history = append(history, rc)
+	}
+
+	return history, nil
+}
+
+func (r *Repository) GetOverrides(namespace, podName string) (*models.Overrides, error) {
+	query := `
+		SELECT
+			COALESCE(w.excluded, false),
+			w.override_percentile, w.override_buffer, w.override_min_cpu, w.override_min_memory
+		FROM pods p
+		JOIN workloads w ON w.id = p.workload_id
+		WHERE p.namespace = $1 AND p.pod_name = $2
+	`
+
+	overrides := models.Overrides{ExcludedContainers: []string{}}
+	err := r.db.QueryRow(query, namespace, podName).Scan(
+		&overrides.Excluded,
+		&overrides.Percentile, &overrides.Buffer, &overrides.MinCPU, &overrides.MinMemory,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(`
+		SELECT c.container_name
+		FROM pods p
+		JOIN containers c ON c.pod_id = p.id
+		WHERE p.namespace = $1 AND p.pod_name = $2 AND c.excluded
+		ORDER BY c.container_name
+	`, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		overrides.ExcludedContainers = append(overrides.ExcludedContainers, name)
+	}
+
+	return &overrides, nil
+}
+
+// GetRecommendations lists recommendations in the given states, or the live
+// recommendation of each workload container when no state is given,
+// optionally only those whose last apply had the given outcome.
+func (r *Repository) GetRecommendations(confidence string, minSavings float64, limit int, states []string, outcome string) ([]models.Recommendation, error) {
 	query := `
 		SELECT 
-			id, analysis_id, namespace, pod_name, container_name,
+			id, COALESCE(analysis_id, 0), namespace, pod_name, container_name,
+			COALESCE(workload_kind, ''), COALESCE(workload_name, ''),
 			current_cpu, current_memory, recommended_cpu, recommended_memory,
-			monthly_savings, confidence, status, reason, applied, created_at
+			COALESCE(current_cpu_limit, 0), COALESCE(current_memory_limit, 0),
+			COALESCE(recommended_cpu_limit, 0), COALESCE(recommended_memory_limit, 0),
+			monthly_savings, confidence, status, reason, applied, created_at,
+			COALESCE(updated_at, created_at), superseded_at,
+			state, state_changed_at, COALESCE(state_actor, ''), COALESCE(state_reason, ''), snoozed_until,
+			COALESCE(stable_since, created_at), COALESCE(resize_status, ''), resize_updated_at,
+			COALESCE(outcome, ''), COALESCE(outcome_reason, '')
 		FROM recommendations
 		WHERE 1=1
 	`
 	args := []interface{}{}
 	argCount := 1
 
+	if len(states) == 0 {
+		states = []string{
+			models.RecommendationOpen, models.RecommendationAccepted, models.RecommendationDismissed,
+			models.RecommendationSnoozed, models.RecommendationApplied,
+		}
+	}
+	placeholders := make([]string, len(states))
+	for i, state := range states {
+		placeholders[i] = fmt.Sprintf("$%d", argCount)
+		args = append(args, state)
+		argCount++
+	}
+	query += " AND state IN (" + strings.Join(placeholders, ", ") + ")"
+
 	if confidence != "" {
 		query += fmt.Sprintf(" AND confidence = $%d", argCount)
 		args = append(args, confidence)
@@ -224,6 +547,12 @@ func (r *Repository) GetRecommendations(confidence string, minSavings float64, l
 		argCount++
 	}
 
+	if outcome != "" {
+		query += fmt.Sprintf(" AND outcome = $%d", argCount)
+		args = append(args, outcome)
+		argCount++
+	}
+
 	query += " ORDER BY monthly_savings DESC"
 
 	if limit > 0 {
@@ -242,24 +571,48 @@ func (r *Repository) GetRecommendations(confidence string, minSavings float64, l
 		var r models.Recommendation
 		err := rows.Scan(
 			&r.ID, &r.AnalysisID, &r.Namespace, &r.PodName, &r.ContainerName,
+			&r.WorkloadKind, &r.WorkloadName,
 			&r.CurrentCPU, &r.CurrentMemory, &r.RecommendedCPU, &r.RecommendedMemory,
+			&r.CurrentCPULimit, &r.CurrentMemoryLimit, &r.RecommendedCPULimit, &r.RecommendedMemoryLimit,
 			&r.MonthlySavings, &r.Confidence, &r.Status, &r.Reason, &r.Applied, &r.CreatedAt,
+			&r.UpdatedAt, &r.SupersededAt,
+			&r.State, &r.StateChangedAt, &r.StateActor, &r.StateReason, &r.SnoozedUntil,
+			&r.StableSince, &r.ResizeStatus, &r.ResizeUpdatedAt,
+			&r.Outcome, &r.OutcomeReason,
 		)
 		if err != nil {
 			return nil, err
 		}
+		setStableHours(&r)
 		recommendations = append(recommendations, r)
 	}
 
 	return recommendations, nil
 }
 
+// setStableHours sets how long a recommendation's values have been stable, or
+// were until it was superseded.
+func setStableHours(rec *models.Recommendation) {
+	until := time.Now()
+	if rec.SupersededAt != nil {
+		until = *rec.SupersededAt
+	}
+	rec.StableHours = until.Sub(rec.StableSince).Hours()
+}
+
 func (r *Repository) GetRecommendationByID(id int64) (*models.Recommendation, error) {
 	query := `
 		SELECT 
-			id, analysis_id, namespace, pod_name, container_name,
+			id, COALESCE(analysis_id, 0), namespace, pod_name, container_name,
+			COALESCE(workload_kind, ''), COALESCE(workload_name, ''),
 			current_cpu, current_memory, recommended_cpu, recommended_memory,
-			monthly_savings, confidence, status, reason, applied, created_at
+			COALESCE(current_cpu_limit, 0), COALESCE(current_memory_limit, 0),
+			COALESCE(recommended_cpu_limit, 0), COALESCE(recommended_memory_limit, 0),
+			monthly_savings, confidence, status, reason, applied, created_at,
+			COALESCE(updated_at, created_at), superseded_at,
+			state, state_changed_at, COALESCE(state_actor, ''), COALESCE(state_reason, ''), snoozed_until,
+			COALESCE(stable_since, created_at), COALESCE(resize_status, ''), resize_updated_at,
+			COALESCE(outcome, ''), COALESCE(outcome_reason, '')
 		FROM recommendations
 		WHERE id = $1
 	`
@@ -267,31 +620,326 @@ func (r *Repository) GetRecommendationByID(id int64) (*models.Recommendation, er
 	var rec models.Recommendation
 	err := r.db.QueryRow(query, id).Scan(
 		&rec.ID, &rec.AnalysisID, &rec.Namespace, &rec.PodName, &rec.ContainerName,
+		&rec.WorkloadKind, &rec.WorkloadName,
 		&rec.CurrentCPU, &rec.CurrentMemory, &rec.RecommendedCPU, &rec.RecommendedMemory,
+		&rec.CurrentCPULimit, &rec.CurrentMemoryLimit, &rec.RecommendedCPULimit, &rec.RecommendedMemoryLimit,
 		&rec.MonthlySavings, &rec.Confidence, &rec.Status, &rec.Reason, &rec.Applied, &rec.CreatedAt,
+		&rec.UpdatedAt, &rec.SupersededAt,
+		&rec.State, &rec.StateChangedAt, &rec.StateActor, &rec.StateReason, &rec.SnoozedUntil,
+		&rec.StableSince, &rec.ResizeStatus, &rec.ResizeUpdatedAt,
+		&rec.Outcome, &rec.OutcomeReason,
 	)
 	if err != nil {
 		return nil, err
 	}
+	setStableHours(&rec)
 
 	return &rec, nil
 }
 
-func (r *Repository) MarkRecommendationApplied(id int64, applied bool) error {
-	query := `UPDATE recommendations SET applied = $1 WHERE id = $2`
-	_, err := r.db.Exec(query, applied, id)
+// GetContainerLayout returns the layout of a workload's container from its
+// most recently seen live replica, or sql.ErrNoRows when the collector has
+// not recorded it.
+func (r *Repository) GetContainerLayout(namespace, kind, workloadName, containerName string) (models.ContainerLayout, error) {
+	var layout models.ContainerLayout
+	err := r.db.QueryRow(`
+		SELECT c.container_index, c.has_requests, c.has_limits
+		FROM containers c
+		JOIN pods p ON p.id = c.pod_id
+		JOIN workloads w ON w.id = p.workload_id
+		WHERE w.namespace = $1 AND w.kind = $2 AND w.name = $3 AND c.container_name = $4
+			AND p.deleted_at IS NULL
+			AND c.container_index IS NOT NULL AND c.has_requests IS NOT NULL AND c.has_limits IS NOT NULL
+		ORDER BY c.updated_at DESC, c.id DESC
+		LIMIT 1
+	`, namespace, kind, workloadName, containerName).Scan(&layout.Index, &layout.HasRequests, &layout.HasLimits)
+	return layout, err
+}
+
+// ErrInvalidTransition is returned for a state change the recommendation's
+// current state does not allow.
+var ErrInvalidTransition = errors.New("invalid recommendation state transition")
+
+// TransitionRecommendation moves a recommendation to state on behalf of actor
+// and records the change. snoozedUntil is only kept for the snoozed state.
+func (r *Repository) TransitionRecommendation(id int64, state, actor, reason string, snoozedUntil *time.Time) (*models.Recommendation, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := transition(tx, id, state, actor, reason, snoozedUntil, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return r.GetRecommendationByID(id)
+}
+
+// transition moves a recommendation to state within tx, locking it first.
+func transition(tx *sql.Tx, id int64, state, actor, reason string, snoozedUntil *time.Time, now time.Time) error {
+	var from string
+	if err := tx.QueryRow(`SELECT state FROM recommendations WHERE id = $1 FOR UPDATE`, id).Scan(&from); err != nil {
+		return err
+	}
+	if !models.CanTransition(from, state) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, state)
+	}
+	if state != models.RecommendationSnoozed {
+		snoozedUntil = nil
+	}
+
+	_, err := tx.Exec(`
+		UPDATE recommendations SET
+			state = $2, state_changed_at = $3, state_actor = $4, state_reason = NULLIF($5, ''),
+			snoozed_until = $6, applied = $7
+		WHERE id = $1
+	`, id, state, now, actor, reason, snoozedUntil, state == models.RecommendationApplied)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO recommendation_events (recommendation_id, from_state, to_state, actor, reason, snoozed_until, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
+	`, id, from, state, actor, reason, snoozedUntil, now)
 	return err
 }
 
+// RecordApply records a recommendation applied to its workload, with the
+// snapshot rollbacks restore, and moves it to the applied state.
+func (r *Repository) RecordApply(apply *models.RecommendationApply, reason string) (*models.Recommendation, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if reason == "" {
+		reason = fmt.Sprintf("applied to %s %s", apply.WorkloadKind, apply.WorkloadName)
+	}
+	if err := transition(tx, apply.RecommendationID, models.RecommendationApplied, apply.Actor, reason, nil, now); err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO recommendation_applies (
+			recommendation_id, actor, mode, namespace, workload_kind, workload_name, container_name,
+			previous_cpu_request, previous_memory_request, previous_cpu_limit, previous_memory_limit,
+			cpu_request, memory_request, cpu_limit, memory_limit, resource_version, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		RETURNING id
+	`, apply.RecommendationID, apply.Actor, apply.Mode, apply.Namespace, apply.WorkloadKind, apply.WorkloadName, apply.ContainerName,
+		apply.PreviousCPURequest, apply.PreviousMemoryRequest, apply.PreviousCPULimit, apply.PreviousMemoryLimit,
+		apply.CPURequest, apply.MemoryRequest, apply.CPULimit, apply.MemoryLimit, apply.ResourceVersion, now,
+	).Scan(&apply.ID)
+	if err != nil {
+		return nil, err
+	}
+	apply.CreatedAt = now
+
+	// In-place resizes are tracked by the collector until they complete, and
+	// the collector verifies the new apply
+	var resizeStatus *string
+	if apply.Mode == models.ApplyModeResize {
+		status := models.ResizeRequested
+		resizeStatus = &status
+	}
+	_, err = tx.Exec(`
+		UPDATE recommendations SET resize_status = $2, resize_updated_at = $3, outcome = NULL, outcome_reason = NULL
+		WHERE id = $1
+	`, apply.RecommendationID, resizeStatus, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return r.GetRecommendationByID(apply.RecommendationID)
+}
+
+// applyColumns are the recommendation_applies columns scanned by scanApply.
+const applyColumns = `
+	id, recommendation_id, actor, mode, namespace, workload_kind, workload_name, container_name,
+	COALESCE(previous_cpu_request, 0), COALESCE(previous_memory_request, 0),
+	COALESCE(previous_cpu_limit, 0), COALESCE(previous_memory_limit, 0),
+	COALESCE(cpu_request, 0), COALESCE(memory_request, 0),
+	COALESCE(cpu_limit, 0), COALESCE(memory_limit, 0),
+	COALESCE(resource_version, ''), created_at, rolled_back_at, COALESCE(rolled_back_by, ''),
+	COALESCE(outcome, ''), COALESCE(outcome_reason, ''), verify_until, verified_at,
+	COALESCE(oom_kills, 0), COALESCE(restarts, 0), COALESCE(samples, 0),
+	COALESCE(p95_cpu, 0), COALESCE(p95_memory, 0), COALESCE(p95_throttled, 0)`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanApply(row scanner) (models.RecommendationApply, error) {
+	var a models.RecommendationApply
+	err := row.Scan(&a.ID, &a.RecommendationID, &a.Actor, &a.Mode, &a.Namespace, &a.WorkloadKind, &a.WorkloadName, &a.ContainerName,
+		&a.PreviousCPURequest, &a.PreviousMemoryRequest, &a.PreviousCPULimit, &a.PreviousMemoryLimit,
+		&a.CPURequest, &a.MemoryRequest, &a.CPULimit, &a.MemoryLimit,
+		&a.ResourceVersion, &a.CreatedAt, &a.RolledBackAt, &a.RolledBackBy,
+		&a.Outcome, &a.OutcomeReason, &a.VerifyUntil, &a.VerifiedAt,
+		&a.OOMKills, &a.Restarts, &a.Samples,
+		&a.P95CPU, &a.P95Memory, &a.P95Throttled)
+	return a, err
+}
+
+// GetRecommendationApplies returns the applies of a recommendation, oldest
+// first.
+func (r *Repository) GetRecommendationApplies(id int64) ([]models.RecommendationApply, error) {
+	rows, err := r.db.Query(`
+		SELECT `+applyColumns+`
+		FROM recommendation_applies
+		WHERE recommendation_id = $1
+		ORDER BY created_at, id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applies []models.RecommendationApply
+	for rows.Next() {
+		a, err := scanApply(rows)
+		if err != nil {
+			return nil, err
+		}
+		applies = append(applies, a)
+	}
+
+	return applies, rows.Err()
+}
+
+// LatestApply returns the last apply of a recommendation that was not rolled
+// back, or sql.ErrNoRows.
+func (r *Repository) LatestApply(id int64) (*models.RecommendationApply, error) {
+	a, err := scanApply(r.db.QueryRow(`
+		SELECT `+applyColumns+`
+		FROM recommendation_applies
+		WHERE recommendation_id = $1 AND rolled_back_at IS NULL
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+	`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// HasLaterApply reports whether the same container was applied to after a,
+// by any recommendation, without being rolled back.
+func (r *Repository) HasLaterApply(a *models.RecommendationApply) (bool, error) {
+	var later bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM recommendation_applies
+			WHERE namespace = $1 AND workload_kind = $2 AND workload_name = $3 AND container_name = $4
+				AND rolled_back_at IS NULL AND (created_at, id) > ($5, $6)
+		)
+	`, a.Namespace, a.WorkloadKind, a.WorkloadName, a.ContainerName, a.CreatedAt, a.ID).Scan(&later)
+	return later, err
+}
+
+// RecordRollback records that an apply was rolled back to its previous
+// resources and reopens the recommendation if it is still applied. A
+// recommendation that moved on, e.g. superseded, keeps its state.
+func (r *Repository) RecordRollback(apply *models.RecommendationApply, actor, reason string) (*models.Recommendation, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if reason == "" {
+		reason = fmt.Sprintf("rolled back on %s %s", apply.WorkloadKind, apply.WorkloadName)
+	}
+	var state string
+	err = tx.QueryRow(`SELECT state FROM recommendations WHERE id = $1 FOR UPDATE`, apply.RecommendationID).Scan(&state)
+	if err != nil {
+		return nil, err
+	}
+	if state == models.RecommendationApplied {
+		if err := transition(tx, apply.RecommendationID, models.RecommendationOpen, actor, reason, nil, now); err != nil {
+			return nil, err
+		}
+	}
+
+	// A verification in progress stops; a decided outcome is kept
+	_, err = tx.Exec(`
+		UPDATE recommendation_applies SET rolled_back_at = $2, rolled_back_by = $3,
+			outcome = NULLIF(outcome, $4),
+			outcome_reason = CASE WHEN outcome = $4 THEN NULL ELSE outcome_reason END
+		WHERE id = $1 AND rolled_back_at IS NULL
+	`, apply.ID, now, actor, models.OutcomeVerifying)
+	if err != nil {
+		return nil, err
+	}
+	apply.RolledBackAt, apply.RolledBackBy = &now, actor
+	if apply.Outcome == models.OutcomeVerifying {
+		apply.Outcome, apply.OutcomeReason = "", ""
+	}
+
+	_, err = tx.Exec(`
+		UPDATE recommendations SET resize_status = NULL, resize_updated_at = $2,
+			outcome = NULLIF(outcome, $3),
+			outcome_reason = CASE WHEN outcome = $3 THEN NULL ELSE outcome_reason END
+		WHERE id = $1
+	`, apply.RecommendationID, now, models.OutcomeVerifying)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return r.GetRecommendationByID(apply.RecommendationID)
+}
+
+// GetRecommendationEvents returns the state changes of a recommendation,
+// oldest first.
+func (r *Repository) GetRecommendationEvents(id int64) ([]models.RecommendationEvent, error) {
+	rows, err := r.db.Query(`
+		SELECT id, recommendation_id, from_state, to_state, actor, COALESCE(reason, ''), snoozed_until, created_at
+		FROM recommendation_events
+		WHERE recommendation_id = $1
+		ORDER BY created_at, id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.RecommendationEvent
+	for rows.Next() {
+		var e models.RecommendationEvent
+		if err := rows.Scan(&e.ID, &e.RecommendationID, &e.FromState, &e.ToState, &e.Actor, &e.Reason, &e.SnoozedUntil, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
 func (r *Repository) GetStatistics() (*models.Statistics, error) {
 	var stats models.Statistics
 
-	// Get pod counts by status
+	// Get pod counts by status; every replica shares its workload's analysis,
+	// so savings and waste add up over the running replicas
 	statusQuery := `
 		SELECT 
 			COUNT(DISTINCT p.id) as total,
 			COUNT(DISTINCT CASE WHEN a.status = 'over-provisioned' THEN p.id END) as over_prov,
 			COUNT(DISTINCT CASE WHEN a.status = 'under-provisioned' THEN p.id END) as under_prov,
+			COUNT(DISTINCT CASE WHEN a.status = 'at-risk' THEN p.id END) as at_risk,
 			COUNT(DISTINCT CASE WHEN a.status = 'optimal' THEN p.id END) as optimal,
 			COALESCE(SUM(a.monthly_savings), 0) as total_savings,
 			COALESCE(SUM(CASE WHEN a.status = 'over-provisioned' 
@@ -302,13 +950,15 @@ func (r *Repository) GetStatistics() (*models.Statistics, error) {
 				ELSE 0 END), 0) as mem_waste
 		FROM pods p
 		JOIN containers c ON c.pod_id = p.id
-		JOIN analyses a ON a.container_id = c.id
+		JOIN analyses a ON a.is_current AND a.workload_id = p.workload_id AND a.container_name = c.container_name
+		WHERE p.deleted_at IS NULL
 	`
 
 	err := r.db.QueryRow(statusQuery).Scan(
 		&stats.TotalPods,
 		&stats.OverProvisioned,
 		&stats.UnderProvisioned,
+		&stats.AtRisk,
 		&stats.Optimal,
 		&stats.TotalMonthlySavings,
 		&stats.TotalCPUWasteCores,
@@ -334,7 +984,7 @@ func (r *Repository) GetStatistics() (*models.Statistics, error) {
 }
 
 func (r *Repository) GetNamespaces() ([]string, error) {
-	rows, err := r.db.Query("SELECT DISTINCT namespace FROM pods ORDER BY namespace")
+	rows, err := r.db.Query("SELECT DISTINCT namespace FROM pods WHERE deleted_at IS NULL ORDER BY namespace")
 	if err != nil {
 		return nil, err
 	}
@@ -367,11 +1017,17 @@ func (r *Repository) SearchPods(searchTerm string) ([]models.PodDetail, error) {
 			a.current_mem_request,
 			a.recommended_cpu,
 			a.recommended_memory,
-			a.confidence
+			a.confidence,
+			p.first_seen_at,
+			p.last_seen_at,
+			p.deleted_at,
+			lr.id
 		FROM pods p
 		JOIN containers c ON c.pod_id = p.id
-		JOIN analyses a ON a.container_id = c.id
-		WHERE LOWER(p.pod_name) LIKE $1 OR LOWER(p.namespace) LIKE $1
+		JOIN analyses a ON a.is_current AND a.workload_id = p.workload_id AND a.container_name = c.container_name
+		LEFT JOIN recommendations lr ON lr.workload_id = p.workload_id AND lr.container_name = c.container_name
+			AND lr.state NOT IN ('superseded', 'expired')
+		WHERE p.deleted_at IS NULL AND (LOWER(p.pod_name) LIKE $1 OR LOWER(p.namespace) LIKE $1)
 		ORDER BY a.monthly_savings DESC
 		LIMIT 50
 	`
@@ -398,6 +1054,10 @@ func (r *Repository) SearchPods(searchTerm string) ([]models.PodDetail, error) {
 			&p.RecommendedCPU,
 			&p.RecommendedMemory,
 			&p.Confidence,
+			&p.FirstSeenAt,
+			&p.LastSeenAt,
+			&p.DeletedAt,
+			&p.RecommendationID,
 		)
 		if err != nil {
 			return nil, err
@@ -8,6 +8,7 @@ import (
 
 	"github.com/scaleops/k8s-optimizer/internal/config"
 	"github.com/scaleops/k8s-optimizer/internal/database"
+	"github.com/scaleops/k8s-optimizer/internal/models"
 )
 
 func main() {
@@ -40,16 +41,31 @@ func main() {
 	// Generate 50 sample pods
 	for i := 0; i < 50; i++ {
 		namespace := namespaces[rand.Intn(len(namespaces))]
-		podName := fmt.Sprintf("%s-%d", podPrefixes[rand.Intn(len(podPrefixes))], rand.Intn(1000))
+		workloadName := podPrefixes[rand.Intn(len(podPrefixes))]
+		podName := fmt.Sprintf("%s-%d", workloadName, rand.Intn(1000))
+
+		// Insert workload
+		var workloadID int64
+		err := db.QueryRow(`
+			INSERT INTO workloads (namespace, kind, name, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (namespace, kind, name) DO UPDATE SET updated_at = $5
+			RETURNING id
+		`, namespace, "Deployment", workloadName, time.Now(), time.Now()).Scan(&workloadID)
+
+		if err != nil {
+			log.Printf("Error inserting workload: %v", err)
+			continue
+		}
 		
 		// Insert pod
 		var podID int64
-		err := db.QueryRow(`
-			INSERT INTO pods (namespace, pod_name, created_at, updated_at)
-			VALUES ($1, $2, $3, $4)
-			ON CONFLICT (namespace, pod_name) DO UPDATE SET updated_at = $4
+		err = db.QueryRow(`
+			INSERT INTO pods (namespace, pod_name, workload_id, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (namespace, pod_name) DO UPDATE SET workload_id = $3, updated_at = $5
 			RETURNING id
-		`, namespace, podName, time.Now(), time.Now()).Scan(&podID)
+		`, namespace, podName, workloadID, time.Now(), time.Now()).Scan(&podID)
 		
 		if err != nil {
 			log.Printf("Error inserting pod: %v", err)
@@ -115,6 +131,10 @@ func main() {
 		// Recommended resources (p95 + 20% buffer)
 		recommendedCPU := p95CPU * 1.2
 		recommendedMemory := int64(float64(p95Memory) * 1.2)
+
+		// Recommended limits (default headroom policy)
+		recommendedCPULimit := recommendedCPU * 1.2
+		recommendedMemoryLimit := int64(float64(recommendedMemory) * 1.2)
 		
 		// Calculate waste
 		cpuWaste := ((cpuRequest - recommendedCPU) / cpuRequest) * 100
@@ -153,24 +173,37 @@ func main() {
 			confidence = "low"
 		}
 
+		// Replace any earlier seeded analysis and recommendation of the container
+		db.Exec(`UPDATE analyses SET is_current = false WHERE is_current AND workload_id = $1 AND container_name = $2`, workloadID, containerName)
+		db.Exec(`
+			UPDATE recommendations SET state = $3, superseded_at = $4, state_changed_at = $4
+			WHERE state NOT IN ($3, $5) AND workload_id = $1 AND container_name = $2
+		`, workloadID, containerName, models.RecommendationSuperseded, time.Now(), models.RecommendationExpired)
+
 		// Insert analysis
 		var analysisID int64
 		err = db.QueryRow(`
 			INSERT INTO analyses (
-				container_id, analyzed_at, window_start, window_end,
+				container_id, workload_id, analyzed_at, window_start, window_end,
 				avg_cpu, max_cpu, p95_cpu, p99_cpu,
 				avg_memory, max_memory, p95_memory, p99_memory,
 				current_cpu_request, current_mem_request,
 				recommended_cpu, recommended_memory,
 				cpu_waste_percent, memory_waste_percent,
-				monthly_savings, status, confidence
-			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+				monthly_savings, status, confidence,
+				current_cpu_limit, current_mem_limit,
+				recommended_cpu_limit, recommended_memory_limit, limit_policy, policy,
+				container_name, is_current
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, true)
 			RETURNING id
-		`, containerID, time.Now(), time.Now().Add(-7*24*time.Hour), time.Now(),
+		`, containerID, workloadID, time.Now(), time.Now().Add(-7*24*time.Hour), time.Now(),
 			avgCPU, p95CPU*1.1, p95CPU, p95CPU*1.05,
 			avgMemory, p95Memory*110/100, p95Memory, p95Memory*105/100,
 			cpuRequest, memRequest, recommendedCPU, recommendedMemory,
-			cpuWaste, memWaste, monthlySavings, status, confidence).Scan(&analysisID)
+			cpuWaste, memWaste, monthlySavings, status, confidence,
+			cpuRequest*1.5, memRequest*2,
+			recommendedCPULimit, recommendedMemoryLimit, "cpu=headroom,memory=headroom", "default",
+			containerName).Scan(&analysisID)
 		
 		if err != nil {
 			log.Printf("Error inserting analysis: %v", err)
@@ -186,13 +219,16 @@ func main() {
 		_, err = db.Exec(`
 			INSERT INTO recommendations (
 				analysis_id, namespace, pod_name, container_name,
-				current_cpu, current_memory,
-				recommended_cpu, recommended_memory,
-				monthly_savings, confidence, status, reason, applied
-			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+				workload_kind, workload_name,
+				current_cpu, current_memory, current_cpu_limit, current_memory_limit,
+				recommended_cpu, recommended_memory, recommended_cpu_limit, recommended_memory_limit,
+				monthly_savings, confidence, status, reason, applied, workload_id
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
 		`, analysisID, namespace, podName, containerName,
-			cpuRequest, memRequest, recommendedCPU, recommendedMemory,
-			monthlySavings, confidence, status, reason, false)
+			"Deployment", workloadName,
+			cpuRequest, memRequest, cpuRequest*1.5, memRequest*2,
+			recommendedCPU, recommendedMemory, recommendedCPULimit, recommendedMemoryLimit,
+			monthlySavings, confidence, status, reason, false, workloadID)
 		
 		if err != nil {
 			log.Printf("Error inserting recommendation: %v", err)
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/scaleops/k8s-optimizer/internal/apply"
+	"github.com/scaleops/k8s-optimizer/internal/models"
+	"github.com/scaleops/k8s-optimizer/internal/repository"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// POST /api/recommendations/:id/apply/cluster - Apply to the owning workload
+// with server-side apply, or with ?mode=resize resize its running pods in
+// place, falling back to the workload when the cluster can't resize pods;
+// ?dry_run=true returns the server's validated result without persisting it
+func (h *Handler) ApplyRecommendationToCluster(c *gin.Context) {
+	if h.applier == nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Applying to the cluster is disabled; start the web server with -enable-apply or APPLY_ENABLED=true",
+		})
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid recommendation ID",
+		})
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	allowRestart, _ := strconv.ParseBool(c.Query("allow_restart"))
+	mode := c.DefaultQuery("mode", models.ApplyModeWorkload)
+	if mode != models.ApplyModeWorkload && mode != models.ApplyModeResize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid mode, must be workload or resize",
+		})
+		return
+	}
+
+	req, ok := bindTransition(c)
+	if !ok {
+		return
+	}
+
+	rec, err := h.repo.GetRecommendationByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Recommendation not found",
+		})
+		return
+	}
+	if !dryRun && !models.CanTransition(rec.State, models.RecommendationApplied) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Recommendation is " + rec.State + " and cannot be applied",
+		})
+		return
+	}
+	if !apply.Supported(rec.WorkloadKind) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Cannot apply to workloads of kind " + rec.WorkloadKind + "; use the YAML patch instead",
+		})
+		return
+	}
+
+	target := apply.Target{
+		Namespace: rec.Namespace,
+		Kind:      rec.WorkloadKind,
+		Name:      rec.WorkloadName,
+		Container: rec.ContainerName,
+	}
+	resources := apply.Resources{
+		CPURequest:    rec.RecommendedCPU,
+		MemoryRequest: rec.RecommendedMemory,
+		CPULimit:      rec.RecommendedCPULimit,
+		MemoryLimit:   rec.RecommendedMemoryLimit,
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), apply.Timeout)
+	defer cancel()
+	fallback := false
+	if mode == models.ApplyModeResize {
+		supported, err := h.applier.SupportsResize()
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		fallback = !supported
+	}
+
+	var result *apply.Result
+	if mode == models.ApplyModeResize && !fallback {
+		result, err = h.applier.Resize(ctx, target, resources, dryRun, allowRestart)
+	} else {
+		result, err = h.applier.Apply(ctx, target, resources, dryRun)
+	}
+	if err != nil {
+		status, message := applyError(err)
+		c.JSON(status, gin.H{
+			"error":  message,
+			"result": result,
+		})
+		return
+	}
+
+	if dryRun {
+		c.JSON(http.StatusOK, gin.H{
+			"success":  true,
+			"dry_run":  true,
+			"fallback": fallback,
+			"result":   result,
+		})
+		return
+	}
+
+	record := &models.RecommendationApply{
+		RecommendationID:      rec.ID,
+		Actor:                 actorOf(c),
+		Mode:                  result.Mode,
+		Namespace:             target.Namespace,
+		WorkloadKind:          target.Kind,
+		WorkloadName:          target.Name,
+		ContainerName:         target.Container,
+		PreviousCPURequest:    result.Previous.CPURequest,
+		PreviousMemoryRequest: result.Previous.MemoryRequest,
+		PreviousCPULimit:      result.Previous.CPULimit,
+		PreviousMemoryLimit:   result.Previous.MemoryLimit,
+		CPURequest:            result.Applied.CPURequest,
+		MemoryRequest:         result.Applied.MemoryRequest,
+		CPULimit:              result.Applied.CPULimit,
+		MemoryLimit:           result.Applied.MemoryLimit,
+		ResourceVersion:       result.ResourceVersion,
+	}
+	rec, err = h.repo.RecordApply(record, strings.TrimSpace(req.Reason))
+	if err != nil {
+		// The workload changed, so say so even though the record failed
+		status := http.StatusInternalServerError
+		if errors.Is(err, repository.ErrInvalidTransition) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"error":  "Applied to " + target.String() + " but failed to record it: " + err.Error(),
+			"result": result,
+		})
+		return
+	}
+
+	message := "Applied to " + target.String()
+	if result.Mode == models.ApplyModeResize {
+		message = "Resized the running pods of " + target.String()
+	} else if fallback {
+		message += "; the cluster does not support resizing pods in place"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"message":        message,
+		"fallback":       fallback,
+		"recommendation": rec,
+		"apply":          record,
+		"result":         result,
+	})
+}
+
+// GET /api/recommendations/:id/applies - Applies to the cluster, with the
+// previous resources
+func (h *Handler) GetRecommendationApplies(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid recommendation ID",
+		})
+		return
+	}
+
+	applies, err := h.repo.GetRecommendationApplies(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch recommendation applies",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"applies": applies,
+	})
+}
+
+// POST /api/recommendations/:id/rollback - Restore the resources the last
+// apply replaced and reopen the recommendation if it is still applied.
+// Without direct apply, or for kinds it can't apply to, the reverse patch is
+// returned in ?format= for the user to apply; ?dry_run=true previews either
+// without recording it
+func (h *Handler) RollbackRecommendation(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid recommendation ID",
+		})
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	allowRestart, _ := strconv.ParseBool(c.Query("allow_restart"))
+	format := c.DefaultQuery("format", formatStrategic)
+	if !validFormat(format) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid format, must be strategic, json or kubectl",
+		})
+		return
+	}
+
+	req, ok := bindTransition(c)
+	if !ok {
+		return
+	}
+
+	rec, err := h.repo.GetRecommendationByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Recommendation not found",
+		})
+		return
+	}
+	// Superseded recommendations can still be rolled back while their last
+	// apply stands
+	snapshot, err := h.repo.LatestApply(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Recommendation has no apply left to roll back",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch recommendation applies",
+		})
+		return
+	}
+	later, err := h.repo.HasLaterApply(snapshot)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch recommendation applies",
+		})
+		return
+	}
+	if later {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "A later apply replaced these resources, roll that back first",
+		})
+		return
+	}
+
+	target := apply.Target{
+		Namespace: snapshot.Namespace,
+		Kind:      snapshot.WorkloadKind,
+		Name:      snapshot.WorkloadName,
+		Container: snapshot.ContainerName,
+	}
+	previous := apply.Resources{
+		CPURequest:    snapshot.PreviousCPURequest,
+		MemoryRequest: snapshot.PreviousMemoryRequest,
+		CPULimit:      snapshot.PreviousCPULimit,
+		MemoryLimit:   snapshot.PreviousMemoryLimit,
+	}
+
+	response := gin.H{"success": true, "dry_run": dryRun}
+	if h.applier != nil && apply.Supported(target.Kind) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), apply.Timeout)
+		defer cancel()
+
+		var result *apply.Result
+		if snapshot.Mode == models.ApplyModeResize {
+			result, err = h.applier.Resize(ctx, target, previous, dryRun, allowRestart)
+		} else {
+			result, err = h.applier.Apply(ctx, target, previous, dryRun)
+		}
+		if err != nil {
+			status, message := applyError(err)
+			c.JSON(status, gin.H{
+				"error":  message,
+				"result": result,
+			})
+			return
+		}
+		response["message"] = "Restored the previous resources of " + target.String()
+		response["result"] = result
+	} else {
+		patchTarget, ok := patchTargets[target.Kind]
+		if !ok {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error": fmt.Sprintf("Cannot patch %s %s: pod resources are immutable, change the manifest it was created from",
+					target.Kind, target.Name),
+			})
+			return
+		}
+
+		reverse := resourcePatch{
+			container: target.Container,
+			desired:   previous,
+			current: apply.Resources{
+				CPURequest:    snapshot.CPURequest,
+				MemoryRequest: snapshot.MemoryRequest,
+				CPULimit:      snapshot.CPULimit,
+				MemoryLimit:   snapshot.MemoryLimit,
+			},
+		}
+		data, err := renderPatch(reverse, rec, patchTarget, format, h.containerLayout(rec))
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error": "No live replica of the container collected yet, use the strategic format",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to generate patch",
+			})
+			return
+		}
+		response["message"] = "Apply this patch to restore the previous resources of " + target.String()
+		response["format"] = format
+		response["patch"] = string(data)
+		if patchTarget.note != "" {
+			response["note"] = patchTarget.note
+		}
+	}
+
+	if dryRun {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	rec, err = h.repo.RecordRollback(snapshot, actorOf(c), strings.TrimSpace(req.Reason))
+	if err != nil {
+		// The workload may have changed, so return the result anyway
+		status := http.StatusInternalServerError
+		if errors.Is(err, repository.ErrInvalidTransition) {
+			status = http.StatusConflict
+		}
+		response["success"] = false
+		response["error"] = "Rolled back " + target.String() + " but failed to record it: " + err.Error()
+		c.JSON(status, response)
+		return
+	}
+
+	response["recommendation"] = rec
+	response["apply"] = snapshot
+	c.JSON(http.StatusOK, response)
+}
+
+// applyError maps an apply failure to a response status and message.
+func applyError(err error) (int, string) {
+	switch {
+	case errors.Is(err, apply.ErrUnsupportedKind), errors.Is(err, apply.ErrRemoveInPlace):
+		return http.StatusUnprocessableEntity, err.Error()
+	case errors.Is(err, apply.ErrNoPodsResized):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, apply.ErrContainerNotFound), apierrors.IsNotFound(err):
+		return http.StatusNotFound, err.Error()
+	case apierrors.IsConflict(err):
+		return http.StatusConflict, err.Error() + " (set APPLY_FORCE=true to take over fields other managers own)"
+	case apierrors.IsInvalid(err):
+		return http.StatusUnprocessableEntity, err.Error()
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		return http.StatusForbidden, "The web server is not allowed to patch the workload: " + err.Error()
+	}
+	return http.StatusBadGateway, "Failed to apply to the cluster: " + err.Error()
+}
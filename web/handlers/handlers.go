@@ -1,27 +1,34 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/scaleops/k8s-optimizer/internal/apply"
 	"github.com/scaleops/k8s-optimizer/internal/config"
 	"github.com/scaleops/k8s-optimizer/internal/models"
 	"github.com/scaleops/k8s-optimizer/internal/repository"
-	"gopkg.in/yaml.v3"
 )
 
 type Handler struct {
-	repo   *repository.Repository
-	config *config.Config
+	repo    *repository.Repository
+	config  *config.Config
+	applier *apply.Applier // nil unless applying to the cluster is enabled
 }
 
-func NewHandler(repo *repository.Repository, cfg *config.Config) *Handler {
+func NewHandler(repo *repository.Repository, cfg *config.Config, applier *apply.Applier) *Handler {
 	return &Handler{
-		repo:   repo,
-		config: cfg,
+		repo:    repo,
+		config:  cfg,
+		applier: applier,
 	}
 }
 
@@ -36,7 +43,7 @@ func (h *Handler) GetDashboard(c *gin.Context) {
 	}
 
 	// Get top 10 wasteful pods
-	topPods, err := h.repo.GetPods("", "over-provisioned", "savings", 10)
+	topPods, err := h.repo.GetPods("", "over-provisioned", "savings", 10, false)
 	if err != nil {
 		topPods = []models.PodDetail{}
 	}
@@ -53,6 +60,7 @@ func (h *Handler) GetPods(c *gin.Context) {
 	status := c.Query("status")
 	sortBy := c.Query("sort_by")
 	limitStr := c.DefaultQuery("limit", "50")
+	includeInactive, _ := strconv.ParseBool(c.Query("include_inactive"))
 
 	limit, err := strconv.Atoi(limitStr)
 	if err != nil {
@@ -66,7 +74,7 @@ func (h *Handler) GetPods(c *gin.Context) {
 	if searchTerm != "" {
 		pods, err = h.repo.SearchPods(searchTerm)
 	} else {
-		pods, err = h.repo.GetPods(namespace, status, sortBy, limit)
+		pods, err = h.repo.GetPods(namespace, status, sortBy, limit, includeInactive)
 	}
 
 	if err != nil {
@@ -83,6 +91,34 @@ func (h *Handler) GetPods(c *gin.Context) {
 	})
 }
 
+// GET /api/workloads - List analyzed workloads
+func (h *Handler) GetWorkloads(c *gin.Context) {
+	namespace := c.Query("namespace")
+	status := c.Query("status")
+	sortBy := c.Query("sort_by")
+	limitStr := c.DefaultQuery("limit", "50")
+	includeInactive, _ := strconv.ParseBool(c.Query("include_inactive"))
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil {
+		limit = 50
+	}
+
+	workloads, err := h.repo.GetWorkloads(namespace, status, sortBy, limit, includeInactive)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch workloads",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"workloads": workloads,
+		"total":     len(workloads),
+		"page":      1,
+	})
+}
+
 // GET /api/pod/:namespace/:name - Pod detail
 func (h *Handler) GetPodDetail(c *gin.Context) {
 	namespace := c.Param("namespace")
@@ -96,9 +132,79 @@ func (h *Handler) GetPodDetail(c *gin.Context) {
 		return
 	}
 
+	statuses, err := h.repo.GetContainerStatuses(namespace, name)
+	if err != nil {
+		statuses = []models.ContainerStatus{}
+	}
+
+	// Pods without a workload have no overrides
+	overrides, err := h.repo.GetOverrides(namespace, name)
+	if err != nil {
+		overrides = nil
+	}
+
+	requestHistory, err := h.repo.GetRequestHistory(namespace, name)
+	if err != nil {
+		requestHistory = []models.RequestChange{}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"pod":           pod,
-		"analysis":      analysis,
+		"pod":                pod,
+		"analysis":           analysis,
+		"usage_history":      history,
+		"container_statuses": statuses,
+		"overrides":          overrides,
+		"request_history":    requestHistory,
+	})
+}
+
+// GET /api/pod/:namespace/:name/history - Usage history at a resolution
+// suited to the range, e.g. ?range=720h
+func (h *Handler) GetPodHistory(c *gin.Context) {
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	historyRange, err := time.ParseDuration(c.DefaultQuery("range", "24h"))
+	if err != nil || historyRange <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid range",
+		})
+		return
+	}
+	now := time.Now()
+	since := now.Add(-historyRange)
+
+	// Use the finest resolution still retained for the whole range
+	resolution := c.DefaultQuery("resolution", "auto")
+	if resolution == "auto" {
+		rawFrom, hourlyFrom := h.config.Retention.ResolutionBoundaries(now)
+		switch {
+		case !since.Before(rawFrom):
+			resolution = "raw"
+		case !since.Before(hourlyFrom):
+			resolution = "hourly"
+		default:
+			resolution = "daily"
+		}
+	}
+
+	if resolution != "raw" && resolution != "hourly" && resolution != "daily" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid resolution",
+		})
+		return
+	}
+
+	history, err := h.repo.GetUsageHistory(namespace, name, resolution, since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch usage history",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"resolution":    resolution,
 		"usage_history": history,
 	})
 }
@@ -112,7 +218,32 @@ func (h *Handler) GetRecommendations(c *gin.Context) {
 	minSavings, _ := strconv.ParseFloat(minSavingsStr, 64)
 	limit, _ := strconv.Atoi(limitStr)
 
-	recommendations, err := h.repo.GetRecommendations(confidence, minSavings, limit)
+	// Comma-separated states, or "all"; live recommendations by default
+	var states []string
+	if stateParam := c.Query("state"); stateParam == "all" {
+		states = models.RecommendationStates
+	} else if stateParam != "" {
+		for _, state := range strings.Split(stateParam, ",") {
+			state = strings.TrimSpace(state)
+			if !validState(state) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("Invalid state %q", state),
+				})
+				return
+			}
+			states = append(states, state)
+		}
+	}
+
+	outcome := c.Query("outcome")
+	if outcome != "" && outcome != models.OutcomeVerifying && outcome != models.OutcomeVerified && outcome != models.OutcomeRegressed {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid outcome, must be verifying, verified or regressed",
+		})
+		return
+	}
+
+	recommendations, err := h.repo.GetRecommendations(confidence, minSavings, limit, states, outcome)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to fetch recommendations",
@@ -133,7 +264,17 @@ func (h *Handler) GetRecommendations(c *gin.Context) {
 	})
 }
 
-// GET /api/recommendations/:id/yaml - Download YAML patch
+func validState(state string) bool {
+	for _, s := range models.RecommendationStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /api/recommendations/:id/yaml - Download a patch for the owning
+// workload; ?format= strategic (YAML, default), json (RFC 6902) or kubectl
 func (h *Handler) GetRecommendationYAML(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
@@ -144,6 +285,14 @@ func (h *Handler) GetRecommendationYAML(c *gin.Context) {
 		return
 	}
 
+	format := c.DefaultQuery("format", formatStrategic)
+	if !validFormat(format) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid format, must be strategic, json or kubectl",
+		})
+		return
+	}
+
 	rec, err := h.repo.GetRecommendationByID(id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
@@ -152,58 +301,273 @@ func (h *Handler) GetRecommendationYAML(c *gin.Context) {
 		return
 	}
 
-	// Generate YAML patch
-	patch := generateResourcePatch(rec)
+	target, ok := patchTargets[rec.WorkloadKind]
+	if !ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": fmt.Sprintf("Cannot patch %s %s: pod resources are immutable, change the manifest it was created from",
+				rec.WorkloadKind, rec.WorkloadName),
+		})
+		return
+	}
 
-	yamlData, err := yaml.Marshal(patch)
+	data, err := renderPatch(recommendedPatch(rec), rec, target, format, h.containerLayout(rec))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "No live replica of the container collected yet, use the strategic format",
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to generate YAML",
+			"error": "Failed to generate patch",
 		})
 		return
 	}
 
-	// Set headers for download
-	filename := fmt.Sprintf("patch-%s-%s-%s.yaml", rec.Namespace, rec.PodName, rec.ContainerName)
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
-	c.Data(http.StatusOK, "text/yaml", yamlData)
+	if target.note != "" {
+		c.Header("Warning", fmt.Sprintf("299 - %q", target.note))
+	}
+	filename := fmt.Sprintf("patch-%s-%s-%s-%s", rec.Namespace, target.resource, rec.WorkloadName, rec.ContainerName)
+	switch format {
+	case formatJSON:
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.json", filename))
+		c.Data(http.StatusOK, "application/json-patch+json", data)
+	case formatKubectl:
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", data)
+	default:
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.yaml", filename))
+		c.Data(http.StatusOK, "text/yaml", data)
+	}
+}
+
+// containerLayout looks up the layout of a recommendation's container for
+// JSON patches on any live replica of its workload, since the pod it was
+// analyzed on may be gone.
+func (h *Handler) containerLayout(rec *models.Recommendation) func() (models.ContainerLayout, error) {
+	return func() (models.ContainerLayout, error) {
+		return h.repo.GetContainerLayout(rec.Namespace, rec.WorkloadKind, rec.WorkloadName, rec.ContainerName)
+	}
+}
+
+// transitionRequest is the optional body of the recommendation state
+// endpoints.
+type transitionRequest struct {
+	Reason  string `json:"reason"`  // required to dismiss
+	Until   string `json:"until"`   // snooze only: RFC 3339 time or YYYY-MM-DD
+	Applied *bool  `json:"applied"` // apply only: false reopens the recommendation
 }
 
-// POST /api/recommendations/:id/apply - Mark as applied
+// POST /api/recommendations/:id/apply - Mark as applied, snapshotting the
+// current resources for rollback
 func (h *Handler) ApplyRecommendation(c *gin.Context) {
-	idStr := c.Param("id")
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	req, ok := bindTransition(c)
+	if !ok {
+		return
+	}
+
+	if req.Applied != nil && !*req.Applied {
+		h.transition(c, models.RecommendationOpen, req, nil)
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Invalid recommendation ID",
 		})
 		return
 	}
+	rec, err := h.repo.GetRecommendationByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Recommendation not found",
+		})
+		return
+	}
 
-	var body struct {
-		Applied bool `json:"applied"`
+	// Snapshot the resources the recommendation was made against, so the
+	// apply can be rolled back
+	record := &models.RecommendationApply{
+		RecommendationID:      rec.ID,
+		Actor:                 actorOf(c),
+		Mode:                  models.ApplyModeManual,
+		Namespace:             rec.Namespace,
+		WorkloadKind:          rec.WorkloadKind,
+		WorkloadName:          rec.WorkloadName,
+		ContainerName:         rec.ContainerName,
+		PreviousCPURequest:    rec.CurrentCPU,
+		PreviousMemoryRequest: rec.CurrentMemory,
+		PreviousCPULimit:      rec.CurrentCPULimit,
+		PreviousMemoryLimit:   rec.CurrentMemoryLimit,
+		CPURequest:            rec.RecommendedCPU,
+		MemoryRequest:         rec.RecommendedMemory,
+		CPULimit:              rec.RecommendedCPULimit,
+		MemoryLimit:           rec.RecommendedMemoryLimit,
 	}
+	rec, err = h.repo.RecordApply(record, strings.TrimSpace(req.Reason))
+	if transitionError(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"message":        "Recommendation is now " + models.RecommendationApplied,
+		"recommendation": rec,
+		"apply":          record,
+	})
+}
 
-	if err := c.ShouldBindJSON(&body); err != nil {
+// POST /api/recommendations/:id/accept - Accept for later
+func (h *Handler) AcceptRecommendation(c *gin.Context) {
+	if req, ok := bindTransition(c); ok {
+		h.transition(c, models.RecommendationAccepted, req, nil)
+	}
+}
+
+// POST /api/recommendations/:id/dismiss - Dismiss with a reason
+func (h *Handler) DismissRecommendation(c *gin.Context) {
+	req, ok := bindTransition(c)
+	if !ok {
+		return
+	}
+	if strings.TrimSpace(req.Reason) == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid request body",
+			"error": "A reason is required to dismiss a recommendation",
 		})
 		return
 	}
+	h.transition(c, models.RecommendationDismissed, req, nil)
+}
+
+// POST /api/recommendations/:id/snooze - Snooze until a date
+func (h *Handler) SnoozeRecommendation(c *gin.Context) {
+	req, ok := bindTransition(c)
+	if !ok {
+		return
+	}
 
-	if err := h.repo.MarkRecommendationApplied(id, body.Applied); err != nil {
+	until, err := time.Parse(time.RFC3339, req.Until)
+	if err != nil {
+		until, err = time.Parse("2006-01-02", req.Until)
+	}
+	if err != nil || !until.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "until must be a future RFC 3339 time or YYYY-MM-DD date",
+		})
+		return
+	}
+	h.transition(c, models.RecommendationSnoozed, req, &until)
+}
+
+// POST /api/recommendations/:id/reopen - Reopen an accepted, snoozed,
+// dismissed or applied recommendation
+func (h *Handler) ReopenRecommendation(c *gin.Context) {
+	if req, ok := bindTransition(c); ok {
+		h.transition(c, models.RecommendationOpen, req, nil)
+	}
+}
+
+// GET /api/recommendations/:id/events - State change history
+func (h *Handler) GetRecommendationEvents(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid recommendation ID",
+		})
+		return
+	}
+
+	events, err := h.repo.GetRecommendationEvents(id)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to update recommendation",
+			"error": "Failed to fetch recommendation events",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+	})
+}
+
+// bindTransition reads the optional request body, answering the request
+// itself when it is invalid.
+// A JSON content type is required even without a body: browsers preflight it,
+// so other origins can't change state with a simple cross-origin POST.
+func bindTransition(c *gin.Context) (transitionRequest, bool) {
+	var req transitionRequest
+	if c.ContentType() != binding.MIMEJSON {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": "Content-Type must be application/json",
+		})
+		return req, false
+	}
+	if c.Request.ContentLength == 0 {
+		return req, true
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return req, false
+	}
+	return req, true
+}
+
+// actorOf returns who makes a request: the authenticated user, or anonymous
+// when the server runs without auth.
+func actorOf(c *gin.Context) string {
+	if actor := c.GetString(gin.AuthUserKey); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+// transition moves the recommendation in the path to state on behalf of the
+// request's actor.
+func (h *Handler) transition(c *gin.Context, state string, req transitionRequest, snoozedUntil *time.Time) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid recommendation ID",
 		})
 		return
 	}
 
+	rec, err := h.repo.TransitionRecommendation(id, state, actorOf(c), strings.TrimSpace(req.Reason), snoozedUntil)
+	if transitionError(c, err) {
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "Recommendation updated successfully",
+		"success":        true,
+		"message":        "Recommendation is now " + state,
+		"recommendation": rec,
 	})
 }
 
+// transitionError responds to a failed state change and reports whether
+// there was one.
+func transitionError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Recommendation not found",
+		})
+	case errors.Is(err, repository.ErrInvalidTransition):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update recommendation",
+		})
+	}
+	return true
+}
+
 // GET /api/stats - Overall statistics
 func (h *Handler) GetStats(c *gin.Context) {
 	stats, err := h.repo.GetStatistics()
@@ -232,44 +596,6 @@ func (h *Handler) GetNamespaces(c *gin.Context) {
 	})
 }
 
-// Helper function to generate Kubernetes resource patch
-func generateResourcePatch(rec *models.Recommendation) map[string]interface{} {
-	cpuRequest := fmt.Sprintf("%.0fm", rec.RecommendedCPU*1000)
-	memRequest := fmt.Sprintf("%dMi", rec.RecommendedMemory/(1024*1024))
-
-	// Calculate limits (20% headroom)
-	cpuLimit := fmt.Sprintf("%.0fm", rec.RecommendedCPU*1000*1.2)
-	memLimit := fmt.Sprintf("%dMi", rec.RecommendedMemory/(1024*1024)*120/100)
-
-	patch := map[string]interface{}{
-		"apiVersion": "v1",
-		"kind":       "Pod",
-		"metadata": map[string]interface{}{
-			"name":      rec.PodName,
-			"namespace": rec.Namespace,
-		},
-		"spec": map[string]interface{}{
-			"containers": []map[string]interface{}{
-				{
-					"name": rec.ContainerName,
-					"resources": map[string]interface{}{
-						"requests": map[string]interface{}{
-							"cpu":    cpuRequest,
-							"memory": memRequest,
-						},
-						"limits": map[string]interface{}{
-							"cpu":    cpuLimit,
-							"memory": memLimit,
-						},
-					},
-				},
-			},
-		},
-	}
-
-	return patch
-}
-
 // Health check endpoint
 func (h *Handler) HealthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
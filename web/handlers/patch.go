@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/scaleops/k8s-optimizer/internal/apply"
+	"github.com/scaleops/k8s-optimizer/internal/models"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Formats of GET /api/recommendations/:id/yaml.
+const (
+	formatStrategic = "strategic" // strategic merge patch, as YAML
+	formatJSON      = "json"      // RFC 6902 JSON patch
+	formatKubectl   = "kubectl"   // kubectl patch command
+)
+
+func validFormat(format string) bool {
+	return format == formatStrategic || format == formatJSON || format == formatKubectl
+}
+
+// patchTarget is where a workload kind keeps its pod spec.
+type patchTarget struct {
+	resource string   // kubectl resource name
+	podSpec  []string // path of the pod spec in the object
+	note     string   // what else it takes for the patch to take effect
+}
+
+// recreateNote warns that a controller doesn't roll out template changes.
+const recreateNote = "A ReplicaSet doesn't replace its pods when its template changes; delete its pods to recreate them with these resources"
+
+// patchTargets lists the owners whose pod template can be patched. Pods and
+// Jobs are left out: their pod spec resources are immutable. ReplicaSets
+// owned by a Deployment are analyzed as the Deployment, so only bare ones
+// get here.
+var patchTargets = map[string]patchTarget{
+	"Deployment":  {"deployment", []string{"spec", "template", "spec"}, ""},
+	"StatefulSet": {"statefulset", []string{"spec", "template", "spec"}, ""},
+	"DaemonSet":   {"daemonset", []string{"spec", "template", "spec"}, ""},
+	"ReplicaSet":  {"replicaset", []string{"spec", "template", "spec"}, recreateNote},
+	"CronJob":     {"cronjob", []string{"spec", "jobTemplate", "spec", "template", "spec"}, ""},
+}
+
+// resourcePatch changes a container's resources from current to desired. A
+// zero desired value removes the current one.
+type resourcePatch struct {
+	container string
+	desired   apply.Resources
+	current   apply.Resources
+}
+
+// recommendedPatch moves a container to its recommended resources.
+func recommendedPatch(rec *models.Recommendation) resourcePatch {
+	return resourcePatch{
+		container: rec.ContainerName,
+		desired: apply.Resources{
+			CPURequest:    rec.RecommendedCPU,
+			MemoryRequest: rec.RecommendedMemory,
+			CPULimit:      rec.RecommendedCPULimit,
+			MemoryLimit:   rec.RecommendedMemoryLimit,
+		},
+		current: apply.Resources{
+			CPURequest:    rec.CurrentCPU,
+			MemoryRequest: rec.CurrentMemory,
+			CPULimit:      rec.CurrentCPULimit,
+			MemoryLimit:   rec.CurrentMemoryLimit,
+		},
+	}
+}
+
+func cpuQuantity(cores float64) string {
+	return fmt.Sprintf("%.0fm", cores*1000)
+}
+
+// memoryQuantity keeps every byte; whole Mi still render as Mi.
+func memoryQuantity(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+// patchValues returns the desired requests or limits; removed ones are nil.
+func patchValues(cpu, currentCPU float64, memory, currentMemory int64) map[string]interface{} {
+	values := map[string]interface{}{}
+	if cpu > 0 {
+		values["cpu"] = cpuQuantity(cpu)
+	} else if currentCPU > 0 {
+		values["cpu"] = nil
+	}
+	if memory > 0 {
+		values["memory"] = memoryQuantity(memory)
+	} else if currentMemory > 0 {
+		values["memory"] = nil
+	}
+	return values
+}
+
+// strategicPatch returns a strategic merge patch setting the container's
+// resources in the owner's pod template; null removes a value.
+func strategicPatch(p resourcePatch, target patchTarget) map[string]interface{} {
+	resources := map[string]interface{}{}
+	if requests := patchValues(p.desired.CPURequest, p.current.CPURequest, p.desired.MemoryRequest, p.current.MemoryRequest); len(requests) > 0 {
+		resources["requests"] = requests
+	}
+	if limits := patchValues(p.desired.CPULimit, p.current.CPULimit, p.desired.MemoryLimit, p.current.MemoryLimit); len(limits) > 0 {
+		resources["limits"] = limits
+	}
+
+	patch := map[string]interface{}{
+		"containers": []map[string]interface{}{
+			{
+				"name":      p.container,
+				"resources": resources,
+			},
+		},
+	}
+	for i := len(target.podSpec) - 1; i >= 0; i-- {
+		patch = map[string]interface{}{target.podSpec[i]: patch}
+	}
+	return patch
+}
+
+// jsonPatchOp is one RFC 6902 operation.
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// jsonPatch returns an RFC 6902 patch setting the container's resources in
+// the owner's pod template, where layout places it. It starts with a test of
+// the container name, so it fails rather than patch another container if the
+// template changed. Requests and limits are set key by key to keep other
+// resources, such as ephemeral storage.
+func jsonPatch(p resourcePatch, target patchTarget, layout models.ContainerLayout) []jsonPatchOp {
+	container := fmt.Sprintf("/%s/containers/%d", strings.Join(target.podSpec, "/"), layout.Index)
+	ops := []jsonPatchOp{{Op: "test", Path: container + "/name", Value: p.container}}
+
+	ops = append(ops, jsonPatchOps(container+"/resources/requests",
+		patchValues(p.desired.CPURequest, p.current.CPURequest, p.desired.MemoryRequest, p.current.MemoryRequest),
+		layout.HasRequests)...)
+	ops = append(ops, jsonPatchOps(container+"/resources/limits",
+		patchValues(p.desired.CPULimit, p.current.CPULimit, p.desired.MemoryLimit, p.current.MemoryLimit),
+		layout.HasLimits)...)
+	return ops
+}
+
+// jsonPatchOps sets the values of the requests or limits object at path key
+// by key, adding the empty object first when the container lacks it.
+func jsonPatchOps(path string, values map[string]interface{}, exists bool) []jsonPatchOp {
+	var ops []jsonPatchOp
+	for _, name := range []string{"cpu", "memory"} {
+		value, ok := values[name]
+		switch {
+		case !ok:
+		case value == nil:
+			// Nothing to remove from a missing object
+			if exists {
+				ops = append(ops, jsonPatchOp{Op: "remove", Path: path + "/" + name})
+			}
+		default:
+			if !exists {
+				ops = append(ops, jsonPatchOp{Op: "add", Path: path, Value: map[string]interface{}{}})
+				exists = true
+			}
+			ops = append(ops, jsonPatchOp{Op: "add", Path: path + "/" + name, Value: value})
+		}
+	}
+	return ops
+}
+
+// kubectlPatch returns a kubectl command applying the strategic merge patch.
+func kubectlPatch(p resourcePatch, target patchTarget, namespace, name string) (string, error) {
+	data, err := json.Marshal(strategicPatch(p, target))
+	if err != nil {
+		return "", err
+	}
+	// Kubernetes names and quantities never contain single quotes
+	return fmt.Sprintf("kubectl patch %s %s -n %s --type strategic -p '%s'",
+		target.resource, name, namespace, data), nil
+}
+
+// renderPatch renders the patch of a recommendation's workload in format.
+// JSON patches need the container's layout, which layout looks up. The
+// target's note heads the YAML and kubectl formats as a comment.
+func renderPatch(p resourcePatch, rec *models.Recommendation, target patchTarget, format string, layout func() (models.ContainerLayout, error)) ([]byte, error) {
+	comment := ""
+	if target.note != "" {
+		comment = "# " + target.note + "\n"
+	}
+
+	switch format {
+	case formatJSON:
+		l, err := layout()
+		if err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(jsonPatch(p, target, l), "", "  ")
+	case formatKubectl:
+		command, err := kubectlPatch(p, target, rec.Namespace, rec.WorkloadName)
+		return []byte(comment + command + "\n"), err
+	default:
+		data, err := yaml.Marshal(strategicPatch(p, target))
+		return append([]byte(comment), data...), err
+	}
+}
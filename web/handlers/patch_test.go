@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/scaleops/k8s-optimizer/internal/apply"
+	"github.com/scaleops/k8s-optimizer/internal/models"
+)
+
+const mi = 1024 * 1024
+
+func TestJSONPatch(t *testing.T) {
+	target := patchTargets["Deployment"]
+	container := "/spec/template/spec/containers/1"
+	test := jsonPatchOp{Op: "test", Path: container + "/name", Value: "app"}
+
+	tests := []struct {
+		name   string
+		patch  resourcePatch
+		layout models.ContainerLayout
+		want   []jsonPatchOp
+	}{
+		{
+			// Other resources, such as ephemeral storage, stay in place
+			name: "set key by key",
+			patch: resourcePatch{
+				container: "app",
+				desired:   apply.Resources{CPURequest: 0.25, MemoryRequest: 300 * mi},
+			},
+			layout: models.ContainerLayout{Index: 1, HasRequests: true},
+			want: []jsonPatchOp{
+				test,
+				{Op: "add", Path: container + "/resources/requests/cpu", Value: "250m"},
+				{Op: "add", Path: container + "/resources/requests/memory", Value: "300Mi"},
+			},
+		},
+		{
+			name: "missing limits added first",
+			patch: resourcePatch{
+				container: "app",
+				desired:   apply.Resources{CPURequest: 0.25, MemoryLimit: 400 * mi},
+			},
+			layout: models.ContainerLayout{Index: 1, HasRequests: true},
+			want: []jsonPatchOp{
+				test,
+				{Op: "add", Path: container + "/resources/requests/cpu", Value: "250m"},
+				{Op: "add", Path: container + "/resources/limits", Value: map[string]interface{}{}},
+				{Op: "add", Path: container + "/resources/limits/memory", Value: "400Mi"},
+			},
+		},
+		{
+			name: "limit removed",
+			patch: resourcePatch{
+				container: "app",
+				desired:   apply.Resources{MemoryLimit: 400 * mi},
+				current:   apply.Resources{CPULimit: 1, MemoryLimit: 512 * mi},
+			},
+			layout: models.ContainerLayout{Index: 1, HasRequests: true, HasLimits: true},
+			want: []jsonPatchOp{
+				test,
+				{Op: "remove", Path: container + "/resources/limits/cpu"},
+				{Op: "add", Path: container + "/resources/limits/memory", Value: "400Mi"},
+			},
+		},
+		{
+			// Rolling back to a snapshot that wasn't in whole Mi
+			name: "exact bytes",
+			patch: resourcePatch{
+				container: "app",
+				desired:   apply.Resources{MemoryRequest: 1000 * 1000 * 1000, MemoryLimit: 1500*mi + 1},
+				current:   apply.Resources{MemoryRequest: 300 * mi, MemoryLimit: 400 * mi},
+			},
+			layout: models.ContainerLayout{Index: 1, HasRequests: true, HasLimits: true},
+			want: []jsonPatchOp{
+				test,
+				{Op: "add", Path: container + "/resources/requests/memory", Value: "1000000000"},
+				{Op: "add", Path: container + "/resources/limits/memory", Value: "1572864001"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := jsonPatch(tt.patch, target, tt.layout); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderPatchNote(t *testing.T) {
+	rec := &models.Recommendation{Namespace: "shop", WorkloadName: "web", ContainerName: "app"}
+	patch := resourcePatch{container: "app", desired: apply.Resources{CPURequest: 0.25}}
+	noLayout := func() (models.ContainerLayout, error) { return models.ContainerLayout{}, nil }
+
+	for _, format := range []string{formatStrategic, formatKubectl} {
+		data, err := renderPatch(patch, rec, patchTargets["ReplicaSet"], format, noLayout)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !strings.HasPrefix(string(data), "# "+recreateNote+"\n") {
+			t.Errorf("%s: got %q, want it to start with the recreate note", format, data)
+		}
+
+		data, err = renderPatch(patch, rec, patchTargets["Deployment"], format, noLayout)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if strings.HasPrefix(string(data), "#") {
+			t.Errorf("%s: got a note for a Deployment: %q", format, data)
+		}
+	}
+}
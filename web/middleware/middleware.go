@@ -1,7 +1,9 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -43,13 +45,23 @@ func Recovery() gin.HandlerFunc {
 	return gin.Recovery()
 }
 
-// CORS middleware handles Cross-Origin Resource Sharing
-func CORS() gin.HandlerFunc {
+// CORS middleware handles Cross-Origin Resource Sharing for the allowed
+// origins. Requests from other origins get no CORS headers, so browsers keep
+// them same-origin.
+func CORS(allowedOrigins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Add("Vary", "Origin")
+		if origin := c.Request.Header.Get("Origin"); allowed[origin] {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+			c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		}
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -60,17 +72,22 @@ func CORS() gin.HandlerFunc {
 	}
 }
 
-// BasicAuth middleware (optional - for production use)
+// BasicAuth middleware requires the credentials on the routes it guards
 func BasicAuth(username, password string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		user, pass, hasAuth := c.Request.BasicAuth()
 
-		if !hasAuth || user != username || pass != password {
+		// Compare both in constant time so neither leaks through timing
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !hasAuth || !userOK || !passOK {
 			c.Header("WWW-Authenticate", "Basic realm=Authorization Required")
 			c.AbortWithStatus(401)
 			return
 		}
 
+		// Recorded as the actor of recommendation state changes
+		c.Set(gin.AuthUserKey, user)
 		c.Next()
 	}
 }
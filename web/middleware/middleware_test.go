@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestCORS(t *testing.T) {
+	router := gin.New()
+	router.Use(CORS([]string{"https://ops.example.com/"}))
+	router.POST("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		method string
+		origin string
+		status int
+		allow  string
+	}{
+		{http.MethodPost, "https://ops.example.com", http.StatusOK, "https://ops.example.com"},
+		{http.MethodOptions, "https://ops.example.com", http.StatusNoContent, "https://ops.example.com"},
+		{http.MethodOptions, "https://evil.example.com", http.StatusNoContent, ""},
+		{http.MethodPost, "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s from %q: got status %d, want %d", tt.method, tt.origin, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+			t.Errorf("%s from %q: got allowed origin %q, want %q", tt.method, tt.origin, got, tt.allow)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); (got != "") != (tt.allow != "") {
+			t.Errorf("%s from %q: got allow credentials %q", tt.method, tt.origin, got)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	router := gin.New()
+	router.Use(BasicAuth("admin", "secret"))
+	router.POST("/", func(c *gin.Context) { c.String(http.StatusOK, c.GetString(gin.AuthUserKey)) })
+
+	tests := []struct {
+		user, password string
+		status         int
+	}{
+		{"admin", "secret", http.StatusOK},
+		{"admin", "wrong", http.StatusUnauthorized},
+		{"other", "secret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s/%s: got status %d, want %d", tt.user, tt.password, w.Code, tt.status)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "admin" {
+			t.Errorf("got actor %q, want admin", w.Body.String())
+		}
+	}
+}